@@ -0,0 +1,309 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	loglib "github.com/menucha-de/logging"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type amqpclient struct {
+	URI        string
+	vhost      string
+	exchange   string
+	key        string
+	confirm    bool
+	persistent bool
+	timeout    int
+	enc        Encoder
+	retry      *retryPolicy
+	status     *statusTracker
+	metrics    *subscriberMetrics
+	lg         *loglib.Logger
+	certs      string
+	secure     bool
+	tlsConfig  *tls.Config
+	mu         sync.Mutex
+	conn       *amqp.Connection
+	ch         *amqp.Channel
+}
+
+var defaultAMQPTimeout int = 10000
+var amqpTimeoutProperty string = prefix + "AMQP.Timeout"
+var amqpExchangeProperty string = prefix + "AMQP.Exchange"
+var amqpVirtualHostProperty string = prefix + "AMQP.VirtualHost"
+var amqpConfirmProperty string = prefix + "AMQP.Confirm"
+var amqpPersistentProperty string = prefix + "AMQP.Persistent"
+
+func init() {
+	RegisterProvider("amqp", amqpFactory)
+	RegisterProvider("amqps", amqpFactory)
+}
+
+func amqpFactory(s Subscriber) (Provider, bool, error) {
+	p, err := newAMQPProvider(s)
+	if p == nil {
+		return nil, false, err
+	}
+	// keep the client on connection errors, it connects again on publish
+	return p, p.secure, err
+}
+
+func newAMQPProvider(s Subscriber) (*amqpclient, error) {
+	if s.URI == "" {
+		s.logger().Error("URI Can't be null")
+		return nil, errors.New("URI must not be null")
+	}
+	u, err := url.Parse(s.URI)
+	if err != nil {
+		s.logger().Error("Can't parse subscriber URI")
+		return nil, err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "amqp" && scheme != "amqps" {
+		s.logger().Error("Unknown scheme '" + u.Scheme + "'")
+		return nil, errors.New("Unknown scheme '" + u.Scheme + "'")
+	}
+	if u.Hostname() == "" {
+		s.logger().Error("No AMQP host specified")
+		return nil, errors.New("No AMQP host specified")
+	}
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicy(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &amqpclient{
+		vhost:      "/",
+		key:        strings.ReplaceAll(strings.Trim(u.Path, "/"), "/", "."),
+		confirm:    true,
+		persistent: true,
+		timeout:    defaultAMQPTimeout,
+		enc:        enc,
+		retry:      retry,
+		status:     s.status(),
+		metrics:    s.metrics(),
+		lg:         s.logger(),
+		certs:      s.certRoot(),
+		secure:     scheme == "amqps",
+	}
+	for key, property := range s.Properties {
+		if key == "" || !strings.HasPrefix(key, prefix+"AMQP") {
+			continue
+		}
+		switch key {
+		case amqpTimeoutProperty:
+			c.timeout, err = strconv.Atoi(property)
+			if err != nil || c.timeout < 0 {
+				s.logger().Error("Invalid timeout value '" + property + "'")
+				return nil, errors.New("Invalid timeout value '" + property + "'")
+			}
+		case amqpExchangeProperty:
+			c.exchange = property
+		case amqpVirtualHostProperty:
+			if property == "" {
+				s.logger().Error("Invalid " + amqpVirtualHostProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + amqpVirtualHostProperty + " '" + property + "'")
+			}
+			c.vhost = property
+		case amqpConfirmProperty:
+			c.confirm, err = strconv.ParseBool(property)
+			if err != nil {
+				s.logger().Error("Invalid " + amqpConfirmProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + amqpConfirmProperty + " '" + property + "'")
+			}
+		case amqpPersistentProperty:
+			c.persistent, err = strconv.ParseBool(property)
+			if err != nil {
+				s.logger().Error("Invalid " + amqpPersistentProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + amqpPersistentProperty + " '" + property + "'")
+			}
+		default:
+			s.logger().Error("Unknown property key '" + key + "'")
+			return nil, errors.New("Unknown property key '" + key + "'")
+		}
+	}
+	if c.exchange == "" && c.key == "" {
+		s.logger().Error("AMQP routing key must be specified using the path of the URI when publishing to the default exchange")
+		return nil, errors.New("AMQP routing key must be specified using the path of the URI when publishing to the default exchange")
+	}
+
+	// the path holds the routing key, the virtual host is set by a property
+	u.Path = ""
+	u.RawPath = ""
+	c.URI = u.String()
+	if !c.secure {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := c.connect(); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// connect opens the connection and the channel, c.mu has to be held
+func (c *amqpclient) connect() error {
+	if c.conn == nil || c.conn.IsClosed() {
+		if c.secure && c.tlsConfig == nil {
+			return errors.New("TLS not configured")
+		}
+		c.status.setState(StatusConnecting)
+		conn, err := amqp.DialConfig(c.URI, amqp.Config{
+			Vhost:           c.vhost,
+			TLSClientConfig: c.tlsConfig,
+			Dial:            amqp.DefaultDial(time.Duration(c.timeout) * time.Millisecond),
+		})
+		if err != nil {
+			c.lg.Error("Can't connect to AMQP broker: " + err.Error())
+			c.status.disconnected(err)
+			return err
+		}
+		c.conn = conn
+		c.ch = nil
+		c.lg.Info("Connection established")
+		c.status.connected()
+		go c.watch(conn)
+	}
+	if c.ch == nil || c.ch.IsClosed() {
+		ch, err := c.conn.Channel()
+		if err != nil {
+			c.lg.Error("Can't open AMQP channel: " + err.Error())
+			return err
+		}
+		if c.confirm {
+			if err := ch.Confirm(false); err != nil {
+				ch.Close()
+				c.lg.Error("Can't enable AMQP publisher confirms: " + err.Error())
+				return err
+			}
+		}
+		c.ch = ch
+	}
+	return nil
+}
+
+// watch records the loss of the connection, it is opened again by the next
+// publish
+func (c *amqpclient) watch(conn *amqp.Connection) {
+	err, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+	if !ok {
+		// closed by Shutdown or SetTLS
+		return
+	}
+	c.lg.Error("Connection lost " + err.Error())
+	c.status.disconnected(err)
+}
+
+func (c *amqpclient) Publish(ctx context.Context, topic string, message interface{}) error {
+	if c == nil {
+		return errors.New("AMQP client not initialized")
+	}
+
+	key := c.key
+	if topic != "" {
+		topic = strings.ReplaceAll(strings.Trim(topic, "/"), "/", ".")
+		if c.key != "" {
+			key = key + "." + topic
+		} else {
+			key = topic
+		}
+	}
+
+	payload, err := c.enc.Encode(message)
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	msg := amqp.Publishing{
+		ContentType: c.enc.ContentType(),
+		MessageId:   uuid.New().String(),
+		Timestamp:   time.Now(),
+		Body:        payload,
+	}
+	if c.persistent {
+		msg.DeliveryMode = amqp.Persistent
+	}
+	return c.retry.do(ctx, func(ctx context.Context) error {
+		return c.send(ctx, key, msg)
+	})
+}
+
+// send makes a single attempt to publish the message and waits for the
+// confirmation of the broker
+func (c *amqpclient) send(ctx context.Context, key string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.timeout)*time.Millisecond)
+	defer cancel()
+	c.mu.Lock()
+	if err := c.connect(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	confirmation, err := c.ch.PublishWithDeferredConfirmWithContext(ctx, c.exchange, key, false, false, msg)
+	c.mu.Unlock()
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	c.metrics.sent(len(msg.Body))
+	if confirmation == nil {
+		return nil
+	}
+	ack, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		c.lg.Error("AMQP publish not confirmed: " + err.Error())
+		return err
+	}
+	if !ack {
+		c.lg.Error("AMQP publish rejected by the broker")
+		return errors.New("AMQP publish rejected by the broker")
+	}
+	return nil
+}
+
+// close closes the channel and the connection, c.mu has to be held
+func (c *amqpclient) close() {
+	if c.ch != nil {
+		c.ch.Close()
+		c.ch = nil
+	}
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *amqpclient) Shutdown() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.close()
+}
+
+//SetTLS applies the certificates of the subscriber and connects using them
+func (c *amqpclient) SetTLS(id string) error {
+	if !c.secure {
+		return nil
+	}
+	config := newTLSConfig(c.certs+"/"+id, c.lg)
+	u, _ := url.Parse(c.URI)
+	config.ServerName = u.Hostname()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tlsConfig = config
+	c.close()
+	return c.connect()
+}
@@ -0,0 +1,323 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// amqpBroker in-process AMQP 0-9-1 broker implementing the methods used by
+// the provider. Published messages are confirmed unless nack is set.
+type amqpBroker struct {
+	ln       net.Listener
+	nack     int32
+	messages chan amqpMessage
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+type amqpMessage struct {
+	vhost        string
+	exchange     string
+	key          string
+	contentType  string
+	deliveryMode uint8
+	body         []byte
+}
+
+func newAMQPBroker(t *testing.T) *amqpBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &amqpBroker{ln: ln, messages: make(chan amqpMessage, 100)}
+	go b.accept()
+	t.Cleanup(b.close)
+	return b
+}
+
+func (b *amqpBroker) uri(path string) string {
+	return "amqp://guest:guest@" + b.ln.Addr().String() + path
+}
+
+func (b *amqpBroker) accept() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns = append(b.conns, conn)
+		b.mu.Unlock()
+		go b.serve(conn)
+	}
+}
+
+func (b *amqpBroker) close() {
+	b.ln.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.Close()
+	}
+}
+
+func (b *amqpBroker) receive(t *testing.T) amqpMessage {
+	select {
+	case m := <-b.messages:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+	}
+	return amqpMessage{}
+}
+
+func (b *amqpBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	var args bytes.Buffer
+	args.Write([]byte{0, 9})
+	binary.Write(&args, binary.BigEndian, uint32(0))
+	writeAMQPLongstr(&args, "PLAIN")
+	writeAMQPLongstr(&args, "en_US")
+	writeAMQPMethod(conn, 0, 10, 10, args.Bytes())
+
+	var vhost string
+	var confirm bool
+	var tag uint64
+	var msg amqpMessage
+	var size uint64
+	for {
+		typ, channel, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case 1:
+			p := bytes.NewReader(payload)
+			var class, method uint16
+			binary.Read(p, binary.BigEndian, &class)
+			binary.Read(p, binary.BigEndian, &method)
+			switch class<<8 | method {
+			case 10<<8 | 11:
+				// tune without heartbeats
+				args.Reset()
+				binary.Write(&args, binary.BigEndian, uint16(0))
+				binary.Write(&args, binary.BigEndian, uint32(131072))
+				binary.Write(&args, binary.BigEndian, uint16(0))
+				writeAMQPMethod(conn, 0, 10, 30, args.Bytes())
+			case 10<<8 | 40:
+				vhost = readAMQPShortstr(p)
+				writeAMQPMethod(conn, 0, 10, 41, []byte{0})
+			case 10<<8 | 50:
+				writeAMQPMethod(conn, 0, 10, 51, nil)
+				return
+			case 20<<8 | 10:
+				writeAMQPMethod(conn, channel, 20, 11, []byte{0, 0, 0, 0})
+			case 20<<8 | 40:
+				writeAMQPMethod(conn, channel, 20, 41, nil)
+			case 85<<8 | 10:
+				confirm = true
+				writeAMQPMethod(conn, channel, 85, 11, nil)
+			case 60<<8 | 40:
+				p.Seek(2, io.SeekCurrent)
+				msg = amqpMessage{vhost: vhost}
+				msg.exchange = readAMQPShortstr(p)
+				msg.key = readAMQPShortstr(p)
+			}
+		case 2:
+			p := bytes.NewReader(payload)
+			var flags uint16
+			p.Seek(4, io.SeekStart)
+			binary.Read(p, binary.BigEndian, &size)
+			binary.Read(p, binary.BigEndian, &flags)
+			if flags&0x8000 != 0 {
+				msg.contentType = readAMQPShortstr(p)
+			}
+			if flags&0x4000 != 0 {
+				readAMQPShortstr(p)
+			}
+			if flags&0x2000 != 0 {
+				var n uint32
+				binary.Read(p, binary.BigEndian, &n)
+				p.Seek(int64(n), io.SeekCurrent)
+			}
+			if flags&0x1000 != 0 {
+				msg.deliveryMode, _ = p.ReadByte()
+			}
+		case 3:
+			msg.body = append(msg.body, payload...)
+		}
+		if typ != 1 && uint64(len(msg.body)) == size {
+			b.messages <- msg
+			tag++
+			if confirm {
+				var args bytes.Buffer
+				binary.Write(&args, binary.BigEndian, tag)
+				args.WriteByte(0)
+				method := uint16(80)
+				if atomic.LoadInt32(&b.nack) == 1 {
+					method = 120
+				}
+				writeAMQPMethod(conn, channel, 60, method, args.Bytes())
+			}
+		}
+	}
+}
+
+func readAMQPFrame(r *bufio.Reader) (byte, uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:3]), payload[:len(payload)-1], nil
+}
+
+func writeAMQPMethod(w io.Writer, channel uint16, class uint16, method uint16, args []byte) {
+	var frame bytes.Buffer
+	frame.WriteByte(1)
+	binary.Write(&frame, binary.BigEndian, channel)
+	binary.Write(&frame, binary.BigEndian, uint32(4+len(args)))
+	binary.Write(&frame, binary.BigEndian, class)
+	binary.Write(&frame, binary.BigEndian, method)
+	frame.Write(args)
+	frame.WriteByte(0xce)
+	w.Write(frame.Bytes())
+}
+
+func readAMQPShortstr(r *bytes.Reader) string {
+	n, _ := r.ReadByte()
+	b := make([]byte, n)
+	io.ReadFull(r, b)
+	return string(b)
+}
+
+func writeAMQPLongstr(w *bytes.Buffer, s string) {
+	binary.Write(w, binary.BigEndian, uint32(len(s)))
+	w.WriteString(s)
+}
+
+func testAMQPProvider(t *testing.T, uri string, properties map[string]string) *amqpclient {
+	p, err := newAMQPProvider(Subscriber{URI: uri, Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+	return p
+}
+
+func TestAMQPRoutingKey(t *testing.T) {
+	b := newAMQPBroker(t)
+	for _, tc := range []struct {
+		path  string
+		topic string
+		key   string
+	}{
+		{"/a/b", "", "a.b"},
+		{"/a/b", "c/d", "a.b.c.d"},
+		{"/a/b/", "/c/", "a.b.c"},
+		{"", "c/d", "c.d"},
+	} {
+		p := testAMQPProvider(t, b.uri(tc.path), map[string]string{
+			amqpExchangeProperty:    "reports",
+			amqpVirtualHostProperty: "site",
+		})
+		if err := p.Publish(context.Background(), tc.topic, "report"); err != nil {
+			t.Fatal(err)
+		}
+		m := b.receive(t)
+		if m.key != tc.key || m.exchange != "reports" || m.vhost != "site" || string(m.body) != "report" {
+			t.Fatalf("%s and %s published as %+v, want routing key %s", tc.path, tc.topic, m, tc.key)
+		}
+	}
+}
+
+func TestAMQPDefaultExchangeRequiresRoutingKey(t *testing.T) {
+	if _, err := newAMQPProvider(Subscriber{URI: "amqp://127.0.0.1:1"}); err == nil {
+		t.Fatal("default exchange without routing key accepted")
+	}
+}
+
+func TestAMQPPersistentDelivery(t *testing.T) {
+	b := newAMQPBroker(t)
+	for _, tc := range []struct {
+		properties map[string]string
+		mode       uint8
+	}{
+		{nil, 2},
+		{map[string]string{amqpPersistentProperty: "true"}, 2},
+		{map[string]string{amqpPersistentProperty: "false"}, 0},
+	} {
+		p := testAMQPProvider(t, b.uri("/a"), tc.properties)
+		if err := p.Publish(context.Background(), "", map[string]int{"a": 1}); err != nil {
+			t.Fatal(err)
+		}
+		if m := b.receive(t); m.deliveryMode != tc.mode || m.contentType != "application/json" {
+			t.Fatalf("%v published as %+v, want delivery mode %d", tc.properties, m, tc.mode)
+		}
+	}
+}
+
+func TestAMQPNackIsDeliveryError(t *testing.T) {
+	b := newAMQPBroker(t)
+	atomic.StoreInt32(&b.nack, 1)
+	p := testAMQPProvider(t, b.uri("/a"), map[string]string{
+		retryMaxAttemptsProperty:    "2",
+		retryInitialBackoffProperty: "1",
+	})
+	err := p.Publish(context.Background(), "", "report")
+	var derr *deliveryError
+	if !errors.As(err, &derr) || derr.attempts != 2 || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	b.receive(t)
+	b.receive(t)
+
+	atomic.StoreInt32(&b.nack, 0)
+	if err := p.Publish(context.Background(), "", "report"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAMQPReconnect(t *testing.T) {
+	b := newAMQPBroker(t)
+	p := testAMQPProvider(t, b.uri("/a"), map[string]string{retryInitialBackoffProperty: "1"})
+	if err := p.Publish(context.Background(), "", "first"); err != nil {
+		t.Fatal(err)
+	}
+	b.receive(t)
+	// the connection is opened again by the next publish
+	b.mu.Lock()
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.mu.Unlock()
+	waitFor(t, "closed connection", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.conn.IsClosed()
+	})
+	if err := p.Publish(context.Background(), "", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if m := b.receive(t); string(m.body) != "second" {
+		t.Fatalf("received %q", m.body)
+	}
+}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
@@ -14,6 +15,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"software.sslmate.com/src/go-pkcs12"
@@ -22,17 +25,15 @@ import (
 	"github.com/menucha-de/utils"
 )
 
-const certFolder = "./conf/transport/certs"
 const trustFileName = "ca"
 const certFileName = "cert"
 const keystoreFileName = "key"
+const credentialsFileName = "credentials"
 
-var secKeys map[string]string
-
-func getSubscribers(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) getSubscribers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	subscribers := []*Subscriber{}
-	for _, value := range config.Subscribers {
+	for _, value := range t.config.Subscribers {
 		subscribers = append(subscribers, value)
 	}
 	var err = json.NewEncoder(w).Encode(subscribers)
@@ -41,22 +42,22 @@ func getSubscribers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
-func hasTrusted(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) hasTrusted(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
 	vars := mux.Vars(r)
 	id := vars["id"]
-	fileExist := utils.FileExists(certFolder + "/" + id + "/" + trustFileName)
+	fileExist := utils.FileExists(t.certFolder + "/" + id + "/" + trustFileName)
 	n, err := io.WriteString(w, strconv.FormatBool(fileExist))
 	if err != nil && n > 0 {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
-func deleteTrusted(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) deleteTrusted(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	fileExist := utils.FileExists(certFolder + "/" + id + "/" + trustFileName)
+	fileExist := utils.FileExists(t.certFolder + "/" + id + "/" + trustFileName)
 	if fileExist {
-		err := os.Remove(certFolder + "/" + id + "/" + trustFileName)
+		err := os.Remove(t.certFolder + "/" + id + "/" + trustFileName)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -64,13 +65,13 @@ func deleteTrusted(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
-func setTrusted(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) setTrusted(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	if _, err := os.Stat(certFolder + "/" + id); os.IsNotExist(err) {
-		os.MkdirAll(certFolder+"/"+id, 0700)
+	if _, err := os.Stat(t.certFolder + "/" + id); os.IsNotExist(err) {
+		os.MkdirAll(t.certFolder+"/"+id, 0700)
 	}
-	out, err := os.Create(certFolder + "/" + id + "/" + trustFileName)
+	out, err := os.Create(t.certFolder + "/" + id + "/" + trustFileName)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -87,17 +88,17 @@ func setTrusted(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusOK)
 }
-func hasKeyStore(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) hasKeyStore(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
-	fileExist := utils.FileExists(certFolder + "/" + id + "/" + keystoreFileName)
+	fileExist := utils.FileExists(t.certFolder + "/" + id + "/" + keystoreFileName)
 	n, err := io.WriteString(w, strconv.FormatBool(fileExist))
 	if err != nil && n > 0 {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
-func setKeyStore(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) setKeyStore(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
@@ -105,14 +106,16 @@ func setKeyStore(w http.ResponseWriter, r *http.Request) {
 	values, _ := url.ParseQuery(u.RawQuery)
 
 	idd := values.Get("secKey")
-	passphrase, ok := secKeys[idd]
+	t.secKeysMu.Lock()
+	passphrase, ok := t.secKeys[idd]
+	delete(t.secKeys, idd)
+	t.secKeysMu.Unlock()
 	if !ok {
 		http.Error(w, "No passphrase specified", http.StatusInternalServerError)
 		return
 	}
-	delete(secKeys, idd)
-	if _, err := os.Stat(certFolder + "/" + id); os.IsNotExist(err) {
-		os.MkdirAll(certFolder+"/"+id, 0700)
+	if _, err := os.Stat(t.certFolder + "/" + id); os.IsNotExist(err) {
+		os.MkdirAll(t.certFolder+"/"+id, 0700)
 	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -121,13 +124,13 @@ func setKeyStore(w http.ResponseWriter, r *http.Request) {
 	}
 	privateKey, certificate, err := pkcs12.Decode(body, passphrase)
 	if err != nil {
-		lg.Error(err.Error())
+		t.lg.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if err := verify(certificate); err != nil {
-		lg.Error(err.Error())
+		t.lg.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -136,40 +139,40 @@ func setKeyStore(w http.ResponseWriter, r *http.Request) {
 	priv, ok := privateKey.(*rsa.PrivateKey)
 	if !ok {
 		err = errors.New("expected RSA private key type")
-		lg.Error(err.Error())
+		t.lg.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	keyFile, err := os.Create(certFolder + "/" + id + "/" + keystoreFileName)
+	keyFile, err := os.Create(t.certFolder + "/" + id + "/" + keystoreFileName)
 	if err != nil {
-		lg.Error(err.Error())
+		t.lg.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer keyFile.Close()
 	err = pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
 	if err != nil {
-		lg.Error(err.Error())
+		t.lg.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	certFile, err := os.Create(certFolder + "/" + id + "/" + certFileName)
+	certFile, err := os.Create(t.certFolder + "/" + id + "/" + certFileName)
 	if err != nil {
-		lg.Error(err.Error())
+		t.lg.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer certFile.Close()
 	err = pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
 	if err != nil {
-		lg.Error(err.Error())
+		t.lg.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = config.update(id)
+	err = t.config.update(id)
 	if err != nil {
-		lg.Error(err.Error())
+		t.lg.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -177,20 +180,20 @@ func setKeyStore(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
 }
-func deleteKeyStore(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) deleteKeyStore(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	fileExist := utils.FileExists(certFolder + "/" + id + "/" + keystoreFileName)
+	fileExist := utils.FileExists(t.certFolder + "/" + id + "/" + keystoreFileName)
 	if fileExist {
-		err := os.Remove(certFolder + "/" + id + "/" + keystoreFileName)
+		err := os.Remove(t.certFolder + "/" + id + "/" + keystoreFileName)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
-	fileExist = utils.FileExists(certFolder + "/" + id + "/" + certFileName)
+	fileExist = utils.FileExists(t.certFolder + "/" + id + "/" + certFileName)
 	if fileExist {
-		err := os.Remove(certFolder + "/" + id + "/" + certFileName)
+		err := os.Remove(t.certFolder + "/" + id + "/" + certFileName)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -198,7 +201,58 @@ func deleteKeyStore(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
-func setPassphrase(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) hasCredentials(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
+	vars := mux.Vars(r)
+	id := vars["id"]
+	fileExist := utils.FileExists(t.certFolder + "/" + id + "/" + credentialsFileName)
+	n, err := io.WriteString(w, strconv.FormatBool(fileExist))
+	if err != nil && n > 0 {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+func (t *Transport) deleteCredentials(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	fileExist := utils.FileExists(t.certFolder + "/" + id + "/" + credentialsFileName)
+	if fileExist {
+		err := os.Remove(t.certFolder + "/" + id + "/" + credentialsFileName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//setCredentials stores a credentials file of the subscriber, e.g. a NATS
+//creds file or NKey seed, and reconnects the provider using it
+func (t *Transport) setCredentials(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if _, err := os.Stat(t.certFolder + "/" + id); os.IsNotExist(err) {
+		os.MkdirAll(t.certFolder+"/"+id, 0700)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = ioutil.WriteFile(t.certFolder+"/"+id+"/"+credentialsFileName, body, 0600)
+	if err != nil {
+		t.lg.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = t.config.update(id)
+	if err != nil {
+		t.lg.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+func (t *Transport) setPassphrase(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
 	var b bytes.Buffer
 	n, err := b.ReadFrom(r.Body)
@@ -207,13 +261,15 @@ func setPassphrase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	secKey := guuid.New().String()
-	secKeys[secKey] = b.String()
+	t.secKeysMu.Lock()
+	t.secKeys[secKey] = b.String()
+	t.secKeysMu.Unlock()
 	nn, err := io.WriteString(w, secKey)
 	if err != nil && nn > 0 {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
-func addSubscriber(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) addSubscriber(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
 	var subscriber *Subscriber
 
@@ -223,12 +279,12 @@ func addSubscriber(w http.ResponseWriter, r *http.Request) {
 		if errors.As(err, &mr) {
 			http.Error(w, mr.Msg, mr.Status)
 		} else {
-			lg.WithError(err).Error("Failed to get subscriber")
+			t.lg.WithError(err).Error("Failed to get subscriber")
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 		return
 	}
-	id, err := config.add(*subscriber)
+	id, err := t.config.add(*subscriber)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -240,7 +296,7 @@ func addSubscriber(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
-func getSubscriber(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) getSubscriber(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	if strings.TrimSpace(id) == "" {
@@ -248,7 +304,7 @@ func getSubscriber(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var s *Subscriber
-	s, ok := config.Subscribers[id]
+	s, ok := t.config.Subscribers[id]
 	if !ok {
 		http.Error(w, "Subscriber with ID "+id+" does not exist", http.StatusBadRequest)
 		return
@@ -263,7 +319,7 @@ func getSubscriber(w http.ResponseWriter, r *http.Request) {
 }
 
 //todo don't update when locked
-func setSubscriber(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) setSubscriber(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
 	var subscriber *Subscriber
 	vars := mux.Vars(r)
@@ -273,7 +329,7 @@ func setSubscriber(w http.ResponseWriter, r *http.Request) {
 		if errors.As(err, &mr) {
 			http.Error(w, mr.Msg, mr.Status)
 		} else {
-			lg.WithError(err).Error("Failed to get subscriber")
+			t.lg.WithError(err).Error("Failed to get subscriber")
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 		return
@@ -287,7 +343,7 @@ func setSubscriber(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "ID of subscriber does not match ", http.StatusBadRequest)
 		return
 	}
-	err = config.set(*subscriber)
+	err = t.config.set(*subscriber)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -296,7 +352,7 @@ func setSubscriber(w http.ResponseWriter, r *http.Request) {
 }
 
 //todo don't delete when used
-func deleteSubscriber(w http.ResponseWriter, r *http.Request) {
+func (t *Transport) deleteSubscriber(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
 
 	vars := mux.Vars(r)
@@ -305,7 +361,7 @@ func deleteSubscriber(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "ID must not be null", http.StatusBadRequest)
 		return
 	}
-	err := config.delete(id)
+	err := t.config.delete(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -336,3 +392,353 @@ func verify(cert *x509.Certificate) error {
 		return err
 	}
 }
+func (t *Transport) getSubscriptors(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	subscriberID := r.URL.Query().Get("subscriberId")
+	var err = json.NewEncoder(w).Encode(t.manager.list(subscriberID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+func (t *Transport) getSubscriptor(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if strings.TrimSpace(id) == "" {
+		http.Error(w, "ID must not be null", http.StatusBadRequest)
+		return
+	}
+	s, ok := t.manager.get(id)
+	if !ok {
+		http.Error(w, "Subscriptor with ID "+id+" does not exist", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var err = json.NewEncoder(w).Encode(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+func (t *Transport) addSubscriptor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
+	var subscriptor *Subscriptor
+
+	err := utils.DecodeJSONBody(w, r, &subscriptor)
+	if err != nil {
+		var mr *utils.MalformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.Msg, mr.Status)
+		} else {
+			t.lg.WithError(err).Error("Failed to get subscriptor")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	id, err := t.DefineSubscriptor(*subscriptor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n, err := io.WriteString(w, id)
+	if err != nil && n > 0 {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+func (t *Transport) setSubscriptor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
+	var subscriptor *Subscriptor
+	vars := mux.Vars(r)
+	err := utils.DecodeJSONBody(w, r, &subscriptor)
+	if err != nil {
+		var mr *utils.MalformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.Msg, mr.Status)
+		} else {
+			t.lg.WithError(err).Error("Failed to get subscriptor")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	id := vars["id"]
+	if strings.TrimSpace(id) == "" {
+		http.Error(w, "ID must not be null", http.StatusBadRequest)
+		return
+	}
+	if subscriptor.ID != id {
+		http.Error(w, "ID of subscriptor does not match ", http.StatusBadRequest)
+		return
+	}
+	err = t.UpdateSubscriptor(*subscriptor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func (t *Transport) enableSubscriptor(w http.ResponseWriter, r *http.Request) {
+	t.setSubscriptorEnable(w, r, true)
+}
+func (t *Transport) disableSubscriptor(w http.ResponseWriter, r *http.Request) {
+	t.setSubscriptorEnable(w, r, false)
+}
+func (t *Transport) setSubscriptorEnable(w http.ResponseWriter, r *http.Request, enable bool) {
+	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if strings.TrimSpace(id) == "" {
+		http.Error(w, "ID must not be null", http.StatusBadRequest)
+		return
+	}
+	s, ok := t.manager.get(id)
+	if !ok {
+		http.Error(w, "Subscriptor with ID "+id+" does not exist", http.StatusNotFound)
+		return
+	}
+	if s.Enable != enable {
+		s.Enable = enable
+		err := t.UpdateSubscriptor(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func (t *Transport) deleteSubscriptor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	if strings.TrimSpace(id) == "" {
+		http.Error(w, "ID must not be null", http.StatusBadRequest)
+		return
+	}
+	err := t.DeleteSubscriptor(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func (t *Transport) getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	letters, err := t.deadLetters(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(letters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+func (t *Transport) purgeDeadLetterList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
+	vars := mux.Vars(r)
+	id := vars["id"]
+	err := t.purgeDeadLetters(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func (t *Transport) getDeadLetterEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	letterID := vars["letterId"]
+	d, ok, err := t.getDeadLetter(id, letterID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		http.Error(w, "Dead letter with ID "+letterID+" does not exist", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+func (t *Transport) replayDeadLetterEntry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
+	vars := mux.Vars(r)
+	id := vars["id"]
+	letterID := vars["letterId"]
+	if _, ok, err := t.getDeadLetter(id, letterID); err == nil && !ok {
+		http.Error(w, "Dead letter with ID "+letterID+" does not exist", http.StatusNotFound)
+		return
+	}
+	err := t.replayDeadLetter(r.Context(), id, letterID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func (t *Transport) deleteDeadLetterEntry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
+	vars := mux.Vars(r)
+	id := vars["id"]
+	letterID := vars["letterId"]
+	if _, ok, err := t.getDeadLetter(id, letterID); err == nil && !ok {
+		http.Error(w, "Dead letter with ID "+letterID+" does not exist", http.StatusNotFound)
+		return
+	}
+	err := t.deleteDeadLetter(id, letterID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func (t *Transport) getCircuits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	var err = json.NewEncoder(w).Encode(t.circuits())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+func (t *Transport) getCircuit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	c, err := t.circuit(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+func (t *Transport) resetCircuitBreaker(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "plain/text; charset=UTF-8")
+	vars := mux.Vars(r)
+	id := vars["id"]
+	err := t.resetCircuit(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func (t *Transport) getSubscriberStatuses(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	var err = json.NewEncoder(w).Encode(t.subscriberStatuses())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+func (t *Transport) getSubscriberStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	s, err := t.status(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+func (t *Transport) getMetrics(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&t.metricsEnabled) == 0 {
+		http.Error(w, "Metrics are not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := t.writeMetrics(w)
+	if err != nil {
+		t.lg.WithError(err).Warning("Failed to write metrics")
+	}
+}
+func (t *Transport) testSubscriberDefinition(w http.ResponseWriter, r *http.Request) {
+	var subscriber *Subscriber
+	err := utils.DecodeJSONBody(w, r, &subscriber)
+	if err != nil {
+		var mr *utils.MalformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.Msg, mr.Status)
+		} else {
+			t.lg.WithError(err).Error("Failed to get subscriber")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	// the definition must not use the certificates and credentials of a
+	// stored subscriber
+	subscriber.ID = guuid.New().String()
+	t.writeDiagnostic(w, r, *subscriber)
+}
+func (t *Transport) testStoredSubscriber(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	t.config.mu.RLock()
+	s, ok := t.config.Subscribers[id]
+	var subscriber Subscriber
+	if ok {
+		subscriber = *s
+	}
+	t.config.mu.RUnlock()
+	if !ok {
+		http.Error(w, "Subscriber with ID "+id+" does not exist", http.StatusNotFound)
+		return
+	}
+	t.writeDiagnostic(w, r, subscriber)
+}
+func (t *Transport) writeDiagnostic(w http.ResponseWriter, r *http.Request, s Subscriber) {
+	timeout := defaultTestTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		var err error
+		timeout, err = strconv.Atoi(value)
+		if err != nil || timeout <= 0 {
+			http.Error(w, "Invalid timeout value '"+value+"'", http.StatusBadRequest)
+			return
+		}
+	}
+	publish, _ := strconv.ParseBool(r.URL.Query().Get("publish"))
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	d := t.testSubscriber(ctx, s, publish)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err := json.NewEncoder(w).Encode(d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+func (t *Transport) getStreamEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	st, err := t.lookupStream(vars["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	st.serveEvents(w, r)
+}
+func (t *Transport) getStreamWebSocket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	st, err := t.lookupStream(vars["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	st.serveWebSocket(w, r)
+}
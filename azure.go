@@ -5,7 +5,6 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
@@ -13,31 +12,55 @@ import (
 
 	"github.com/amenzhinsky/iothub/iotdevice"
 	iotmqtt "github.com/amenzhinsky/iothub/iotdevice/transport/mqtt"
+	loglib "github.com/menucha-de/logging"
 )
 
 type azureclient struct {
 	client  *iotdevice.Client
 	timeout int
+	enc     Encoder
+	retry   *retryPolicy
+	status  *statusTracker
+	metrics *subscriberMetrics
+	lg      *loglib.Logger
 }
 
 var azureTimeoutProperty string = prefix + "Azure.Timeout"
 var azureOnDemand string = prefix + "Azure.OnDemand"
 
+func init() {
+	RegisterProvider("azure", func(s Subscriber) (Provider, bool, error) {
+		p, err := newAzureProvider(s)
+		if err != nil {
+			return nil, false, err
+		}
+		return p, false, nil
+	})
+}
+
 func newAzureProvider(s Subscriber) (*azureclient, error) {
 
 	defaultTimeout = 1000
 	if s.URI == "" {
-		lg.Error("URI Can't be null")
+		s.logger().Error("URI Can't be null")
 		return nil, errors.New("URI must not be null")
 	}
 	u, err := url.Parse(s.URI)
 	if err != nil {
-		lg.Error("Can't parse subscriber URI")
+		s.logger().Error("Can't parse subscriber URI")
 		return nil, err
 	}
 	connectDirectly := true
 	connectionString := u.Host
 	timeout := defaultTimeout
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicy(s)
+	if err != nil {
+		return nil, err
+	}
 
 	if s.Properties != nil {
 		for key, property := range s.Properties {
@@ -46,27 +69,27 @@ func newAzureProvider(s Subscriber) (*azureclient, error) {
 				case azureTimeoutProperty:
 					timeout, err := strconv.Atoi(property)
 					if err != nil {
-						lg.Error("Invalid timeout value '" + property + "'")
+						s.logger().Error("Invalid timeout value '" + property + "'")
 						return nil, errors.New("Invalid timeout value '" + property + "'")
 
 					}
 
 					if timeout < 0 {
-						lg.Error("Invalid timeout value '" + property + "'")
+						s.logger().Error("Invalid timeout value '" + property + "'")
 						return nil, errors.New("Invalid timeout value '" + property + "'")
 
 					}
 				case azureOnDemand:
 					b, err := strconv.ParseBool(property)
 					if err != nil {
-						lg.Error("Invalid " + azureOnDemand + " '" + property + "'")
+						s.logger().Error("Invalid " + azureOnDemand + " '" + property + "'")
 						return nil, errors.New("Invalid " + azureOnDemand + " '" + property + "'")
 
 					}
 					connectDirectly = b
 
 				default:
-					lg.Error("Unknown property key '" + key + "'")
+					s.logger().Error("Unknown property key '" + key + "'")
 					return nil, errors.New("Unknown property key '" + key + "'")
 				}
 
@@ -77,39 +100,53 @@ func newAzureProvider(s Subscriber) (*azureclient, error) {
 		iotmqtt.New(), connectionString,
 	)
 	if err != nil {
-		lg.Error(err.Error())
+		s.logger().Error(err.Error())
 		return nil, err
 	}
 	if connectDirectly {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
 		defer cancel()
 		if err = c.Connect(ctx); err != nil {
-			lg.Error("Failed to connect to azure subscriptor " + connectionString)
+			s.logger().Error("Failed to connect to azure subscriptor " + connectionString)
 			return nil, err
 		}
+		s.status().connected()
 
 	}
 
-	return &azureclient{client: c, timeout: timeout}, nil
+	return &azureclient{client: c, timeout: timeout, enc: enc, retry: retry, status: s.status(), metrics: s.metrics(), lg: s.logger()}, nil
+}
+func (c *azureclient) Publish(ctx context.Context, topic string, message interface{}) error {
+	str, err := c.enc.Encode(message)
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	return c.retry.do(ctx, func(ctx context.Context) error {
+		return c.send(ctx, str)
+	})
 }
-func (c *azureclient) Publish(topic string, message interface{}) {
-	if err := c.client.Connect(context.Background()); err != nil {
-		lg.Error("Failed to connect to azure subscriptor ")
 
-		return
+// send makes a single attempt to deliver the encoded report
+func (c *azureclient) send(ctx context.Context, str []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.timeout)*time.Millisecond)
+	defer cancel()
+	if err := c.client.Connect(ctx); err != nil {
+		c.lg.Error("Failed to connect to azure subscriptor ")
+		c.status.disconnected(err)
+		return err
 	}
-	str := fmt.Sprintf("%v", message)
+	defer c.client.Close()
+	c.status.connected()
 	// send a device-to-cloud message
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.timeout)*time.Millisecond)
-	defer cancel()
-
-	if err := c.client.SendEvent(ctx, []byte(str),
+	if err := c.client.SendEvent(ctx, str,
 		iotdevice.WithSendMessageID(genID()),
 	); err != nil {
-		lg.Error(err.Error())
+		c.lg.Error(err.Error())
+		return err
 	}
-	//iotservice.WithSendExpiryTime(time.Now().Add(c.timeout*time.Second))
-	c.client.Close()
+	c.metrics.sent(len(str))
+	return nil
 }
 func (c *azureclient) Shutdown() {
 	if c != nil {
@@ -0,0 +1,251 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	loglib "github.com/menucha-de/logging"
+)
+
+var breakerThresholdProperty string = prefix + "CircuitBreaker.Threshold"
+var breakerOpenTimeoutProperty string = prefix + "CircuitBreaker.OpenTimeout"
+var breakerHalfOpenProperty string = prefix + "CircuitBreaker.HalfOpenRequests"
+
+var defaultBreakerThreshold int = 5
+var defaultBreakerOpenTimeout int = 30000
+var defaultBreakerHalfOpen int = 1
+
+//ErrCircuitOpen is returned by publishes of a subscriber whose circuit
+//breaker is open
+var ErrCircuitOpen = errors.New("Circuit breaker is open")
+
+//Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+//CircuitState state of the circuit breaker of a subscriber
+type CircuitState struct {
+	SubscriberID string     `json:"subscriberId"`
+	State        string     `json:"state"`
+	Failures     int        `json:"failures"`
+	OpenedAt     *time.Time `json:"openedAt,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+// breaker circuit breaker wrapped around the provider of a subscriber. It
+// opens after threshold consecutive failures, rejects publishes until the
+// open timeout elapsed and closes again once a half open probe succeeds.
+type breaker struct {
+	Provider
+	mu          sync.Mutex
+	threshold   int
+	openTimeout time.Duration
+	halfOpen    int
+	state       string
+	failures    int
+	probes      int
+	openedAt    time.Time
+	lastError   string
+	status      *statusTracker
+	metrics     *subscriberMetrics
+	lg          *loglib.Logger
+}
+
+func newBreaker(p Provider, s Subscriber) (*breaker, error) {
+	b := &breaker{
+		Provider:    p,
+		threshold:   defaultBreakerThreshold,
+		openTimeout: time.Duration(defaultBreakerOpenTimeout) * time.Millisecond,
+		halfOpen:    defaultBreakerHalfOpen,
+		state:       CircuitClosed,
+		lg:          s.logger(),
+	}
+	for key, property := range s.Properties {
+		switch key {
+		case breakerThresholdProperty:
+			threshold, err := strconv.Atoi(property)
+			if err != nil || threshold < 0 {
+				s.logger().Error("Invalid circuit breaker threshold '" + property + "'")
+				return nil, errors.New("Invalid circuit breaker threshold '" + property + "'")
+			}
+			b.threshold = threshold
+		case breakerOpenTimeoutProperty:
+			timeout, err := strconv.Atoi(property)
+			if err != nil || timeout < 0 {
+				s.logger().Error("Invalid circuit breaker open timeout '" + property + "'")
+				return nil, errors.New("Invalid circuit breaker open timeout '" + property + "'")
+			}
+			b.openTimeout = time.Duration(timeout) * time.Millisecond
+		case breakerHalfOpenProperty:
+			n, err := strconv.Atoi(property)
+			if err != nil || n < 1 {
+				s.logger().Error("Invalid circuit breaker half open requests '" + property + "'")
+				return nil, errors.New("Invalid circuit breaker half open requests '" + property + "'")
+			}
+			b.halfOpen = n
+		}
+	}
+	return b, nil
+}
+
+//Publish publishes the report unless the circuit is open
+func (b *breaker) Publish(ctx context.Context, topic string, m interface{}) error {
+	start := time.Now()
+	if b.threshold == 0 {
+		err := b.Provider.Publish(ctx, topic, m)
+		b.status.published(err)
+		b.metrics.published(time.Since(start), err)
+		return err
+	}
+	probe, err := b.allow()
+	if err != nil {
+		b.metrics.shortCircuited()
+		return err
+	}
+	err = b.Provider.Publish(ctx, topic, m)
+	b.done(ctx, probe, err)
+	b.status.published(err)
+	b.metrics.published(time.Since(start), err)
+	return err
+}
+
+// allow returns whether the publish may pass and whether it is a probe
+func (b *breaker) allow() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false, ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		b.probes = 0
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probes >= b.halfOpen {
+			return false, ErrCircuitOpen
+		}
+		b.probes++
+		return true, nil
+	}
+	return false, nil
+}
+
+// done records the result of a publish and releases the probe slot.
+// Cancelled publishes and publishes still in flight do not count as failures
+// of the destination. A permanent failure was answered by the destination,
+// like a success it closes the circuit.
+func (b *breaker) done(ctx context.Context, probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe && b.probes > 0 {
+		b.probes--
+	}
+	if err != nil && (inFlight(err) || ctx.Err() != nil) {
+		return
+	}
+	if err == nil || permanentFailure(err) {
+		if b.state != CircuitClosed {
+			b.lg.Info("Circuit breaker closed")
+		}
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.lastError = err.Error()
+	if b.state == CircuitHalfOpen || (b.state == CircuitClosed && b.failures >= b.threshold) {
+		b.lg.WithError(err).Warning("Circuit breaker opened")
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// reset closes the circuit
+func (b *breaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = CircuitClosed
+	b.failures = 0
+	b.probes = 0
+}
+
+func (b *breaker) circuitState(id string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := CircuitState{
+		SubscriberID: id,
+		State:        b.state,
+		Failures:     b.failures,
+		LastError:    b.lastError,
+	}
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.openTimeout {
+		c.State = CircuitHalfOpen
+	}
+	if b.state != CircuitClosed {
+		openedAt := b.openedAt.UTC()
+		c.OpenedAt = &openedAt
+	}
+	return c
+}
+
+//Drain waits for the deliveries of the wrapped provider
+func (b *breaker) Drain(ctx context.Context) error {
+	if d, ok := b.Provider.(Drainer); ok {
+		return d.Drain(ctx)
+	}
+	return nil
+}
+
+// circuits returns the circuit breaker states of the connected subscribers
+func (t *Transport) circuits() []CircuitState {
+	t.config.mu.RLock()
+	defer t.config.mu.RUnlock()
+	result := []CircuitState{}
+	for id, s := range t.config.Subscribers {
+		if b, ok := s.Provider.(*breaker); ok {
+			result = append(result, b.circuitState(id))
+		}
+	}
+	return result
+}
+
+// circuit returns the circuit breaker state of the subscriber
+func (t *Transport) circuit(id string) (CircuitState, error) {
+	t.config.mu.RLock()
+	defer t.config.mu.RUnlock()
+	s, ok := t.config.Subscribers[id]
+	if !ok {
+		return CircuitState{}, errors.New("Subscriber with ID " + id + " does not exist")
+	}
+	b, ok := s.Provider.(*breaker)
+	if !ok {
+		return CircuitState{}, errors.New("Subscriber with ID " + id + " is not connected")
+	}
+	return b.circuitState(id), nil
+}
+
+// resetCircuit closes the circuit breaker of the subscriber
+func (t *Transport) resetCircuit(id string) error {
+	t.config.mu.RLock()
+	defer t.config.mu.RUnlock()
+	s, ok := t.config.Subscribers[id]
+	if !ok {
+		return errors.New("Subscriber with ID " + id + " does not exist")
+	}
+	b, ok := s.Provider.(*breaker)
+	if !ok {
+		return errors.New("Subscriber with ID " + id + " is not connected")
+	}
+	b.reset()
+	if o := t.getOutbox(id); o != nil {
+		o.notify()
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBreakerShortCircuitsNotCountedAsFailures(t *testing.T) {
+	b, err := newBreaker(&fakeProvider{host: "fail"}, Subscriber{Properties: map[string]string{
+		breakerThresholdProperty: "2",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &subscriberMetrics{buckets: make([]uint64, len(latencyBuckets))}
+	b.metrics = m
+	for i := 0; i < 2; i++ {
+		if err := b.Publish(context.Background(), "a", "report"); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if state := b.circuitState("x").State; state != CircuitOpen {
+		t.Fatalf("circuit %s, want open", state)
+	}
+	before := fakeCount("fail")
+	for i := 0; i < 3; i++ {
+		if err := b.Publish(context.Background(), "a", "report"); err != ErrCircuitOpen {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if fakeCount("fail") != before {
+		t.Fatal("publish passed the open circuit")
+	}
+	if m.publishes != 2 || m.failures != 2 || m.count != 2 || m.shortCircuits != 3 {
+		t.Fatalf("publishes %d, failures %d, latency samples %d, short circuits %d", m.publishes, m.failures, m.count, m.shortCircuits)
+	}
+}
+
+func TestWriteMetricsShortCircuits(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	tr.subscriberMetrics("x", "fake").shortCircuited()
+	var b bytes.Buffer
+	if err := tr.writeMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `transport_publish_short_circuits_total{subscriber="x",scheme="fake"} 1`) {
+		t.Fatalf("short circuits not written:\n%s", b.String())
+	}
+}
+
+// resultProvider returns the configured result, publishes block while
+// release is set
+type resultProvider struct {
+	mu      sync.Mutex
+	err     error
+	release chan struct{}
+}
+
+func (p *resultProvider) set(err error, release chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err, p.release = err, release
+}
+
+func (p *resultProvider) Publish(ctx context.Context, topic string, m interface{}) error {
+	p.mu.Lock()
+	err, release := p.err, p.release
+	p.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+	return err
+}
+
+func (p *resultProvider) Shutdown() {}
+
+func (p *resultProvider) SetTLS(id string) error {
+	return nil
+}
+
+func testBreaker(t *testing.T, halfOpen string) (*breaker, *resultProvider) {
+	p := &resultProvider{}
+	b, err := newBreaker(p, Subscriber{Properties: map[string]string{
+		breakerThresholdProperty:   "2",
+		breakerOpenTimeoutProperty: "20",
+		breakerHalfOpenProperty:    halfOpen,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, p
+}
+
+func checkCircuit(t *testing.T, b *breaker, want string) {
+	t.Helper()
+	if state := b.circuitState("x").State; state != want {
+		t.Fatalf("circuit %s, want %s", state, want)
+	}
+}
+
+// openCircuit fails publishes until the circuit opens and waits for the
+// open timeout
+func openCircuit(t *testing.T, b *breaker, p *resultProvider) {
+	t.Helper()
+	p.set(errors.New("unreachable"), nil)
+	for i := 0; i < 2; i++ {
+		checkCircuit(t, b, CircuitClosed)
+		b.Publish(context.Background(), "a", "report")
+	}
+	checkCircuit(t, b, CircuitOpen)
+	if err := b.Publish(context.Background(), "a", "report"); err != ErrCircuitOpen {
+		t.Fatalf("open circuit returned %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	checkCircuit(t, b, CircuitHalfOpen)
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		probe error
+		want  string
+	}{
+		{"success closes", nil, CircuitClosed},
+		{"permanent failure closes", &deliveryError{err: errors.New("rejected"), permanent: true}, CircuitClosed},
+		{"failure reopens", errors.New("unreachable"), CircuitOpen},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, p := testBreaker(t, "1")
+			openCircuit(t, b, p)
+			p.set(tc.probe, nil)
+			if err := b.Publish(context.Background(), "a", "report"); err != tc.probe {
+				t.Fatalf("probe returned %v", err)
+			}
+			checkCircuit(t, b, tc.want)
+			if tc.want == CircuitClosed && b.failures != 0 {
+				t.Fatalf("%d failures after closing", b.failures)
+			}
+		})
+	}
+}
+
+func TestBreakerHalfOpenProbes(t *testing.T) {
+	b, p := testBreaker(t, "2")
+	openCircuit(t, b, p)
+	release := make(chan struct{})
+	p.set(ErrPublishInFlight, release)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Publish(context.Background(), "a", "report")
+		}()
+	}
+	waitFor(t, "probes", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.probes == 2
+	})
+	// all probe slots are taken
+	if err := b.Publish(context.Background(), "a", "report"); err != ErrCircuitOpen {
+		t.Fatalf("publish beyond the half open requests returned %v", err)
+	}
+	close(release)
+	wg.Wait()
+	// unconfirmed probes release their slots without a result
+	checkCircuit(t, b, CircuitHalfOpen)
+	p.set(nil, nil)
+	if err := b.Publish(context.Background(), "a", "report"); err != nil {
+		t.Fatal(err)
+	}
+	checkCircuit(t, b, CircuitClosed)
+}
+
+func TestBreakerCancelledProbe(t *testing.T) {
+	b, p := testBreaker(t, "1")
+	openCircuit(t, b, p)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.set(context.Canceled, nil)
+	b.Publish(ctx, "a", "report")
+	checkCircuit(t, b, CircuitHalfOpen)
+	// the slot of the cancelled probe is free again
+	p.set(nil, nil)
+	if err := b.Publish(context.Background(), "a", "report"); err != nil {
+		t.Fatal(err)
+	}
+	checkCircuit(t, b, CircuitClosed)
+}
+
+func TestBreakerResetDuringProbe(t *testing.T) {
+	b, p := testBreaker(t, "1")
+	openCircuit(t, b, p)
+	release := make(chan struct{})
+	p.set(ErrPublishInFlight, release)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Publish(context.Background(), "a", "report")
+	}()
+	waitFor(t, "probe", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.probes == 1
+	})
+	b.reset()
+	close(release)
+	<-done
+	if b.probes != 0 {
+		t.Fatalf("%d probes after reset", b.probes)
+	}
+}
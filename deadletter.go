@@ -0,0 +1,302 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+var deadLetterDirectoryProperty string = prefix + "DeadLetter.Directory"
+var deadLetterSubscriberProperty string = prefix + "DeadLetter.Subscriber"
+
+const deadLetterExt = ".json"
+
+//DeadLetter report which could not be delivered to a subscriber
+type DeadLetter struct {
+	ID           string    `json:"id"`
+	SubscriberID string    `json:"subscriberId"`
+	Path         string    `json:"path,omitempty"`
+	Attempts     int       `json:"attempts"`
+	Error        string    `json:"error"`
+	Timestamp    time.Time `json:"timestamp"`
+	Payload      []byte    `json:"payload"`
+}
+
+// deadLetterSink destination of the dead letters of a subscriber, either a
+// directory or another subscriber
+type deadLetterSink struct {
+	directory  string
+	subscriber string
+}
+
+func newDeadLetterSink(s Subscriber) (*deadLetterSink, error) {
+	directory := strings.TrimSpace(s.Properties[deadLetterDirectoryProperty])
+	subscriber := strings.TrimSpace(s.Properties[deadLetterSubscriberProperty])
+	if directory == "" && subscriber == "" {
+		return nil, nil
+	}
+	if directory != "" && subscriber != "" {
+		s.logger().Error("Only one dead letter destination may be configured")
+		return nil, errors.New("Only one dead letter destination may be configured")
+	}
+	if subscriber == s.ID {
+		s.logger().Error("Subscriber can't be its own dead letter destination")
+		return nil, errors.New("Subscriber can't be its own dead letter destination")
+	}
+	if directory != "" {
+		// the directory is kept inside of the configuration directory
+		clean := filepath.Clean(directory)
+		if filepath.IsAbs(directory) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			s.logger().Error("Invalid " + deadLetterDirectoryProperty + " '" + directory + "'")
+			return nil, errors.New("Invalid " + deadLetterDirectoryProperty + " '" + directory + "', must be a relative path inside of the configuration directory")
+		}
+		root := dirname
+		if s.t != nil {
+			root = s.t.dir
+		}
+		directory = filepath.Join(root, clean)
+	}
+	return &deadLetterSink{directory: directory, subscriber: subscriber}, nil
+}
+
+// deliveryAttempts returns the number of attempts made to deliver a report
+func deliveryAttempts(err error) int {
+	var d *deliveryError
+	if errors.As(err, &d) {
+		return d.attempts
+	}
+	return 1
+}
+
+// permanentFailure returns whether retrying the delivery is pointless
+func permanentFailure(err error) bool {
+	var d *deliveryError
+	return errors.As(err, &d) && d.permanent
+}
+
+// deadLetter hands a report which could not be delivered to the dead letter
+// destination of the subscriber. It returns false if the subscriber has no
+// destination or the destination failed.
+func (t *Transport) deadLetter(s *Subscriber, topic string, report interface{}, cause error) bool {
+	sink, err := newDeadLetterSink(*s)
+	if err != nil || sink == nil {
+		return false
+	}
+	payload, ok := report.([]byte)
+	if !ok {
+		enc, err := newEncoder(*s)
+		if err != nil {
+			return false
+		}
+		payload, err = enc.Encode(report)
+		if err != nil {
+			t.lg.WithError(err).Error("Failed to encode dead letter")
+			return false
+		}
+	}
+	d := DeadLetter{
+		ID:           guuid.New().String(),
+		SubscriberID: s.ID,
+		Path:         topic,
+		Attempts:     deliveryAttempts(cause),
+		Timestamp:    time.Now().UTC(),
+		Payload:      payload,
+	}
+	if cause != nil {
+		d.Error = cause.Error()
+	}
+	if sink.directory != "" {
+		err = writeDeadLetter(sink.directory, d)
+	} else {
+		err = t.forwardDeadLetter(sink.subscriber, d)
+	}
+	if err != nil {
+		t.lg.WithError(err).Error("Failed to dead letter report of subscriber " + s.ID)
+		return false
+	}
+	t.lg.Warning("Report of subscriber " + s.ID + " dead lettered: " + d.Error)
+	return true
+}
+
+// discard hands a report which will not be delivered to the dead letter
+// destination of the subscriber. Reports of subscribers without destination
+// are dropped. It returns false if the destination failed.
+func (t *Transport) discard(s *Subscriber, topic string, report interface{}, cause error) bool {
+	sink, err := newDeadLetterSink(*s)
+	if err == nil && sink == nil {
+		t.lg.WithError(cause).Warning("Dropping undeliverable report of subscriber " + s.ID)
+		return true
+	}
+	return t.deadLetter(s, topic, report, cause)
+}
+
+// forwardDeadLetter publishes the dead letter to another subscriber, the
+// report is not retried nor dead lettered again
+func (t *Transport) forwardDeadLetter(id string, d DeadLetter) error {
+	s, ok := t.subscriber(id)
+	if !ok || s.Provider == nil {
+		return errors.New("Dead letter subscriber with ID " + id + " is not connected")
+	}
+	return s.Provider.Publish(context.Background(), d.Path, d)
+}
+
+func writeDeadLetter(directory string, d DeadLetter) error {
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		os.MkdirAll(directory, 0700)
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(directory, d.ID+deadLetterExt)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// deadLetterDirectory returns the dead letter directory of the subscriber
+func (t *Transport) deadLetterDirectory(id string) (string, error) {
+	s, ok := t.subscriber(id)
+	if !ok {
+		return "", errors.New("Subscriber with ID " + id + " does not exist")
+	}
+	sink, err := newDeadLetterSink(s)
+	if err != nil {
+		return "", err
+	}
+	if sink == nil || sink.directory == "" {
+		return "", errors.New("Subscriber with ID " + id + " has no dead letter directory")
+	}
+	return sink.directory, nil
+}
+
+// deadLetters returns the dead letters of the subscriber, the oldest first
+func (t *Transport) deadLetters(id string) ([]DeadLetter, error) {
+	directory, err := t.deadLetterDirectory(id)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []DeadLetter{}, nil
+		}
+		return nil, err
+	}
+	result := []DeadLetter{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), deadLetterExt) {
+			continue
+		}
+		d, err := readDeadLetter(filepath.Join(directory, f.Name()))
+		if err != nil {
+			t.lg.WithError(err).Warning("Failed to read dead letter " + f.Name())
+			continue
+		}
+		if d.SubscriberID == id {
+			result = append(result, d)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Timestamp.Before(result[j].Timestamp)
+	})
+	return result, nil
+}
+
+// getDeadLetter returns a dead letter of the subscriber
+func (t *Transport) getDeadLetter(id string, letterID string) (DeadLetter, bool, error) {
+	directory, err := t.deadLetterDirectory(id)
+	if err != nil {
+		return DeadLetter{}, false, err
+	}
+	if _, err := guuid.Parse(letterID); err != nil {
+		return DeadLetter{}, false, nil
+	}
+	d, err := readDeadLetter(filepath.Join(directory, letterID+deadLetterExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DeadLetter{}, false, nil
+		}
+		return DeadLetter{}, false, err
+	}
+	return d, d.SubscriberID == id, nil
+}
+
+// replayDeadLetter delivers the dead letter to the subscriber again and
+// removes it on success
+func (t *Transport) replayDeadLetter(ctx context.Context, id string, letterID string) error {
+	d, ok, err := t.getDeadLetter(id, letterID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Dead letter with ID " + letterID + " does not exist")
+	}
+	if !t.inflight.begin(id) {
+		return ErrShutdown
+	}
+	defer t.inflight.end(id)
+	s, ok := t.subscriber(id)
+	if !ok || s.Provider == nil {
+		return errors.New("Subscriber with ID " + id + " is not connected")
+	}
+	if err := s.Provider.Publish(ctx, d.Path, d.Payload); err != nil && !inFlight(err) {
+		return err
+	}
+	return t.deleteDeadLetter(id, letterID)
+}
+
+// deleteDeadLetter removes a dead letter of the subscriber
+func (t *Transport) deleteDeadLetter(id string, letterID string) error {
+	d, ok, err := t.getDeadLetter(id, letterID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Dead letter with ID " + letterID + " does not exist")
+	}
+	directory, err := t.deadLetterDirectory(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(directory, d.ID+deadLetterExt))
+}
+
+// purgeDeadLetters removes all dead letters of the subscriber
+func (t *Transport) purgeDeadLetters(id string) error {
+	letters, err := t.deadLetters(id)
+	if err != nil {
+		return err
+	}
+	directory, err := t.deadLetterDirectory(id)
+	if err != nil {
+		return err
+	}
+	for _, d := range letters {
+		err := os.Remove(filepath.Join(directory, d.ID+deadLetterExt))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDeadLetter(path string) (DeadLetter, error) {
+	var d DeadLetter
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(b, &d)
+	return d, err
+}
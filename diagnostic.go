@@ -0,0 +1,329 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+//Diagnostic step states
+const (
+	StepOK      = "ok"
+	StepFailed  = "failed"
+	StepSkipped = "skipped"
+)
+
+//DiagnosticStep result of a step of a subscriber test
+type DiagnosticStep struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Duration int64  `json:"duration"`
+	Message  string `json:"message,omitempty"`
+}
+
+//Diagnostic result of a subscriber test. The steps are dns, tcp, tls, auth
+//and publish, steps following a failed step are skipped.
+type Diagnostic struct {
+	Success bool             `json:"success"`
+	Steps   []DiagnosticStep `json:"steps"`
+}
+
+var defaultTestTimeout = 10000
+
+// probeTarget describes how the endpoint of a scheme is probed, connect
+// tells whether the provider connects when it is created. Providers which
+// connect on publish verify the credentials by the publish only.
+type probeTarget struct {
+	port    string
+	tls     bool
+	network string
+	connect bool
+}
+
+var probeTargets = map[string]probeTarget{
+	"mqtt":  {"1883", false, "tcp", true},
+	"mqtts": {"8883", true, "tcp", true},
+	"http":  {"80", false, "tcp", false},
+	"https": {"443", true, "tcp", false},
+	"tcp":   {"", false, "tcp", false},
+	"tcps":  {"", true, "tcp", false},
+	"udp":   {"", false, "udp", false},
+	"azure": {"8883", true, "tcp", false},
+	"amqp":  {"5672", false, "tcp", true},
+	"amqps": {"5671", true, "tcp", true},
+	"kafka": {"9092", false, "tcp", true},
+	"ws":    {"80", false, "tcp", true},
+	"wss":   {"443", true, "tcp", true},
+	// NATS upgrades to TLS after the plain INFO, it is checked by the provider
+	"nats": {"4222", false, "tcp", true},
+}
+
+// probeAddress returns the host and port of the subscriber endpoint
+func probeAddress(s Subscriber) (string, string, probeTarget, error) {
+	u, err := url.Parse(s.URI)
+	if err != nil {
+		return "", "", probeTarget{}, err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	target, ok := probeTargets[scheme]
+	if !ok {
+		return "", "", target, errors.New("Unsuported scheme " + u.Scheme)
+	}
+	host := u.Hostname()
+	port := u.Port()
+	if scheme == "azure" {
+		// the host holds the connection string
+		host = ""
+		for _, part := range strings.Split(u.Host, ";") {
+			if strings.HasPrefix(part, "HostName=") {
+				host = strings.TrimPrefix(part, "HostName=")
+			}
+		}
+		port = ""
+	}
+	if scheme == "kafka" {
+		// the first of the bootstrap brokers is probed
+		broker := strings.Split(u.Host, ",")[0]
+		host, port = broker, ""
+		if h, p, err := net.SplitHostPort(broker); err == nil {
+			host, port = h, p
+		}
+		target.tls, _ = strconv.ParseBool(s.Properties[kafkaTLSProperty])
+	}
+	if host == "" {
+		return "", "", target, errors.New("No host specified")
+	}
+	if port == "" || port == "0" {
+		port = target.port
+	}
+	if port == "" {
+		return "", "", target, errors.New("No port specified")
+	}
+	return host, port, target, nil
+}
+
+type diagnosis struct {
+	result Diagnostic
+	failed bool
+}
+
+// run executes a step unless a previous step failed
+func (d *diagnosis) run(name string, step func() (string, error)) {
+	if d.failed {
+		d.skip(name, "")
+		return
+	}
+	start := time.Now()
+	msg, err := step()
+	s := DiagnosticStep{
+		Name:     name,
+		Status:   StepOK,
+		Duration: time.Since(start).Milliseconds(),
+		Message:  msg,
+	}
+	if err != nil {
+		s.Status = StepFailed
+		s.Message = err.Error()
+		d.failed = true
+	}
+	d.result.Steps = append(d.result.Steps, s)
+}
+
+func (d *diagnosis) skip(name string, msg string) {
+	d.result.Steps = append(d.result.Steps, DiagnosticStep{Name: name, Status: StepSkipped, Message: msg})
+}
+
+// notVerified marks the last step as skipped if it succeeded
+func (d *diagnosis) notVerified(msg string) {
+	step := &d.result.Steps[len(d.result.Steps)-1]
+	if step.Status == StepOK {
+		step.Status = StepSkipped
+		step.Message = msg
+	}
+}
+
+// testSubscriber checks whether the subscriber can be reached. The provider
+// is built as by newProvider, connected and torn down again, a probe report
+// is published if requested. Nothing is persisted.
+func (t *Transport) testSubscriber(ctx context.Context, s Subscriber, publish bool) Diagnostic {
+	d := &diagnosis{}
+	host, port, target, err := probeAddress(s)
+	if _, known := probeTargets[strings.ToLower(schemeOf(s.URI))]; known {
+		d.run("dns", func() (string, error) {
+			if err != nil {
+				return "", err
+			}
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return "", err
+			}
+			return strings.Join(addrs, ", "), nil
+		})
+	} else {
+		// endpoints of other providers are only checked by the provider
+		d.skip("dns", "Not applicable for "+schemeOf(s.URI))
+	}
+
+	var conn net.Conn
+	if target.network == "tcp" {
+		d.run("tcp", func() (string, error) {
+			var dialer net.Dialer
+			conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+			if err != nil {
+				return "", err
+			}
+			return "Connected to " + conn.RemoteAddr().String(), nil
+		})
+	} else {
+		d.skip("tcp", "Not applicable for "+schemeOf(s.URI))
+	}
+
+	if target.tls {
+		d.run("tls", func() (string, error) {
+			config := newTLSConfig(t.certFolder+"/"+s.ID, t.lg)
+			config.ServerName = host
+			if b, _ := strconv.ParseBool(s.Properties[httpsBypassSSlVerificationProperty]); b {
+				config.InsecureSkipVerify = true
+			}
+			if strings.ToLower(schemeOf(s.URI)) == "tcps" {
+				if name := s.Properties[tcpsServerNameProperty]; name != "" {
+					config.ServerName = name
+				}
+				if version := s.Properties[tcpsMinVersionProperty]; version != "" {
+					config.MinVersion, _ = parseTLSVersion(version)
+				}
+			}
+			c := tls.Client(conn, config)
+			if deadline, ok := ctx.Deadline(); ok {
+				c.SetDeadline(deadline)
+			}
+			if err := c.Handshake(); err != nil {
+				return "", err
+			}
+			return "Handshake completed with " + host, nil
+		})
+	} else {
+		d.skip("tls", "Not applicable for "+schemeOf(s.URI))
+	}
+	if conn != nil {
+		conn.Close()
+	}
+
+	var p Provider
+	d.run("auth", func() (string, error) {
+		p, err = t.probeProvider(ctx, s)
+		if err != nil {
+			return "", err
+		}
+		return "Provider connected", nil
+	})
+	if !target.connect {
+		d.notVerified("Not verified, " + schemeOf(s.URI) + " subscribers connect on publish")
+	}
+
+	if publish {
+		d.run("publish", func() (string, error) {
+			err := p.Publish(ctx, "", map[string]interface{}{
+				"test":      true,
+				"timestamp": time.Now().UTC(),
+			})
+			var status *statusError
+			if errors.As(err, &status) && (status.code == http.StatusUnauthorized || status.code == http.StatusForbidden) {
+				for i := range d.result.Steps {
+					if d.result.Steps[i].Name == "auth" {
+						d.result.Steps[i].Status = StepFailed
+						d.result.Steps[i].Message = err.Error()
+					}
+				}
+			}
+			if err != nil {
+				return "", err
+			}
+			return "Probe report published", nil
+		})
+	} else {
+		d.skip("publish", "Not requested")
+	}
+	if p != nil {
+		p.Shutdown()
+	}
+	d.result.Success = !d.failed
+	for _, step := range d.result.Steps {
+		if step.Status == StepFailed {
+			d.result.Success = false
+		}
+	}
+	return d.result
+}
+
+// probeSubscriber returns the subscriber used to build the probe provider.
+// It does not persist reports nor take over the session of the subscriber,
+// MQTT probes connect with a clean session using their own client id.
+func probeSubscriber(s Subscriber, probe *Transport) Subscriber {
+	properties := make(map[string]string)
+	for key, value := range s.Properties {
+		properties[key] = value
+	}
+	delete(properties, mqttStoreProperty)
+	s.Properties = properties
+	s.Provider = nil
+	s.t = probe
+	s.probe = true
+	if u, err := url.Parse(s.URI); err == nil && (u.Scheme == "mqtt" || u.Scheme == "mqtts") {
+		values := u.Query()
+		if id := values.Get("clientid"); id != "" {
+			values.Set("clientid", id+"-probe-"+guuid.New().String())
+			u.RawQuery = values.Encode()
+			s.URI = u.String()
+		}
+	}
+	return s
+}
+
+// probeProvider builds and connects the provider of the subscriber without
+// registering it. The reports are not persisted.
+func (t *Transport) probeProvider(ctx context.Context, s Subscriber) (Provider, error) {
+	probe := New(WithDirectory(t.dir), WithCertFolder(t.certFolder), WithLogger(t.lg))
+	s = probeSubscriber(s, probe)
+
+	type result struct {
+		p   Provider
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		factory, ok := lookupProvider(schemeOf(s.URI))
+		if !ok {
+			done <- result{nil, errors.New("Unsuported scheme " + schemeOf(s.URI))}
+			return
+		}
+		p, flag, err := factory(s)
+		if err == nil && flag {
+			err = p.SetTLS(s.ID)
+		}
+		if err != nil && p != nil {
+			p.Shutdown()
+			p = nil
+		}
+		done <- result{p, err}
+	}()
+	select {
+	case r := <-done:
+		return r.p, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.p != nil {
+				r.p.Shutdown()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTestSubscriberDefinitionIgnoresID(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://tls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"id": "` + id + `", "enable": true, "uri": "fake://tls"}`
+	r := httptest.NewRequest(http.MethodPost, "/rest/subscribers/test", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	tr.testSubscriberDefinition(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if used, _ := fakeTLS.Load("tls"); used == id || used == "" || used == nil {
+		t.Fatalf("definition probed using the certificates of %v", used)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/rest/subscribers/"+id+"/test", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": id})
+	w = httptest.NewRecorder()
+	tr.testStoredSubscriber(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if used, _ := fakeTLS.Load("tls"); used != id {
+		t.Fatalf("stored subscriber probed using the certificates of %v", used)
+	}
+}
+
+func TestProbeSubscriberOwnMQTTSession(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	s := Subscriber{ID: "x", URI: "mqtt://127.0.0.1:1/topic?clientid=device&qos=1", Properties: map[string]string{
+		mqttStoreProperty:   "file",
+		mqttTimeoutProperty: "0",
+	}}
+	probe := probeSubscriber(s, tr)
+	u, _ := url.Parse(probe.URI)
+	if id := u.Query().Get("clientid"); !strings.HasPrefix(id, "device-probe-") {
+		t.Fatalf("probe connects using client id %s", id)
+	}
+	if _, ok := probe.Properties[mqttStoreProperty]; ok {
+		t.Fatal("probe uses the store of the subscriber")
+	}
+	if s.Properties[mqttStoreProperty] != "file" {
+		t.Fatal("properties of the subscriber modified")
+	}
+	for _, tc := range []struct {
+		s     Subscriber
+		clean bool
+	}{{s, false}, {probe, true}} {
+		cl, _ := newMqttProvider(tc.s)
+		if cl == nil {
+			t.Fatal("MQTT client not created")
+		}
+		cl.Shutdown()
+		if cl.opts.CleanSession != tc.clean {
+			t.Fatalf("%s connects with clean session %v", tc.s.URI, cl.opts.CleanSession)
+		}
+	}
+}
+
+func TestTestSubscriberAuthNotVerified(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	tr := newTestTransport(t)
+	defer tr.Close()
+	for _, publish := range []bool{false, true} {
+		d := tr.testSubscriber(context.Background(), Subscriber{URI: srv.URL}, publish)
+		if !d.Success {
+			t.Fatalf("test failed %+v", d)
+		}
+		for _, step := range d.Steps {
+			if step.Name == "auth" && step.Status != StepSkipped {
+				t.Fatalf("auth of a HTTP subscriber reported as %s: %s", step.Status, step.Message)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+var encodingProperty string = prefix + "Encoding"
+var protobufMessageProperty string = prefix + "Protobuf.Message"
+
+var defaultEncoding string = "json"
+
+//Encoder serializes reports before they are handed over to a provider.
+//Reports of type []byte or string are considered encoded already and are
+//passed through unchanged.
+type Encoder interface {
+	Encode(report interface{}) ([]byte, error)
+	ContentType() string
+}
+
+//EncoderFactory creates the encoder of a subscriber
+type EncoderFactory func(s Subscriber) (Encoder, error)
+
+var encoders = make(map[string]EncoderFactory)
+var encodersMu sync.RWMutex
+
+func init() {
+	RegisterEncoder("json", func(s Subscriber) (Encoder, error) {
+		return &funcEncoder{json.Marshal, "application/json"}, nil
+	})
+	RegisterEncoder("xml", func(s Subscriber) (Encoder, error) {
+		return &funcEncoder{xml.Marshal, "application/xml"}, nil
+	})
+	RegisterEncoder("cbor", func(s Subscriber) (Encoder, error) {
+		return &funcEncoder{cbor.Marshal, "application/cbor"}, nil
+	})
+	RegisterEncoder("msgpack", func(s Subscriber) (Encoder, error) {
+		return &funcEncoder{msgpack.Marshal, "application/msgpack"}, nil
+	})
+	RegisterEncoder("protobuf", newProtobufEncoder)
+	RegisterEncoder("raw", func(s Subscriber) (Encoder, error) {
+		return &funcEncoder{rawMarshal, "application/octet-stream"}, nil
+	})
+}
+
+//RegisterEncoder makes an encoder available for the Transporter.Encoding
+//property of subscribers. It panics if the factory is nil or the name is
+//already registered.
+func RegisterEncoder(name string, factory EncoderFactory) {
+	if factory == nil {
+		panic("transport: RegisterEncoder factory is nil")
+	}
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	if _, dup := encoders[name]; dup {
+		panic("transport: RegisterEncoder called twice for encoding " + name)
+	}
+	encoders[name] = factory
+}
+
+//newEncoder creates the encoder selected by the subscriber properties
+func newEncoder(s Subscriber) (Encoder, error) {
+	name := defaultEncoding
+	if e, ok := s.Properties[encodingProperty]; ok {
+		name = e
+	}
+	encodersMu.RLock()
+	factory, ok := encoders[name]
+	encodersMu.RUnlock()
+	if !ok {
+		s.logger().Error("Invalid encoding value '" + name + "'")
+		return nil, errors.New("Invalid encoding value '" + name + "'")
+	}
+	return factory(s)
+}
+
+//contentType returns the MimeType property if set, the content type of the
+//encoder otherwise
+func contentType(s Subscriber, enc Encoder) string {
+	if mimeType, ok := s.Properties[mimeTypeProperty]; ok && mimeType != "" {
+		return mimeType
+	}
+	return enc.ContentType()
+}
+
+type funcEncoder struct {
+	marshal     func(v interface{}) ([]byte, error)
+	contentType string
+}
+
+func (e *funcEncoder) Encode(report interface{}) ([]byte, error) {
+	switch r := report.(type) {
+	case []byte:
+		return r, nil
+	case string:
+		return []byte(r), nil
+	}
+	return e.marshal(report)
+}
+
+func (e *funcEncoder) ContentType() string {
+	return e.contentType
+}
+
+func rawMarshal(v interface{}) ([]byte, error) {
+	if s, ok := v.(fmt.Stringer); ok {
+		return []byte(s.String()), nil
+	}
+	return nil, fmt.Errorf("raw encoding does not support reports of type %T", v)
+}
+
+type protobufEncoder struct {
+	messageType protoreflect.MessageType
+}
+
+//newProtobufEncoder creates a protobuf encoder. Reports which are no proto
+//messages are converted to the message registered with the name given by
+//the Transporter.Protobuf.Message property.
+func newProtobufEncoder(s Subscriber) (Encoder, error) {
+	e := &protobufEncoder{}
+	name, ok := s.Properties[protobufMessageProperty]
+	if ok && name != "" {
+		mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(name))
+		if err != nil {
+			s.logger().Error("Unknown protobuf message '" + name + "'")
+			return nil, errors.New("Unknown protobuf message '" + name + "'")
+		}
+		e.messageType = mt
+	}
+	return e, nil
+}
+
+func (e *protobufEncoder) Encode(report interface{}) ([]byte, error) {
+	switch r := report.(type) {
+	case []byte:
+		return r, nil
+	case string:
+		return []byte(r), nil
+	case proto.Message:
+		return proto.Marshal(r)
+	}
+	if e.messageType == nil {
+		return nil, fmt.Errorf("no protobuf message registered for reports of type %T", report)
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	m := e.messageType.New().Interface()
+	if err := protojson.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(m)
+}
+
+func (e *protobufEncoder) ContentType() string {
+	return "application/x-protobuf"
+}
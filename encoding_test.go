@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testReport struct {
+	ID     string  `json:"id" cbor:"id" msgpack:"id"`
+	Count  int     `json:"count" cbor:"count" msgpack:"count"`
+	Values []int   `json:"values" cbor:"values" msgpack:"values"`
+	Ratio  float64 `json:"ratio" cbor:"ratio" msgpack:"ratio"`
+}
+
+func testEncoder(t *testing.T, properties map[string]string) Encoder {
+	enc, err := newEncoder(Subscriber{Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+func TestEncodersRoundTrip(t *testing.T) {
+	report := testReport{ID: "a", Count: 2, Values: []int{1, 2, 3}, Ratio: 0.5}
+	for _, tc := range []struct {
+		encoding    string
+		contentType string
+		unmarshal   func(data []byte, v interface{}) error
+	}{
+		{"", "application/json", json.Unmarshal},
+		{"json", "application/json", json.Unmarshal},
+		{"cbor", "application/cbor", cbor.Unmarshal},
+		{"msgpack", "application/msgpack", msgpack.Unmarshal},
+	} {
+		name, properties := "default", map[string]string{}
+		if tc.encoding != "" {
+			name, properties[encodingProperty] = tc.encoding, tc.encoding
+		}
+		t.Run(name, func(t *testing.T) {
+			enc := testEncoder(t, properties)
+			if enc.ContentType() != tc.contentType {
+				t.Fatalf("content type %s, want %s", enc.ContentType(), tc.contentType)
+			}
+			data, err := enc.Encode(report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded testReport
+			if err := tc.unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, report) {
+				t.Fatalf("decoded %+v, want %+v", decoded, report)
+			}
+			// encoded reports are passed through
+			for _, raw := range []struct {
+				report interface{}
+				want   string
+			}{
+				{[]byte{0xff, 0x00}, "\xff\x00"},
+				{"encoded", "encoded"},
+			} {
+				data, err := enc.Encode(raw.report)
+				if err != nil || string(data) != raw.want {
+					t.Fatalf("%v encoded as %q, %v", raw.report, data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestProtobufEncoderRoundTrip(t *testing.T) {
+	enc := testEncoder(t, map[string]string{encodingProperty: "protobuf"})
+	if enc.ContentType() != "application/x-protobuf" {
+		t.Fatalf("content type %s", enc.ContentType())
+	}
+	data, err := enc.Encode(wrapperspb.String("report"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s wrapperspb.StringValue
+	if err := proto.Unmarshal(data, &s); err != nil || s.Value != "report" {
+		t.Fatalf("decoded %q, %v", s.Value, err)
+	}
+	if _, err := enc.Encode(map[string]interface{}{"a": 1}); err == nil {
+		t.Fatal("report encoded without a message type")
+	}
+
+	// other reports are converted to the registered message
+	enc = testEncoder(t, map[string]string{
+		encodingProperty:        "protobuf",
+		protobufMessageProperty: "google.protobuf.Struct",
+	})
+	report := map[string]interface{}{"id": "a", "count": 2.0, "values": []interface{}{1.0, 2.0}}
+	data, err = enc.Encode(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded structpb.Struct
+	if err := proto.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.AsMap(), report) {
+		t.Fatalf("decoded %v, want %v", decoded.AsMap(), report)
+	}
+}
+
+func TestUnknownEncodingRejected(t *testing.T) {
+	for _, properties := range []map[string]string{
+		{encodingProperty: "yaml"},
+		{encodingProperty: "JSON"},
+		{encodingProperty: "protobuf", protobufMessageProperty: "test.Unknown"},
+	} {
+		if _, err := newEncoder(Subscriber{Properties: properties}); err == nil {
+			t.Errorf("%v accepted", properties)
+		}
+	}
+	tr := newTestTransport(t)
+	defer tr.Close()
+	if _, err := tr.config.add(Subscriber{Enable: true, URI: "fake://ok", Properties: map[string]string{encodingProperty: "yaml"}}); err == nil {
+		t.Fatal("subscriber with unknown encoding added")
+	}
+}
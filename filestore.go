@@ -0,0 +1,202 @@
+package transport
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	loglib "github.com/menucha-de/logging"
+)
+
+const msgExt = ".msg"
+
+// FileStore implements the store interface to provide a persistence
+// mechanism which survives restarts. Every message is written to its own
+// file inside of the store directory.
+type FileStore struct {
+	sync.RWMutex
+	directory string
+	opened    bool
+	limit     *storeLimit
+	lg        *loglib.Logger
+}
+
+// NewFileStore returns a pointer to a new instance of FileStore, the
+// instance is not initialized and ready to use until Open() has been called
+// on it. Messages exceeding the size are dropped.
+func NewFileStore(directory string, size int) *FileStore {
+	return newFileStore(directory, size, overflowDropNewest, 0, lg)
+}
+
+func newFileStore(directory string, size int, overflow overflowPolicy, timeout time.Duration, lg *loglib.Logger) *FileStore {
+	store := &FileStore{
+		directory: directory,
+		opened:    false,
+		limit:     newStoreLimit(size, overflow, timeout),
+		lg:        lg,
+	}
+	return store
+}
+
+// Open initializes a FileStore instance and loads the keys of the messages
+// persisted in the store directory.
+func (store *FileStore) Open() {
+	store.Lock()
+	defer store.Unlock()
+	if _, err := os.Stat(store.directory); os.IsNotExist(err) {
+		os.MkdirAll(store.directory, 0700)
+	}
+	files, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		store.lg.WithError(err).Error("Failed to read file store")
+		return
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	store.limit.reset()
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), msgExt) {
+			store.limit.keys = append(store.limit.keys, strings.TrimSuffix(f.Name(), msgExt))
+		}
+	}
+	store.opened = true
+	store.lg.Debug("filestore initialized")
+}
+
+// Put takes a key and a pointer to a Message and stores the
+// message.
+func (store *FileStore) Put(key string, message packets.ControlPacket) {
+	store.Lock()
+	defer store.Unlock()
+	if !store.opened {
+		store.lg.Error("Trying to use file store, but not open")
+		return
+	}
+	evict, ok := store.limit.reserve(store, key)
+	if !ok {
+		store.lg.Debug("queue size excedeed")
+		return
+	}
+	if evict != "" {
+		store.remove(evict)
+		store.lg.Debug("queue size excedeed, oldest message dropped")
+	}
+	tmp := store.path(key) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		store.lg.WithError(err).Error("Failed to write file store")
+		store.limit.remove(key)
+		return
+	}
+	err = message.Write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, store.path(key))
+	}
+	if err != nil {
+		store.lg.WithError(err).Error("Failed to write file store")
+		os.Remove(tmp)
+		store.limit.remove(key)
+	}
+}
+
+// Get takes a key and looks in the store for a matching Message
+// returning either the Message pointer or nil.
+func (store *FileStore) Get(key string) packets.ControlPacket {
+	store.RLock()
+	defer store.RUnlock()
+	if !store.opened {
+		store.lg.Error("Trying to use file store, but not open")
+		return nil
+	}
+	f, err := os.Open(store.path(key))
+	if err != nil {
+		store.lg.Warning("filestore get: message not found")
+		return nil
+	}
+	defer f.Close()
+	m, err := packets.ReadPacket(f)
+	if err != nil {
+		store.lg.WithError(err).Warning("filestore get: message corrupted")
+		return nil
+	}
+	store.lg.Debug("filestore get: message found")
+	return m
+}
+
+// All returns a slice of strings containing all the keys currently
+// in the FileStore in the order they have been put.
+func (store *FileStore) All() []string {
+	store.RLock()
+	defer store.RUnlock()
+	if !store.opened {
+		store.lg.Error("Trying to use file store, but not open")
+		return nil
+	}
+	return store.limit.all()
+}
+
+// Del takes a key, searches the FileStore and if the key is found
+// deletes the Message file associated with it.
+func (store *FileStore) Del(key string) {
+	store.Lock()
+	defer store.Unlock()
+	if !store.opened {
+		store.lg.Error("Trying to use file store, but not open")
+		return
+	}
+	store.remove(key)
+	store.limit.remove(key)
+}
+
+// Close will disallow modifications to the state of the store.
+func (store *FileStore) Close() {
+	store.Lock()
+	defer store.Unlock()
+	if !store.opened {
+		store.lg.Error("Trying to close file store, but not open")
+		return
+	}
+	store.opened = false
+	store.lg.Debug("filestore closed")
+}
+
+// Reset eliminates all persisted message data in the store.
+func (store *FileStore) Reset() {
+	store.Lock()
+	defer store.Unlock()
+	if !store.opened {
+		store.lg.Error("Trying to reset file store, but not open")
+	}
+	for _, key := range store.limit.all() {
+		store.remove(key)
+	}
+	store.limit.reset()
+	store.lg.Debug("filestore wiped")
+}
+
+func (store *FileStore) path(key string) string {
+	return filepath.Join(store.directory, key+msgExt)
+}
+
+func (store *FileStore) remove(key string) {
+	err := os.Remove(store.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			store.lg.Warning("filestore del: message not found")
+		} else {
+			store.lg.WithError(err).Warning("filestore del: failed to delete message")
+		}
+		return
+	}
+	store.lg.Debug("filestore del: message was deleted")
+}
@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// framing delimits the reports written to a stream
+type framing struct {
+	name      string
+	prefix    int
+	start     []byte
+	delimiter []byte
+}
+
+const (
+	stx = 0x02
+	etx = 0x03
+)
+
+// newFraming returns the framing with the name, the delimiter is only used
+// by the delimiter framing and may contain escape sequences like \r\n
+func newFraming(name string, delimiter string) (*framing, error) {
+	switch name {
+	case "", "none":
+		return &framing{name: "none"}, nil
+	case "newline":
+		return &framing{name: name, delimiter: []byte{'\n'}}, nil
+	case "length-prefix-2":
+		return &framing{name: name, prefix: 2}, nil
+	case "length-prefix-4":
+		return &framing{name: name, prefix: 4}, nil
+	case "stx-etx":
+		return &framing{name: name, start: []byte{stx}, delimiter: []byte{etx}}, nil
+	case "delimiter":
+		d, err := strconv.Unquote("\"" + delimiter + "\"")
+		if err != nil || d == "" {
+			return nil, errors.New("Invalid delimiter '" + delimiter + "'")
+		}
+		return &framing{name: name, delimiter: []byte(d)}, nil
+	default:
+		return nil, errors.New("Invalid framing '" + name + "'")
+	}
+}
+
+// frame returns the framed payload
+func (f *framing) frame(payload []byte) ([]byte, error) {
+	switch f.prefix {
+	case 2:
+		if len(payload) > 0xffff {
+			return nil, errors.New("Report of " + strconv.Itoa(len(payload)) + " bytes exceeds the 2 byte length prefix")
+		}
+		b := make([]byte, 2, 2+len(payload))
+		binary.BigEndian.PutUint16(b, uint16(len(payload)))
+		return append(b, payload...), nil
+	case 4:
+		if uint64(len(payload)) > 0xffffffff {
+			return nil, errors.New("Report of " + strconv.Itoa(len(payload)) + " bytes exceeds the 4 byte length prefix")
+		}
+		b := make([]byte, 4, 4+len(payload))
+		binary.BigEndian.PutUint32(b, uint32(len(payload)))
+		return append(b, payload...), nil
+	}
+	if len(f.start) == 0 && len(f.delimiter) == 0 {
+		return payload, nil
+	}
+	b := make([]byte, 0, len(f.start)+len(payload)+len(f.delimiter))
+	b = append(b, f.start...)
+	b = append(b, payload...)
+	return append(b, f.delimiter...), nil
+}
@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readFrame reads a frame written using the framing from r and returns its
+// payload, the none framing has no boundaries and returns the rest of r
+func readFrame(r *bufio.Reader, f *framing) ([]byte, error) {
+	switch f.prefix {
+	case 2, 4:
+		b := make([]byte, f.prefix)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		n := uint64(binary.BigEndian.Uint32(append(make([]byte, 4-f.prefix), b...)))
+		payload := make([]byte, n)
+		_, err := io.ReadFull(r, payload)
+		return payload, err
+	}
+	if len(f.delimiter) == 0 {
+		return io.ReadAll(r)
+	}
+	var b []byte
+	for !bytes.HasSuffix(b, f.delimiter) {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, c)
+	}
+	b = b[:len(b)-len(f.delimiter)]
+	if !bytes.HasPrefix(b, f.start) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b[len(f.start):], nil
+}
+
+func TestFramingRoundTrip(t *testing.T) {
+	payloads := [][]byte{[]byte(`{"a":1}`), []byte(""), []byte(strings.Repeat("x", 300))}
+	for _, tc := range []struct {
+		name      string
+		delimiter string
+		want      string
+	}{
+		{"newline", "", "abc\n"},
+		{"length-prefix-2", "", "\x00\x03abc"},
+		{"length-prefix-4", "", "\x00\x00\x00\x03abc"},
+		{"stx-etx", "", "\x02abc\x03"},
+		{"delimiter", `\r\n`, "abc\r\n"},
+		{"delimiter", "##", "abc##"},
+	} {
+		t.Run(tc.name+tc.delimiter, func(t *testing.T) {
+			f, err := newFraming(tc.name, tc.delimiter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := f.frame([]byte("abc"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.want {
+				t.Fatalf("framed as %q, want %q", b, tc.want)
+			}
+			var stream []byte
+			for _, p := range payloads {
+				b, err := f.frame(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stream = append(stream, b...)
+			}
+			r := bufio.NewReader(bytes.NewReader(stream))
+			for _, p := range payloads {
+				got, err := readFrame(r, f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, p) {
+					t.Fatalf("read %q, want %q", got, p)
+				}
+			}
+		})
+	}
+}
+
+func TestFramingNone(t *testing.T) {
+	for _, name := range []string{"", "none"} {
+		f, err := newFraming(name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := f.frame([]byte("abc")); string(b) != "abc" {
+			t.Fatalf("framed as %q", b)
+		}
+	}
+}
+
+func TestFramingInvalid(t *testing.T) {
+	if _, err := newFraming("xml", ""); err == nil {
+		t.Fatal("unknown framing accepted")
+	}
+	if _, err := newFraming("delimiter", ""); err == nil {
+		t.Fatal("empty delimiter accepted")
+	}
+	if _, err := newFraming("delimiter", `\q`); err == nil {
+		t.Fatal("invalid escape sequence accepted")
+	}
+	f, _ := newFraming("length-prefix-2", "")
+	if _, err := f.frame(make([]byte, 0x10000)); err == nil {
+		t.Fatal("report exceeding the length prefix framed")
+	}
+	if _, err := f.frame(make([]byte, 0xffff)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"context"
 	tls "crypto/tls"
 	"errors"
-	"fmt"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -13,6 +12,8 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
+
+	loglib "github.com/menucha-de/logging"
 )
 
 type httpclient struct {
@@ -20,9 +21,15 @@ type httpclient struct {
 	method   string
 	URI      string
 	mimeType string
+	enc      Encoder
 	user     *url.Userinfo
 	timeout  int
 	err      int32
+	certs    string
+	retry    *retryPolicy
+	status   *statusTracker
+	metrics  *subscriberMetrics
+	lg       *loglib.Logger
 }
 
 var httpTimeoutProperty string = prefix + "HTTP.Timeout"
@@ -31,31 +38,54 @@ var httpMethodProperty string = prefix + "HTTP.Method"
 var httpsBypassSSlVerificationProperty = prefix + "HTTPS.BypassSSLVerification"
 var mimeTypeProperty string = "MimeType"
 
-var defaultmimeType string = "application/json"
 var defaultbypassSslVerification bool = false
 var defaultmethod string = "POST"
 
+func init() {
+	RegisterProvider("http", func(s Subscriber) (Provider, bool, error) {
+		return httpFactory(s, false)
+	})
+	RegisterProvider("https", func(s Subscriber) (Provider, bool, error) {
+		return httpFactory(s, true)
+	})
+}
+
+func httpFactory(s Subscriber, tls bool) (Provider, bool, error) {
+	p, err := newHTTPProvider(s)
+	if err != nil {
+		return nil, false, err
+	}
+	return p, tls, nil
+}
+
 func newHTTPProvider(s Subscriber) (*httpclient, error) {
 	defaultTimeout = 1000
 	if s.URI == "" {
-		lg.Error("URI Can't be null")
+		s.logger().Error("URI Can't be null")
 		return nil, errors.New("URI must not be null")
 	}
 	u, err := url.Parse(s.URI)
 	if err != nil {
-		lg.Error("Can't parse subscriber URI")
+		s.logger().Error("Can't parse subscriber URI")
 		return nil, err
 	}
 
 	if u.Host == "" {
-		lg.Error("No host specified")
+		s.logger().Error("No host specified")
 		return nil, errors.New("No  host specified")
 
 	}
 	method := defaultmethod
 	timeout := defaultTimeout
 	bypassSslVerification := defaultbypassSslVerification
-	mimeType := defaultmimeType
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicy(s)
+	if err != nil {
+		return nil, err
+	}
 	if s.Properties != nil {
 		for key, property := range s.Properties {
 
@@ -64,20 +94,20 @@ func newHTTPProvider(s Subscriber) (*httpclient, error) {
 				case httpTimeoutProperty:
 					timeout, err := strconv.Atoi(property)
 					if err != nil {
-						lg.Error("Invalid timeout value '" + property + "'")
+						s.logger().Error("Invalid timeout value '" + property + "'")
 						return nil, errors.New("Invalid timeout value '" + property + "'")
 
 					}
 
 					if timeout < 0 {
-						lg.Error("Invalid timeout value '" + property + "'")
+						s.logger().Error("Invalid timeout value '" + property + "'")
 						return nil, errors.New("Invalid timeout value '" + property + "'")
 
 					}
 				case httpMethodProperty:
 					method = strings.ToUpper(property)
 					if method == "" {
-						lg.Error("HTTP method not specified")
+						s.logger().Error("HTTP method not specified")
 						return nil, errors.New("HTTP method not specified")
 					}
 					switch method {
@@ -89,25 +119,23 @@ func newHTTPProvider(s Subscriber) (*httpclient, error) {
 					case http.MethodPut:
 
 					default:
-						lg.Error("Invalid HTTP method value '" + property + "'")
+						s.logger().Error("Invalid HTTP method value '" + property + "'")
 						return nil, errors.New("Invalid HTTP method value '" + property + "'")
 					}
 
 				case httpsBypassSSlVerificationProperty:
 					b, err := strconv.ParseBool(property)
 					if err != nil {
-						lg.Error("Invalid " + httpsBypassSSlVerificationProperty + " '" + property + "'")
+						s.logger().Error("Invalid " + httpsBypassSSlVerificationProperty + " '" + property + "'")
 						return nil, errors.New("Invalid " + httpsBypassSSlVerificationProperty + " '" + property + "'")
 
 					}
 					bypassSslVerification = b
 
 				default:
-					lg.Error("Unknown property key '" + key + "'")
+					s.logger().Error("Unknown property key '" + key + "'")
 					return nil, errors.New("Unknown property key '" + key + "'")
 				}
-			} else if key == mimeTypeProperty {
-				mimeType = property
 			}
 		}
 	}
@@ -133,20 +161,29 @@ func newHTTPProvider(s Subscriber) (*httpclient, error) {
 		TLSClientConfig:    tlsConfig,
 	}
 	mclient.Transport = tr
-	return &httpclient{mclient, method, s.URI, mimeType, u.User, timeout, 0}, nil
+	return &httpclient{mclient, method, s.URI, contentType(s, enc), enc, u.User, timeout, 0, s.certRoot(), retry, s.status(), s.metrics(), s.logger()}, nil
 
 }
-func (c *httpclient) Publish(topic string, message interface{}) {
-	//data := url.Values{}
-	str := []byte(fmt.Sprintf("%v", message))
-	//data.Set("report", str)
+func (c *httpclient) Publish(ctx context.Context, topic string, message interface{}) error {
+	str, err := c.enc.Encode(message)
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
 
+	return c.retry.do(ctx, func(ctx context.Context) error {
+		return c.send(ctx, str)
+	})
+}
+
+// send makes a single attempt to deliver the encoded report
+func (c *httpclient) send(ctx context.Context, str []byte) error {
 	req, err := http.NewRequest(c.method, c.URI, bytes.NewBuffer(str))
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Duration(c.timeout)*time.Millisecond))
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.timeout)*time.Millisecond)
 	defer cancel()
 	if err != nil {
-		lg.Error(err.Error())
-		return
+		c.lg.Error(err.Error())
+		return &permanentError{err}
 	}
 	req.Header.Set("Content-Type", c.mimeType)
 	if c.user != nil {
@@ -160,27 +197,36 @@ func (c *httpclient) Publish(topic string, message interface{}) {
 
 	resp, err := c.mclient.Do(req)
 	if err != nil {
+		c.status.disconnected(err)
 		if atomic.LoadInt32(&c.err) == 0 {
 			atomic.StoreInt32(&c.err, 1)
-			lg.Error(err.Error())
+			c.lg.Error(err.Error())
 		}
-		return
+		return err
 	}
+	defer resp.Body.Close()
+	c.status.connected()
+	c.metrics.sent(len(str))
 
 	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusOK+100 {
-		err = errors.New("HTTP " + strconv.Itoa(resp.StatusCode) + ": " + resp.Status)
+		err = &statusError{
+			code:       resp.StatusCode,
+			status:     resp.Status,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 		if atomic.LoadInt32(&c.err) == 0 {
 			atomic.StoreInt32(&c.err, 1)
-			lg.Error(err.Error())
+			c.lg.Error(err.Error())
 		}
-		return
+		return err
 	}
 	atomic.StoreInt32(&c.err, 0)
+	return nil
 }
 func (c *httpclient) Shutdown() {}
 func (c *httpclient) SetTLS(id string) error {
 
-	tlsConfig := newTLSConfig(dirname + "/certs/" + id)
+	tlsConfig := newTLSConfig(c.certs+"/"+id, c.lg)
 	tr := &http.Transport{
 		MaxIdleConns:       10,
 		IdleConnTimeout:    time.Duration(c.timeout) * time.Second,
@@ -0,0 +1,421 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	loglib "github.com/menucha-de/logging"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+type kafkaclient struct {
+	brokers  []string
+	topic    string
+	keyField string
+	timeout  int
+	enc      Encoder
+	status   *statusTracker
+	metrics  *subscriberMetrics
+	lg       *loglib.Logger
+	certs    string
+	secure   bool
+	opts     []kgo.Opt
+	mu       sync.Mutex
+	kclient  *kgo.Client
+	discard  func(topic string, report interface{}, err error)
+	pending  sync.WaitGroup
+}
+
+var defaultKafkaPort string = "9092"
+var defaultKafkaTimeout int = 10000
+var kafkaTimeoutProperty string = prefix + "Kafka.Timeout"
+var kafkaAcksProperty string = prefix + "Kafka.Acks"
+var kafkaIdempotentProperty string = prefix + "Kafka.Idempotent"
+var kafkaCompressionProperty string = prefix + "Kafka.Compression"
+var kafkaLingerProperty string = prefix + "Kafka.Linger"
+var kafkaBatchMaxBytesProperty string = prefix + "Kafka.BatchMaxBytes"
+var kafkaKeyFieldProperty string = prefix + "Kafka.KeyField"
+var kafkaSASLMechanismProperty string = prefix + "Kafka.SASL.Mechanism"
+var kafkaTLSProperty string = prefix + "Kafka.TLS"
+
+var kafkaCompressions = map[string]kgo.CompressionCodec{
+	"none":   kgo.NoCompression(),
+	"gzip":   kgo.GzipCompression(),
+	"snappy": kgo.SnappyCompression(),
+	"lz4":    kgo.Lz4Compression(),
+	"zstd":   kgo.ZstdCompression(),
+}
+
+func init() {
+	RegisterProvider("kafka", kafkaFactory)
+}
+
+func kafkaFactory(s Subscriber) (Provider, bool, error) {
+	p, err := newKafkaProvider(s)
+	if p == nil {
+		return nil, false, err
+	}
+	// keep the client on connection errors, it connects again on publish
+	return p, p.secure, err
+}
+
+func newKafkaProvider(s Subscriber) (*kafkaclient, error) {
+	if s.URI == "" {
+		s.logger().Error("URI Can't be null")
+		return nil, errors.New("URI must not be null")
+	}
+	u, err := url.Parse(s.URI)
+	if err != nil {
+		s.logger().Error("Can't parse subscriber URI")
+		return nil, err
+	}
+	if strings.ToLower(u.Scheme) != "kafka" {
+		s.logger().Error("Unknown scheme '" + u.Scheme + "'")
+		return nil, errors.New("Unknown scheme '" + u.Scheme + "'")
+	}
+	if u.Host == "" {
+		s.logger().Error("No Kafka broker specified")
+		return nil, errors.New("No Kafka broker specified")
+	}
+	topic := strings.Trim(u.Path, "/")
+	if topic == "" || strings.Contains(topic, "/") {
+		s.logger().Error("Kafka topic must be specified using the path of the URI")
+		return nil, errors.New("Kafka topic must be specified using the path of the URI")
+	}
+	var brokers []string
+	for _, broker := range strings.Split(u.Host, ",") {
+		if broker == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			broker = net.JoinHostPort(broker, defaultKafkaPort)
+		}
+		brokers = append(brokers, broker)
+	}
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &kafkaclient{
+		brokers: brokers,
+		topic:   topic,
+		timeout: defaultKafkaTimeout,
+		enc:     enc,
+		status:  s.status(),
+		metrics: s.metrics(),
+		lg:      s.logger(),
+		certs:   s.certRoot(),
+		discard: func(topic string, report interface{}, err error) {
+			s.logger().WithError(err).Warning("Dropping undeliverable report of subscriber " + s.ID)
+		},
+	}
+	if s.t != nil {
+		c.discard = func(topic string, report interface{}, err error) {
+			s.t.discard(&s, topic, report, err)
+		}
+	}
+
+	acks := "all"
+	var idempotent *bool
+	mechanism := ""
+	var producerOpts []kgo.Opt
+	for key, property := range s.Properties {
+		if key == "" || !strings.HasPrefix(key, prefix+"Kafka") {
+			continue
+		}
+		switch key {
+		case kafkaTimeoutProperty:
+			c.timeout, err = strconv.Atoi(property)
+			if err != nil || c.timeout < 0 {
+				s.logger().Error("Invalid timeout value '" + property + "'")
+				return nil, errors.New("Invalid timeout value '" + property + "'")
+			}
+		case kafkaAcksProperty:
+			if property != "none" && property != "leader" && property != "all" {
+				s.logger().Error("Invalid " + kafkaAcksProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + kafkaAcksProperty + " '" + property + "', must be none, leader or all")
+			}
+			acks = property
+		case kafkaIdempotentProperty:
+			b, err := strconv.ParseBool(property)
+			if err != nil {
+				s.logger().Error("Invalid " + kafkaIdempotentProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + kafkaIdempotentProperty + " '" + property + "'")
+			}
+			idempotent = &b
+		case kafkaCompressionProperty:
+			codec, ok := kafkaCompressions[property]
+			if !ok {
+				s.logger().Error("Invalid " + kafkaCompressionProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + kafkaCompressionProperty + " '" + property + "', must be none, gzip, snappy, lz4 or zstd")
+			}
+			producerOpts = append(producerOpts, kgo.ProducerBatchCompression(codec))
+		case kafkaLingerProperty:
+			linger, err := strconv.Atoi(property)
+			if err != nil || linger < 0 {
+				s.logger().Error("Invalid " + kafkaLingerProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + kafkaLingerProperty + " '" + property + "'")
+			}
+			producerOpts = append(producerOpts, kgo.ProducerLinger(time.Duration(linger)*time.Millisecond))
+		case kafkaBatchMaxBytesProperty:
+			size, err := strconv.ParseInt(property, 10, 32)
+			if err != nil || size <= 0 {
+				s.logger().Error("Invalid " + kafkaBatchMaxBytesProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + kafkaBatchMaxBytesProperty + " '" + property + "'")
+			}
+			producerOpts = append(producerOpts, kgo.ProducerBatchMaxBytes(int32(size)))
+		case kafkaKeyFieldProperty:
+			c.keyField = property
+		case kafkaSASLMechanismProperty:
+			mechanism = property
+		case kafkaTLSProperty:
+			c.secure, err = strconv.ParseBool(property)
+			if err != nil {
+				s.logger().Error("Invalid " + kafkaTLSProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + kafkaTLSProperty + " '" + property + "'")
+			}
+		default:
+			s.logger().Error("Unknown property key '" + key + "'")
+			return nil, errors.New("Unknown property key '" + key + "'")
+		}
+	}
+
+	// idempotent producing requires the acknowledgement of all replicas
+	if idempotent != nil && *idempotent && acks != "all" {
+		s.logger().Error(kafkaIdempotentProperty + " requires " + kafkaAcksProperty + " all")
+		return nil, errors.New(kafkaIdempotentProperty + " requires " + kafkaAcksProperty + " all")
+	}
+	if idempotent != nil && !*idempotent || acks != "all" {
+		producerOpts = append(producerOpts, kgo.DisableIdempotentWrite())
+	}
+	switch acks {
+	case "none":
+		producerOpts = append(producerOpts, kgo.RequiredAcks(kgo.NoAck()))
+	case "leader":
+		producerOpts = append(producerOpts, kgo.RequiredAcks(kgo.LeaderAck()))
+	default:
+		producerOpts = append(producerOpts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	}
+
+	user := u.User.Username()
+	password, _ := u.User.Password()
+	switch strings.ToUpper(mechanism) {
+	case "":
+		if user != "" {
+			producerOpts = append(producerOpts, kgo.SASL(plain.Auth{User: user, Pass: password}.AsMechanism()))
+		}
+	case "PLAIN":
+		producerOpts = append(producerOpts, kgo.SASL(plain.Auth{User: user, Pass: password}.AsMechanism()))
+	case "SCRAM-SHA-256":
+		producerOpts = append(producerOpts, kgo.SASL(scram.Auth{User: user, Pass: password}.AsSha256Mechanism()))
+	case "SCRAM-SHA-512":
+		producerOpts = append(producerOpts, kgo.SASL(scram.Auth{User: user, Pass: password}.AsSha512Mechanism()))
+	default:
+		s.logger().Error("Invalid " + kafkaSASLMechanismProperty + " '" + mechanism + "'")
+		return nil, errors.New("Invalid " + kafkaSASLMechanismProperty + " '" + mechanism + "', must be PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512")
+	}
+	if mechanism != "" && user == "" {
+		s.logger().Error(kafkaSASLMechanismProperty + " requires the credentials in the URI")
+		return nil, errors.New(kafkaSASLMechanismProperty + " requires the credentials in the URI")
+	}
+
+	// the client does not time out records in less than a second
+	deliveryTimeout := time.Duration(c.timeout) * time.Millisecond
+	if deliveryTimeout > 0 && deliveryTimeout < time.Second {
+		deliveryTimeout = time.Second
+	}
+	c.opts = append([]kgo.Opt{
+		kgo.SeedBrokers(c.brokers...),
+		kgo.DefaultProduceTopic(c.topic),
+		kgo.DialTimeout(time.Duration(c.timeout) * time.Millisecond),
+		kgo.RecordDeliveryTimeout(deliveryTimeout),
+		kgo.WithHooks(c),
+	}, producerOpts...)
+	if !c.secure {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := c.connect(); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// connect creates the client and checks that a broker can be reached, c.mu
+// has to be held
+func (c *kafkaclient) connect(opts ...kgo.Opt) error {
+	c.close()
+	c.status.setState(StatusConnecting)
+	kclient, err := kgo.NewClient(append(c.opts, opts...)...)
+	if err != nil {
+		c.lg.Error(err.Error())
+		c.status.failed(err)
+		return err
+	}
+	c.kclient = kclient
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.timeout)*time.Millisecond)
+	defer cancel()
+	if err := kclient.Ping(ctx); err != nil {
+		c.lg.Error("Can't connect to Kafka at " + strings.Join(c.brokers, ",") + ": " + err.Error())
+		c.status.disconnected(err)
+		return err
+	}
+	return nil
+}
+
+//OnBrokerConnect records the connection state, the client connects to the
+//brokers on demand and reconnects by itself
+func (c *kafkaclient) OnBrokerConnect(meta kgo.BrokerMetadata, dialDur time.Duration, conn net.Conn, err error) {
+	if err != nil {
+		c.status.disconnected(err)
+		return
+	}
+	c.status.connected()
+}
+
+func (c *kafkaclient) Publish(ctx context.Context, topic string, message interface{}) error {
+	if c == nil {
+		return errors.New("Kafka client not initialized")
+	}
+
+	payload, err := c.enc.Encode(message)
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	kclient := c.kclient
+	c.mu.Unlock()
+	if kclient == nil {
+		return errors.New("Kafka client not connected")
+	}
+	// the record outlives the publish, it is produced in a batch with the
+	// records buffered meanwhile
+	record := &kgo.Record{Value: payload, Context: context.Background()}
+	if c.keyField != "" {
+		record.Key = reportField(message, c.keyField)
+	} else if topic != "" {
+		record.Key = []byte(topic)
+	}
+	c.pending.Add(1)
+	kclient.Produce(ctx, record, func(r *kgo.Record, err error) {
+		c.produced(topic, r, err)
+	})
+	return nil
+}
+
+// produced records the result of a buffered record. The client retries
+// records until the timeout, records failing anyway are dead lettered or
+// dropped. The promise must not block, it may be called while the client
+// is closed holding the configuration lock.
+func (c *kafkaclient) produced(topic string, r *kgo.Record, err error) {
+	if err == nil {
+		c.metrics.sent(len(r.Key) + len(r.Value))
+		c.pending.Done()
+		return
+	}
+	c.lg.Error(err.Error())
+	c.status.published(err)
+	go func() {
+		defer c.pending.Done()
+		c.discard(topic, r.Value, err)
+	}()
+}
+
+// reportField returns the value of a top level field of the report as record
+// key, strings are used as they are and other values JSON encoded
+func reportField(report interface{}, name string) []byte {
+	var b []byte
+	switch r := report.(type) {
+	case []byte:
+		b = r
+	case string:
+		b = []byte(r)
+	default:
+		var err error
+		b, err = json.Marshal(report)
+		if err != nil {
+			return nil
+		}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil
+	}
+	value, ok := fields[name]
+	if !ok {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return []byte(s)
+	}
+	return value
+}
+
+// close closes the client, c.mu has to be held
+func (c *kafkaclient) close() {
+	if c.kclient != nil {
+		c.kclient.Close()
+		c.kclient = nil
+	}
+}
+
+//Drain waits for the records still buffered by the client and the dead
+//lettering of the records which failed
+func (c *kafkaclient) Drain(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	kclient := c.kclient
+	c.mu.Unlock()
+	if kclient != nil {
+		if err := kclient.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *kafkaclient) Shutdown() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.close()
+}
+
+//SetTLS applies the certificates of the subscriber and connects using them
+func (c *kafkaclient) SetTLS(id string) error {
+	if !c.secure {
+		return nil
+	}
+	config := newTLSConfig(c.certs+"/"+id, c.lg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connect(kgo.DialTLSConfig(config))
+}
@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// unreachableBroker returns the address of a closed port
+func unreachableBroker(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestKafkaPublishBuffersAndDiscardsFailedRecords(t *testing.T) {
+	// the provider is created although the broker can't be reached
+	c, _ := newKafkaProvider(Subscriber{
+		URI:        "kafka://" + unreachableBroker(t) + "/reports",
+		Properties: map[string]string{kafkaTimeoutProperty: "200"},
+	})
+	if c == nil || c.kclient == nil {
+		t.Fatal("Kafka client not created")
+	}
+	defer c.Shutdown()
+	var mu sync.Mutex
+	discarded := map[string]int{}
+	c.discard = func(topic string, report interface{}, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		discarded[topic]++
+	}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := c.Publish(context.Background(), "a", "report"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("publishes waited %v for the broker", d)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if discarded["a"] != 10 {
+		t.Fatalf("%d failed records discarded, want 10", discarded["a"])
+	}
+}
+
+func TestKafkaPublishCancelled(t *testing.T) {
+	c, _ := newKafkaProvider(Subscriber{
+		URI:        "kafka://" + unreachableBroker(t) + "/reports",
+		Properties: map[string]string{kafkaTimeoutProperty: "200"},
+	})
+	defer c.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Publish(ctx, "a", "report"); err != context.Canceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
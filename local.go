@@ -0,0 +1,445 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	loglib "github.com/menucha-de/logging"
+)
+
+type localclient struct {
+	enc     Encoder
+	t       *Transport
+	stream  *stream
+	status  *statusTracker
+	metrics *subscriberMetrics
+	lg      *loglib.Logger
+}
+
+var defaultStreamBufferSize int = 64
+var defaultStreamHistorySize int = 32
+var localBufferSizeProperty string = prefix + "Local.BufferSize"
+var localHistorySizeProperty string = prefix + "Local.HistorySize"
+
+func init() {
+	RegisterProvider("local", localFactory)
+}
+
+func localFactory(s Subscriber) (Provider, bool, error) {
+	p, err := newLocalProvider(s)
+	if err != nil {
+		return nil, false, err
+	}
+	return p, false, nil
+}
+
+func newLocalProvider(s Subscriber) (*localclient, error) {
+	if s.URI == "" {
+		s.logger().Error("URI Can't be null")
+		return nil, errors.New("URI must not be null")
+	}
+	u, err := url.Parse(s.URI)
+	if err != nil {
+		s.logger().Error("Can't parse subscriber URI")
+		return nil, err
+	}
+	if strings.ToLower(u.Scheme) != "local" {
+		s.logger().Error("Unknown scheme '" + u.Scheme + "'")
+		return nil, errors.New("Unknown scheme '" + u.Scheme + "'")
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") != "" || u.User != nil {
+		s.logger().Error("Invalid stream name, the URI has to be local://stream-name")
+		return nil, errors.New("Invalid stream name, the URI has to be local://stream-name")
+	}
+	if s.t == nil {
+		s.logger().Error("Local subscribers require a transport service")
+		return nil, errors.New("Local subscribers require a transport service")
+	}
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	bufferSize, historySize := defaultStreamBufferSize, defaultStreamHistorySize
+	for key, property := range s.Properties {
+		if key == "" || !strings.HasPrefix(key, prefix+"Local") {
+			continue
+		}
+		switch key {
+		case localBufferSizeProperty:
+			bufferSize, err = strconv.Atoi(property)
+			if err != nil || bufferSize < 1 {
+				s.logger().Error("Invalid " + localBufferSizeProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + localBufferSizeProperty + " '" + property + "'")
+			}
+		case localHistorySizeProperty:
+			historySize, err = strconv.Atoi(property)
+			if err != nil || historySize < 0 {
+				s.logger().Error("Invalid " + localHistorySizeProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + localHistorySizeProperty + " '" + property + "'")
+			}
+		default:
+			s.logger().Error("Unknown property key '" + key + "'")
+			return nil, errors.New("Unknown property key '" + key + "'")
+		}
+	}
+	c := &localclient{
+		enc:     enc,
+		t:       s.t,
+		status:  s.status(),
+		metrics: s.metrics(),
+		lg:      s.logger(),
+	}
+	c.stream = s.t.openStream(u.Host, c, streamSize{bufferSize, historySize})
+	c.status.connected()
+	return c, nil
+}
+
+func (c *localclient) Publish(ctx context.Context, topic string, message interface{}) error {
+	if c == nil {
+		return errors.New("Local client not initialized")
+	}
+
+	payload, err := c.enc.Encode(message)
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	c.stream.publish(c.enc.ContentType(), payload)
+	c.metrics.sent(len(payload))
+	return nil
+}
+
+func (c *localclient) Shutdown() {
+	if c == nil {
+		return
+	}
+	c.t.releaseStream(c.stream, c)
+}
+
+func (c *localclient) SetTLS(id string) error {
+	return nil
+}
+
+// streamEvent report published to a stream, the ids of a stream increase
+// by one
+type streamEvent struct {
+	id          uint64
+	contentType string
+	data        []byte
+}
+
+// streamClient client connected to a stream. The events are buffered per
+// client, a client whose buffer is full is evicted.
+type streamClient struct {
+	events  chan streamEvent
+	evicted chan struct{}
+}
+
+// streamSize buffer and history size requested by a local subscriber
+type streamSize struct {
+	bufferSize  int
+	historySize int
+}
+
+// stream fans the reports of the local subscribers out to the connected
+// clients and keeps the latest events for clients resuming after a
+// disconnect. The stream exists as long as local subscribers publish to
+// it, it uses the largest sizes they request.
+type stream struct {
+	mu          sync.Mutex
+	name        string
+	bufferSize  int
+	historySize int
+	history     []streamEvent
+	lastID      uint64
+	clients     map[*streamClient]struct{}
+	owners      map[*localclient]streamSize
+	closed      bool
+	lg          *loglib.Logger
+}
+
+// openStream returns the stream with the name, creating it if necessary,
+// and registers the local subscriber publishing to it
+func (t *Transport) openStream(name string, c *localclient, size streamSize) *stream {
+	t.streamsMu.Lock()
+	defer t.streamsMu.Unlock()
+	st, ok := t.streams[name]
+	if !ok {
+		st = &stream{
+			name:    name,
+			clients: make(map[*streamClient]struct{}),
+			owners:  make(map[*localclient]streamSize),
+			lg:      t.lg,
+		}
+		t.streams[name] = st
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.owners[c] = size
+	st.configure()
+	return st
+}
+
+// releaseStream unregisters the local subscriber, the stream is closed and
+// removed once no subscriber publishes to it anymore
+func (t *Transport) releaseStream(st *stream, c *localclient) {
+	t.streamsMu.Lock()
+	defer t.streamsMu.Unlock()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.owners[c]; !ok {
+		return
+	}
+	delete(st.owners, c)
+	if len(st.owners) > 0 {
+		st.configure()
+		return
+	}
+	if t.streams[st.name] == st {
+		delete(t.streams, st.name)
+	}
+	st.shutdown()
+}
+
+// configure applies the largest sizes requested by the owners, st.mu has to
+// be held
+func (st *stream) configure() {
+	st.bufferSize, st.historySize = 0, 0
+	for _, size := range st.owners {
+		if size.bufferSize > st.bufferSize {
+			st.bufferSize = size.bufferSize
+		}
+		if size.historySize > st.historySize {
+			st.historySize = size.historySize
+		}
+	}
+	if len(st.history) > st.historySize {
+		st.history = append([]streamEvent(nil), st.history[len(st.history)-st.historySize:]...)
+	}
+}
+
+func (st *stream) publish(contentType string, data []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastID++
+	e := streamEvent{id: st.lastID, contentType: contentType, data: data}
+	if st.historySize > 0 {
+		if len(st.history) >= st.historySize {
+			st.history = append(st.history[:0], st.history[len(st.history)-st.historySize+1:]...)
+		}
+		st.history = append(st.history, e)
+	}
+	for client := range st.clients {
+		select {
+		case client.events <- e:
+		default:
+			// slow consumer
+			st.lg.Warning("Evicting slow client of stream " + st.name)
+			st.evict(client)
+		}
+	}
+}
+
+// subscribe connects a client. With resume set the kept events following
+// lastEventID are replayed, all kept events if the id is unknown. A client
+// of a closed stream is evicted immediately.
+func (st *stream) subscribe(lastEventID uint64, resume bool) *streamClient {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		client := &streamClient{evicted: make(chan struct{})}
+		close(client.evicted)
+		return client
+	}
+	var replay []streamEvent
+	if resume {
+		for _, e := range st.history {
+			if e.id > lastEventID || lastEventID > st.lastID {
+				replay = append(replay, e)
+			}
+		}
+	}
+	size := st.bufferSize
+	if len(replay) > size {
+		size = len(replay)
+	}
+	client := &streamClient{
+		events:  make(chan streamEvent, size),
+		evicted: make(chan struct{}),
+	}
+	for _, e := range replay {
+		client.events <- e
+	}
+	st.clients[client] = struct{}{}
+	return client
+}
+
+func (st *stream) unsubscribe(client *streamClient) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.clients, client)
+}
+
+// evict disconnects a client, st.mu has to be held
+func (st *stream) evict(client *streamClient) {
+	if _, ok := st.clients[client]; ok {
+		delete(st.clients, client)
+		close(client.evicted)
+	}
+}
+
+// close disconnects all clients
+func (st *stream) close() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.shutdown()
+}
+
+// shutdown disconnects all clients and rejects new ones, st.mu has to be
+// held
+func (st *stream) shutdown() {
+	st.closed = true
+	for client := range st.clients {
+		st.evict(client)
+	}
+}
+
+// streamKeepAlive interval of the keep-alive comments and pings sent to the
+// clients of a stream
+var streamKeepAlive = 30 * time.Second
+
+var streamUpgrader = websocket.Upgrader{}
+
+func (t *Transport) lookupStream(name string) (*stream, error) {
+	t.streamsMu.Lock()
+	defer t.streamsMu.Unlock()
+	st, ok := t.streams[name]
+	if !ok {
+		return nil, errors.New("Stream " + name + " does not exist")
+	}
+	return st, nil
+}
+
+// serveEvents sends the events to a Server-Sent Events client until it
+// disconnects or is evicted. A client reconnecting with the Last-Event-ID
+// header or the lastEventId query parameter receives the kept events it
+// missed. Binary reports are sent base64 encoded.
+func (st *stream) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var id uint64
+	if lastEventID != "" {
+		var err error
+		id, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid last event id '"+lastEventID+"'", http.StatusBadRequest)
+			return
+		}
+	}
+	client := st.subscribe(id, lastEventID != "")
+	defer st.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		var b bytes.Buffer
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.evicted:
+			return
+		case <-ticker.C:
+			b.WriteString(": keep-alive\n\n")
+		case e := <-client.events:
+			data := string(e.data)
+			if !textual(e.contentType) {
+				data = base64.StdEncoding.EncodeToString(e.data)
+			}
+			b.WriteString("id: " + strconv.FormatUint(e.id, 10) + "\n")
+			for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+				b.WriteString("data: " + line + "\n")
+			}
+			b.WriteString("\n")
+		}
+		if _, err := w.Write(b.Bytes()); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// serveWebSocket sends the events to a WebSocket client as text or binary
+// frames depending on the encoding until it disconnects or is evicted
+func (st *stream) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader replied with the error
+		st.lg.WithError(err).Debug("WebSocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+	client := st.subscribe(0, false)
+	defer st.unsubscribe(client)
+
+	// the messages of the client are discarded, the pongs extend the
+	// read deadline
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadDeadline(time.Now().Add(2 * streamKeepAlive))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * streamKeepAlive))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-client.evicted:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "slow consumer"),
+				time.Now().Add(time.Second))
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamKeepAlive)); err != nil {
+				return
+			}
+		case e := <-client.events:
+			messageType := websocket.BinaryMessage
+			if textual(e.contentType) {
+				messageType = websocket.TextMessage
+			}
+			conn.SetWriteDeadline(time.Now().Add(streamKeepAlive))
+			if err := conn.WriteMessage(messageType, e.data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"testing"
+)
+
+func addLocalSubscriber(t *testing.T, tr *Transport, uri string, properties map[string]string) string {
+	id, err := tr.config.add(Subscriber{Enable: true, URI: uri, Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func evicted(client *streamClient) bool {
+	select {
+	case <-client.evicted:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestStreamRemovedWithSubscriber(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id := addLocalSubscriber(t, tr, "local://a", nil)
+	st, err := tr.lookupStream("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := st.subscribe(0, false)
+	if err := tr.config.delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.lookupStream("a"); err == nil {
+		t.Fatal("stream of a deleted subscriber still exists")
+	}
+	if !evicted(client) {
+		t.Fatal("client of a deleted stream still connected")
+	}
+	if !evicted(st.subscribe(0, false)) {
+		t.Fatal("client connected to a deleted stream")
+	}
+}
+
+func TestStreamRemovedOnDisableAndRepoint(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id := addLocalSubscriber(t, tr, "local://a", nil)
+	if err := tr.config.set(Subscriber{ID: id, Enable: true, URI: "local://b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.lookupStream("a"); err == nil {
+		t.Fatal("stream still exists after the subscriber was re-pointed")
+	}
+	if _, err := tr.lookupStream("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.config.set(Subscriber{ID: id, Enable: false, URI: "local://b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.lookupStream("b"); err == nil {
+		t.Fatal("stream still exists after the subscriber was disabled")
+	}
+}
+
+func TestStreamShared(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	small := addLocalSubscriber(t, tr, "local://a", map[string]string{
+		localBufferSizeProperty:  "4",
+		localHistorySizeProperty: "2",
+	})
+	large := addLocalSubscriber(t, tr, "local://a", map[string]string{
+		localBufferSizeProperty:  "16",
+		localHistorySizeProperty: "8",
+	})
+	st, err := tr.lookupStream("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.bufferSize != 16 || st.historySize != 8 {
+		t.Fatalf("sizes %d and %d, want the largest requested", st.bufferSize, st.historySize)
+	}
+	// configuring the small subscriber again keeps the sizes of the other
+	if err := tr.config.set(Subscriber{ID: small, Enable: true, URI: "local://a", Properties: map[string]string{
+		localBufferSizeProperty:  "4",
+		localHistorySizeProperty: "2",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if st.bufferSize != 16 || st.historySize != 8 {
+		t.Fatalf("sizes %d and %d after reconfiguring a subscriber", st.bufferSize, st.historySize)
+	}
+	client := st.subscribe(0, false)
+	if err := tr.config.delete(large); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tr.lookupStream("a"); err != nil || got != st {
+		t.Fatal("stream removed while a subscriber still publishes to it")
+	}
+	if evicted(client) {
+		t.Fatal("client evicted while the stream is still used")
+	}
+	if st.bufferSize != 4 || st.historySize != 2 {
+		t.Fatalf("sizes %d and %d after deleting a subscriber", st.bufferSize, st.historySize)
+	}
+	if err := tr.config.delete(small); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.lookupStream("a"); err == nil {
+		t.Fatal("stream still exists after its subscribers were deleted")
+	}
+	if !evicted(client) {
+		t.Fatal("client of a removed stream still connected")
+	}
+}
@@ -16,8 +16,10 @@ package transport
 
 import (
 	"sync"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
+	loglib "github.com/menucha-de/logging"
 )
 
 // MemoryStore implements the store interface to provide a "persistence"
@@ -27,17 +29,24 @@ type MemoryStore struct {
 	sync.RWMutex
 	messages map[string]packets.ControlPacket
 	opened   bool
-	size     int
+	limit    *storeLimit
+	lg       *loglib.Logger
 }
 
 // NewMemoryStore returns a pointer to a new instance of
 // MemoryStore, the instance is not initialized and ready to
-// use until Open() has been called on it.
+// use until Open() has been called on it. Messages exceeding
+// the size are dropped.
 func NewMemoryStore(size int) *MemoryStore {
+	return newMemoryStore(size, overflowDropNewest, 0, lg)
+}
+
+func newMemoryStore(size int, overflow overflowPolicy, timeout time.Duration, lg *loglib.Logger) *MemoryStore {
 	store := &MemoryStore{
 		messages: make(map[string]packets.ControlPacket),
 		opened:   false,
-		size:     size,
+		limit:    newStoreLimit(size, overflow, timeout),
+		lg:       lg,
 	}
 	return store
 }
@@ -47,7 +56,7 @@ func (store *MemoryStore) Open() {
 	store.Lock()
 	defer store.Unlock()
 	store.opened = true
-	lg.Debug("memorystore initialized")
+	store.lg.Debug("memorystore initialized")
 }
 
 // Put takes a key and a pointer to a Message and stores the
@@ -56,13 +65,18 @@ func (store *MemoryStore) Put(key string, message packets.ControlPacket) {
 	store.Lock()
 	defer store.Unlock()
 	if !store.opened {
-		lg.Error("Trying to use memory store, but not open")
+		store.lg.Error("Trying to use memory store, but not open")
 		return
 	}
-	if len(store.messages) >= store.size {
-		lg.Debug("queue size excedeed")
+	evict, ok := store.limit.reserve(store, key)
+	if !ok {
+		store.lg.Debug("queue size excedeed")
 		return
 	}
+	if evict != "" {
+		delete(store.messages, evict)
+		store.lg.Debug("queue size excedeed, oldest message dropped")
+	}
 	store.messages[key] = message
 }
 
@@ -72,33 +86,29 @@ func (store *MemoryStore) Get(key string) packets.ControlPacket {
 	store.RLock()
 	defer store.RUnlock()
 	if !store.opened {
-		lg.Error("Trying to use memory store, but not open")
+		store.lg.Error("Trying to use memory store, but not open")
 		return nil
 	}
 	//mid := mIDFromKey(key)
 	m := store.messages[key]
 	if m == nil {
-		lg.Warning("memorystore get: message not found")
+		store.lg.Warning("memorystore get: message not found")
 	} else {
-		lg.Debug("memorystore get: message found")
+		store.lg.Debug("memorystore get: message found")
 	}
 	return m
 }
 
 // All returns a slice of strings containing all the keys currently
-// in the MemoryStore.
+// in the MemoryStore in the order they have been put.
 func (store *MemoryStore) All() []string {
 	store.RLock()
 	defer store.RUnlock()
 	if !store.opened {
-		lg.Error("Trying to use memory store, but not open")
+		store.lg.Error("Trying to use memory store, but not open")
 		return nil
 	}
-	var keys []string
-	for k := range store.messages {
-		keys = append(keys, k)
-	}
-	return keys
+	return store.limit.all()
 }
 
 // Del takes a key, searches the MemoryStore and if the key is found
@@ -107,16 +117,17 @@ func (store *MemoryStore) Del(key string) {
 	store.Lock()
 	defer store.Unlock()
 	if !store.opened {
-		lg.Error("Trying to use memory store, but not open")
+		store.lg.Error("Trying to use memory store, but not open")
 		return
 	}
 	//mid := mIDFromKey(key)
 	m := store.messages[key]
 	if m == nil {
-		lg.Warning("memorystore del: message not found")
+		store.lg.Warning("memorystore del: message not found")
 	} else {
 		delete(store.messages, key)
-		lg.Debug("memorystore del: message was deleted")
+		store.limit.remove(key)
+		store.lg.Debug("memorystore del: message was deleted")
 	}
 }
 
@@ -125,11 +136,11 @@ func (store *MemoryStore) Close() {
 	store.Lock()
 	defer store.Unlock()
 	if !store.opened {
-		lg.Error("Trying to close memory store, but not open")
+		store.lg.Error("Trying to close memory store, but not open")
 		return
 	}
 	store.opened = false
-	lg.Debug("memorystore closed")
+	store.lg.Debug("memorystore closed")
 }
 
 // Reset eliminates all persisted message data in the store.
@@ -137,8 +148,9 @@ func (store *MemoryStore) Reset() {
 	store.Lock()
 	defer store.Unlock()
 	if !store.opened {
-		lg.Error("Trying to reset memory store, but not open")
+		store.lg.Error("Trying to reset memory store, but not open")
 	}
 	store.messages = make(map[string]packets.ControlPacket)
-	lg.Debug("memorystore wiped")
+	store.limit.reset()
+	store.lg.Debug("memorystore wiped")
 }
@@ -0,0 +1,211 @@
+package transport
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets upper bounds of the publish latency histogram in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// subscriberMetrics delivery metrics of a subscriber. The publishes, failures,
+// latencies and short circuits are recorded by the breaker wrapping every
+// provider, the retries by the retry policy and the bytes by the providers. A
+// nil value ignores all events.
+type subscriberMetrics struct {
+	mu            sync.Mutex
+	scheme        string
+	publishes     uint64
+	failures      uint64
+	shortCircuits uint64
+	retries       uint64
+	bytes         uint64
+	buckets       []uint64
+	sum           float64
+	count         uint64
+}
+
+// metrics returns the metrics of the subscriber
+func (s Subscriber) metrics() *subscriberMetrics {
+	if s.t == nil {
+		return nil
+	}
+	return s.t.subscriberMetrics(s.ID, schemeOf(s.URI))
+}
+
+func (t *Transport) subscriberMetrics(id string, scheme string) *subscriberMetrics {
+	t.metricsMu.Lock()
+	defer t.metricsMu.Unlock()
+	m, ok := t.metrics[id]
+	if !ok {
+		m = &subscriberMetrics{buckets: make([]uint64, len(latencyBuckets))}
+		t.metrics[id] = m
+	}
+	m.mu.Lock()
+	m.scheme = scheme
+	m.mu.Unlock()
+	return m
+}
+
+func (t *Transport) removeMetrics(id string) {
+	t.metricsMu.Lock()
+	defer t.metricsMu.Unlock()
+	delete(t.metrics, id)
+}
+
+// published records a publish and its latency
+func (m *subscriberMetrics) published(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.publishes++
+	if err != nil && !inFlight(err) {
+		m.failures++
+	}
+	seconds := d.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			m.buckets[i]++
+		}
+	}
+	m.sum += seconds
+	m.count++
+}
+
+// shortCircuited records a publish rejected by the open circuit breaker, it
+// is neither counted as publish nor as failure
+func (m *subscriberMetrics) shortCircuited() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shortCircuits++
+}
+
+// retried records a retry of a publish
+func (m *subscriberMetrics) retried() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries++
+}
+
+// sent records bytes written to the destination
+func (m *subscriberMetrics) sent(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes += uint64(n)
+}
+
+type metricsSample struct {
+	id            string
+	scheme        string
+	publishes     uint64
+	failures      uint64
+	shortCircuits uint64
+	retries       uint64
+	bytes         uint64
+	buckets       []uint64
+	sum           float64
+	count         uint64
+	publishQueue  int
+	resendQueue   int
+}
+
+func (t *Transport) metricsSamples() []metricsSample {
+	t.metricsMu.Lock()
+	ids := make([]string, 0, len(t.metrics))
+	for id := range t.metrics {
+		ids = append(ids, id)
+	}
+	t.metricsMu.Unlock()
+	sort.Strings(ids)
+	samples := make([]metricsSample, 0, len(ids))
+	for _, id := range ids {
+		t.metricsMu.Lock()
+		m, ok := t.metrics[id]
+		t.metricsMu.Unlock()
+		if !ok {
+			continue
+		}
+		m.mu.Lock()
+		sample := metricsSample{
+			id:            id,
+			scheme:        m.scheme,
+			publishes:     m.publishes,
+			failures:      m.failures,
+			shortCircuits: m.shortCircuits,
+			retries:       m.retries,
+			bytes:         m.bytes,
+			buckets:       append([]uint64(nil), m.buckets...),
+			sum:           m.sum,
+			count:         m.count,
+		}
+		m.mu.Unlock()
+		if q := t.getQueue(id); q != nil {
+			sample.publishQueue = len(q.jobs)
+		}
+		if o := t.getOutbox(id); o != nil {
+			sample.resendQueue = o.count()
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// writeMetrics writes the metrics in the Prometheus text format
+func (t *Transport) writeMetrics(out io.Writer) error {
+	samples := t.metricsSamples()
+	w := bufio.NewWriter(out)
+	counter := func(name string, help string, value func(s metricsSample) uint64) {
+		w.WriteString("# HELP " + name + " " + help + "\n")
+		w.WriteString("# TYPE " + name + " counter\n")
+		for _, s := range samples {
+			w.WriteString(name + "{" + metricsLabels(s) + "} " + strconv.FormatUint(value(s), 10) + "\n")
+		}
+	}
+	counter("transport_publishes_total", "Number of publishes.", func(s metricsSample) uint64 { return s.publishes })
+	counter("transport_publish_failures_total", "Number of failed publishes.", func(s metricsSample) uint64 { return s.failures })
+	counter("transport_publish_short_circuits_total", "Number of publishes rejected by the open circuit breaker.", func(s metricsSample) uint64 { return s.shortCircuits })
+	counter("transport_publish_retries_total", "Number of retried publish attempts.", func(s metricsSample) uint64 { return s.retries })
+	counter("transport_sent_bytes_total", "Number of bytes sent.", func(s metricsSample) uint64 { return s.bytes })
+
+	w.WriteString("# HELP transport_queue_depth Number of reports waiting for delivery.\n")
+	w.WriteString("# TYPE transport_queue_depth gauge\n")
+	for _, s := range samples {
+		w.WriteString("transport_queue_depth{" + metricsLabels(s) + ",queue=\"publish\"} " + strconv.Itoa(s.publishQueue) + "\n")
+		w.WriteString("transport_queue_depth{" + metricsLabels(s) + ",queue=\"resend\"} " + strconv.Itoa(s.resendQueue) + "\n")
+	}
+
+	w.WriteString("# HELP transport_publish_duration_seconds Latency of publishes.\n")
+	w.WriteString("# TYPE transport_publish_duration_seconds histogram\n")
+	for _, s := range samples {
+		labels := metricsLabels(s)
+		for i, le := range latencyBuckets {
+			w.WriteString("transport_publish_duration_seconds_bucket{" + labels + ",le=\"" + strconv.FormatFloat(le, 'g', -1, 64) + "\"} " + strconv.FormatUint(s.buckets[i], 10) + "\n")
+		}
+		w.WriteString("transport_publish_duration_seconds_bucket{" + labels + ",le=\"+Inf\"} " + strconv.FormatUint(s.count, 10) + "\n")
+		w.WriteString("transport_publish_duration_seconds_sum{" + labels + "} " + strconv.FormatFloat(s.sum, 'g', -1, 64) + "\n")
+		w.WriteString("transport_publish_duration_seconds_count{" + labels + "} " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+	return w.Flush()
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func metricsLabels(s metricsSample) string {
+	return "subscriber=\"" + labelEscaper.Replace(s.id) + "\",scheme=\"" + labelEscaper.Replace(s.scheme) + "\""
+}
@@ -1,14 +1,17 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	loglib "github.com/menucha-de/logging"
 )
 
 type client struct {
@@ -18,36 +21,63 @@ type client struct {
 	isConnected bool
 	opts        *mqtt.ClientOptions
 	timeout     int
+	enc         Encoder
+	certs       string
+	mu          sync.Mutex
+	inflight    map[mqtt.Token]struct{}
+	status      *statusTracker
+	metrics     *subscriberMetrics
+	lg          *loglib.Logger
 }
 
 var defaultTimeout int = 10000
 var defaultPort string = "1883"
 var defaultQueueSize int = 10
 var mqttTimeoutProperty string = prefix + "MQTT.Timeout"
+var mqttStoreProperty string = prefix + "MQTT.Store"
+var mqttOverflowProperty string = prefix + "MQTT.Overflow"
+
+func init() {
+	RegisterProvider("mqtt", func(s Subscriber) (Provider, bool, error) {
+		return mqttFactory(s, false)
+	})
+	RegisterProvider("mqtts", func(s Subscriber) (Provider, bool, error) {
+		return mqttFactory(s, true)
+	})
+}
+
+func mqttFactory(s Subscriber, tls bool) (Provider, bool, error) {
+	p, err := newMqttProvider(s)
+	if p == nil {
+		return nil, false, err
+	}
+	// keep the client on connection errors, it retries to connect
+	return p, tls, err
+}
 
 func newMqttProvider(s Subscriber) (*client, error) {
 	if s.URI == "" {
-		lg.Error("URI Can't be null")
+		s.logger().Error("URI Can't be null")
 		return nil, errors.New("URI must not be null")
 	}
 	u, err := url.Parse(s.URI)
 	if err != nil {
-		lg.Error("Can't parse subscriber URI")
+		s.logger().Error("Can't parse subscriber URI")
 		return nil, err
 	}
 	if u.Path == "" {
-		lg.Error("MQTT topic must be specified using the path of the URI")
+		s.logger().Error("MQTT topic must be specified using the path of the URI")
 		return nil, errors.New("MQTT topic must be specified using the path of the URI")
 	}
 	topic := u.Path
 
 	if strings.Contains(topic, "#") || strings.Contains(topic, "+") {
-		lg.Error("MQTT topic should not contain '#' or '+'")
+		s.logger().Error("MQTT topic should not contain '#' or '+'")
 		return nil, errors.New("MQTT topic should not contain '#' or '+'")
 
 	}
 	if u.Host == "" {
-		lg.Error("No MQTT host specified")
+		s.logger().Error("No MQTT host specified")
 		return nil, errors.New("No MQTT host specified")
 
 	}
@@ -58,7 +88,7 @@ func newMqttProvider(s Subscriber) (*client, error) {
 
 	id := values.Get("clientid")
 	if id == "" {
-		lg.Error("clientid must be set as URI query parameter for MQTT transporter")
+		s.logger().Error("clientid must be set as URI query parameter for MQTT transporter")
 		return nil, errors.New("clientid must be set as URI query parameter for MQTT transporter")
 	}
 	runes := []rune(topic)
@@ -68,12 +98,18 @@ func newMqttProvider(s Subscriber) (*client, error) {
 	if qos != "" {
 		nr, err = strconv.Atoi(qos)
 		if err != nil {
-			lg.Error("Invalid MQTT qos value '" + qos + "'")
+			s.logger().Error("Invalid MQTT qos value '" + qos + "'")
 			return nil, errors.New("Invalid MQTT qos value '" + qos + "'")
 		}
 	}
 	timeout := defaultTimeout
 	queueSizeprop := defaultQueueSize
+	storeType := "memory"
+	overflow := overflowDropNewest
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
 	if s.Properties != nil {
 		for key, property := range s.Properties {
 
@@ -84,19 +120,32 @@ func newMqttProvider(s Subscriber) (*client, error) {
 					case mqttTimeoutProperty:
 						timeout, err = strconv.Atoi(property)
 						if err != nil {
-							lg.Error("Invalid timeout value '" + property + "'")
+							s.logger().Error("Invalid timeout value '" + property + "'")
 							return nil, errors.New("Invalid timeout value '" + property + "'")
 
 						}
 
 						if timeout < 0 {
-							lg.Error("Invalid timeout value '" + property + "'")
+							s.logger().Error("Invalid timeout value '" + property + "'")
 							return nil, errors.New("Invalid timeout value '" + property + "'")
 
 						}
 
+					case mqttStoreProperty:
+						storeType = property
+						if storeType != "memory" && storeType != "file" {
+							s.logger().Error("Invalid store value '" + property + "'")
+							return nil, errors.New("Invalid store value '" + property + "'")
+						}
+					case mqttOverflowProperty:
+						overflow, err = parseOverflowPolicy(property)
+						if err != nil {
+							s.logger().Error(err.Error())
+							return nil, err
+						}
+
 					default:
-						lg.Error("Unknown property key '" + key + "'")
+						s.logger().Error("Unknown property key '" + key + "'")
 						return nil, errors.New("Unknown property key '" + key + "'")
 					}
 				} else if strings.HasPrefix(key, prefix) {
@@ -104,23 +153,36 @@ func newMqttProvider(s Subscriber) (*client, error) {
 					case queueSize:
 						queueSizeprop, err = strconv.Atoi(property)
 						if err != nil {
-							lg.Error("Invalid queuesize value '" + property + "'")
+							s.logger().Error("Invalid queuesize value '" + property + "'")
 							return nil, errors.New("Invalid queuesize value '" + property + "'")
 
 						}
 
 						if queueSizeprop <= 0 {
-							lg.Error("Invalid queuesize value '" + property + "'")
+							s.logger().Error("Invalid queuesize value '" + property + "'")
 							return nil, errors.New("Invalid queuesize value '" + property + "'")
 
 						}
 
+					case encodingProperty, protobufMessageProperty:
+						// validated by newEncoder
+					case resendMaxAttempts:
+						// validated by resendAttempts
+					case resendDropExhaustedProperty:
+						// validated by resendDropExhausted
+					case queueSizeProperty, queueWorkersProperty, queueOverflowProperty:
+						// validated by publishQueueSettings
+					case deadLetterDirectoryProperty, deadLetterSubscriberProperty:
+						// validated by newDeadLetterSink
+					case breakerThresholdProperty, breakerOpenTimeoutProperty, breakerHalfOpenProperty:
+						// validated by newBreaker
+
 					default:
-						lg.Error("Unknown property key '" + key + "'")
+						s.logger().Error("Unknown property key '" + key + "'")
 						return nil, errors.New("Unknown property key '" + key + "'")
 					}
 				} else {
-					lg.Error("Unknown property key '" + key + "'")
+					s.logger().Error("Unknown property key '" + key + "'")
 					return nil, errors.New("Unknown property key '" + key + "'")
 
 				}
@@ -135,7 +197,7 @@ func newMqttProvider(s Subscriber) (*client, error) {
 		opts.AddBroker("ssl://" + u.Host)
 
 	default:
-		lg.Error("Unknown scheme '" + u.Scheme + "'")
+		s.logger().Error("Unknown scheme '" + u.Scheme + "'")
 		return nil, errors.New("Unknown scheme '" + u.Scheme + "'")
 
 	}
@@ -144,15 +206,20 @@ func newMqttProvider(s Subscriber) (*client, error) {
 
 	opts.SetConnectTimeout(time.Duration(timeout/1000) * time.Second)
 	opts.SetAutoReconnect(true)
-	if nr > 0 {
+	if nr > 0 && !s.probe {
 		opts.SetCleanSession(false)
 	}
-	opts.SetStore(NewMemoryStore(queueSizeprop))
+	if storeType == "file" {
+		opts.SetStore(newFileStore(s.storeFolder("mqtt"), queueSizeprop, overflow, time.Duration(timeout)*time.Millisecond, s.logger()))
+	} else {
+		opts.SetStore(newMemoryStore(queueSizeprop, overflow, time.Duration(timeout)*time.Millisecond, s.logger()))
+	}
 	password, _ := u.User.Password()
 	opts.SetPassword(password)
-	cl := &client{nil, topic, nr, true, opts, timeout}
+	cl := &client{mclient: nil, topic: topic, qos: nr, isConnected: true, opts: opts, timeout: timeout, enc: enc, certs: s.certRoot(), inflight: make(map[mqtt.Token]struct{}), status: s.status(), metrics: s.metrics(), lg: s.logger()}
 	opts.SetOnConnectHandler(cl.onConnect)
 	opts.SetConnectionLostHandler(cl.onLost)
+	opts.SetReconnectingHandler(cl.onReconnecting)
 	opts.SetMaxReconnectInterval(30 * time.Second)
 	opts.SetConnectRetry(true)
 	opts.SetConnectRetryInterval(2 * time.Second)
@@ -161,11 +228,14 @@ func newMqttProvider(s Subscriber) (*client, error) {
 
 	cl.mclient = mclient
 	if u.Scheme == "mqtt" {
+		cl.status.setState(StatusConnecting)
 		if token := mclient.Connect(); token.WaitTimeout(time.Duration(timeout/1000)*time.Second) && token.Error() == nil {
 
 		} else {
-			lg.Error("Connection failed")
-			return cl, errors.New("Can't connect to mqtt at " + u.Host)
+			s.logger().Error("Connection failed")
+			err = errors.New("Can't connect to mqtt at " + u.Host)
+			cl.status.disconnected(err)
+			return cl, err
 		}
 	}
 	return cl, err
@@ -173,27 +243,27 @@ func newMqttProvider(s Subscriber) (*client, error) {
 }
 
 func (cl *client) onLost(c mqtt.Client, err error) {
-	lg.Error("Connection lost " + fmt.Sprint(err))
-
+	cl.lg.Error("Connection lost " + fmt.Sprint(err))
+	cl.status.disconnected(err)
 }
 
 func (cl *client) onConnect(c mqtt.Client) {
 
 	if c.IsConnectionOpen() {
-		lg.Info("Connection established")
+		cl.lg.Info("Connection established")
+		cl.status.connected()
 	}
 }
 
-func (cl *client) Publish(topic string, message interface{}) {
+func (cl *client) onReconnecting(c mqtt.Client, opts *mqtt.ClientOptions) {
+	cl.status.reconnecting()
+}
+
+func (cl *client) Publish(ctx context.Context, topic string, message interface{}) error {
 	if cl == nil {
-		return
+		return errors.New("MQTT client not initialized")
 	}
 
-	//if !cl.mclient.IsConnectionOpen() {
-	//we don't need this but maybe implement a que
-	//	return
-	//}
-
 	t := cl.topic
 	if topic != "" {
 		if cl.topic != "" {
@@ -203,34 +273,79 @@ func (cl *client) Publish(topic string, message interface{}) {
 		}
 	}
 
-	/*if !cl.mclient.IsConnected() {
-		lg.Error("disconnected from broker")
-		if token := cl.mclient.Connect(); token.Wait() && token.Error() != nil {
-			//lg.Error(token.Error.Error())
-			return
+	payload, err := cl.enc.Encode(message)
+	if err != nil {
+		cl.lg.Error(err.Error())
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cl.timeout)*time.Millisecond)
+	defer cancel()
+	token := cl.mclient.Publish(t, byte(cl.qos), false, payload)
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			cl.lg.Error(err.Error())
+			return err
 		}
-	}*/
-	//avoid blocking
-	cl.mclient.Publish(t, byte(cl.qos), false, message)
-	//if token := cl.mclient.Publish(t, byte(cl.qos), false, message); token.Wait() && token.Error() != nil {
-	//lg.Error(token.Error())
-	//	lg.Error("There is an Error")
-	//}
+		cl.metrics.sent(len(payload))
+		return nil
+	case <-ctx.Done():
+		// the message is still delivered by the client
+		cl.mu.Lock()
+		for t := range cl.inflight {
+			select {
+			case <-t.Done():
+				delete(cl.inflight, t)
+			default:
+			}
+		}
+		cl.inflight[token] = struct{}{}
+		cl.mu.Unlock()
+		return ErrPublishInFlight
+	}
+}
+
+//Drain waits for the messages still in flight
+func (cl *client) Drain(ctx context.Context) error {
+	if cl == nil {
+		return nil
+	}
+	cl.mu.Lock()
+	tokens := make([]mqtt.Token, 0, len(cl.inflight))
+	for token := range cl.inflight {
+		tokens = append(tokens, token)
+	}
+	cl.mu.Unlock()
+	for _, token := range tokens {
+		select {
+		case <-token.Done():
+			cl.mu.Lock()
+			delete(cl.inflight, token)
+			cl.mu.Unlock()
+		case <-ctx.Done():
+			return errors.New("MQTT messages still in flight")
+		}
+	}
+	return nil
 }
 func (cl *client) Shutdown() {
-	if cl != nil && cl.mclient.IsConnected() && cl.mclient.IsConnectionOpen() {
+	// stops the connection retries as well
+	if cl != nil {
 		cl.mclient.Disconnect(1)
 	}
 }
 func (cl *client) SetTLS(id string) error {
-	tlsconfig := newTLSConfig(dirname + "/certs/" + id)
+	tlsconfig := newTLSConfig(cl.certs+"/"+id, cl.lg)
 	cl.opts.SetTLSConfig(tlsconfig)
 	cl.mclient = mqtt.NewClient(cl.opts)
+	cl.status.setState(StatusConnecting)
 	if token := cl.mclient.Connect(); token.WaitTimeout(time.Duration(cl.timeout/1000)*time.Second) && token.Error() == nil {
 
 	} else {
-		lg.Error("Connection failed")
-		return errors.New("Can't connect to mqtt ")
+		cl.lg.Error("Connection failed")
+		err := errors.New("Can't connect to mqtt ")
+		cl.status.disconnected(err)
+		return err
 	}
 	return nil
 }
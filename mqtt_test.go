@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// stubToken token completed by closing done
+type stubToken struct {
+	mqtt.Token
+	done chan struct{}
+}
+
+func (t *stubToken) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *stubToken) Error() error {
+	return nil
+}
+
+// stubClient paho client handing out the token and recording disconnects
+type stubClient struct {
+	mqtt.Client
+	token       *stubToken
+	disconnects int32
+}
+
+func (c *stubClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.token
+}
+
+func (c *stubClient) IsConnected() bool {
+	return false
+}
+
+func (c *stubClient) Disconnect(quiesce uint) {
+	atomic.AddInt32(&c.disconnects, 1)
+}
+
+func testMQTTClient(t *testing.T, timeout int) (*client, *stubClient) {
+	enc, err := newEncoder(Subscriber{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubClient{token: &stubToken{done: make(chan struct{})}}
+	return &client{
+		mclient:  stub,
+		timeout:  timeout,
+		enc:      enc,
+		inflight: make(map[mqtt.Token]struct{}),
+		lg:       lg,
+	}, stub
+}
+
+func TestMQTTPublishTimeoutInFlight(t *testing.T) {
+	cl, stub := testMQTTClient(t, 10)
+	err := cl.Publish(context.Background(), "a", "report")
+	if !errors.Is(err, ErrPublishInFlight) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cl.Drain(ctx); err == nil {
+		t.Fatal("Drain returned while the report is in flight")
+	}
+	close(stub.token.done)
+	if err := cl.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(cl.inflight) != 0 {
+		t.Fatal("delivered report still in flight")
+	}
+}
+
+func TestMQTTPublishConfirmed(t *testing.T) {
+	cl, stub := testMQTTClient(t, 1000)
+	close(stub.token.done)
+	if err := cl.Publish(context.Background(), "a", "report"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMQTTShutdownDisconnected(t *testing.T) {
+	cl, stub := testMQTTClient(t, 10)
+	// stops the connection retries of a client which is not connected
+	cl.Shutdown()
+	if atomic.LoadInt32(&stub.disconnects) != 1 {
+		t.Fatal("Disconnect not called")
+	}
+}
@@ -0,0 +1,340 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	loglib "github.com/menucha-de/logging"
+	"github.com/menucha-de/utils"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type natsclient struct {
+	URI       string
+	subject   string
+	user      *url.Userinfo
+	jetStream bool
+	stream    string
+	timeout   int
+	enc       Encoder
+	retry     *retryPolicy
+	status    *statusTracker
+	metrics   *subscriberMetrics
+	lg        *loglib.Logger
+	certs     string
+	secure    bool
+	mu        sync.Mutex
+	nc        *nats.Conn
+	js        jetstream.JetStream
+}
+
+var defaultNATSPort string = "4222"
+var defaultNATSTimeout int = 10000
+var natsTimeoutProperty string = prefix + "NATS.Timeout"
+var natsJetStreamProperty string = prefix + "NATS.JetStream"
+var natsStreamProperty string = prefix + "NATS.Stream"
+var natsTLSProperty string = prefix + "NATS.TLS"
+
+func init() {
+	RegisterProvider("nats", natsFactory)
+}
+
+func natsFactory(s Subscriber) (Provider, bool, error) {
+	p, err := newNATSProvider(s)
+	if p == nil {
+		return nil, false, err
+	}
+	// keep the client on connection errors, it connects again on publish
+	return p, p.secure, err
+}
+
+// natsSubject converts a path into subject tokens
+func natsSubject(path string) (string, error) {
+	subject := strings.ReplaceAll(strings.Trim(path, "/"), "/", ".")
+	if strings.ContainsAny(subject, "*> \t\r\n") || strings.Contains(subject, "..") {
+		return "", errors.New("Invalid NATS subject '" + subject + "'")
+	}
+	return subject, nil
+}
+
+func newNATSProvider(s Subscriber) (*natsclient, error) {
+	if s.URI == "" {
+		s.logger().Error("URI Can't be null")
+		return nil, errors.New("URI must not be null")
+	}
+	u, err := url.Parse(s.URI)
+	if err != nil {
+		s.logger().Error("Can't parse subscriber URI")
+		return nil, err
+	}
+	if strings.ToLower(u.Scheme) != "nats" {
+		s.logger().Error("Unknown scheme '" + u.Scheme + "'")
+		return nil, errors.New("Unknown scheme '" + u.Scheme + "'")
+	}
+	if u.Hostname() == "" {
+		s.logger().Error("No NATS host specified")
+		return nil, errors.New("No NATS host specified")
+	}
+	subject, err := natsSubject(u.Path)
+	if err == nil && subject == "" {
+		err = errors.New("NATS subject must be specified using the path of the URI")
+	}
+	if err != nil {
+		s.logger().Error(err.Error())
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" || u.Port() == "0" {
+		host = u.Hostname() + ":" + defaultNATSPort
+	}
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicy(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsclient{
+		URI:     "nats://" + host,
+		subject: subject,
+		user:    u.User,
+		timeout: defaultNATSTimeout,
+		enc:     enc,
+		retry:   retry,
+		status:  s.status(),
+		metrics: s.metrics(),
+		lg:      s.logger(),
+		certs:   s.certRoot() + "/" + s.ID,
+	}
+	for key, property := range s.Properties {
+		if key == "" || !strings.HasPrefix(key, prefix+"NATS") {
+			continue
+		}
+		switch key {
+		case natsTimeoutProperty:
+			c.timeout, err = strconv.Atoi(property)
+			if err != nil || c.timeout < 0 {
+				s.logger().Error("Invalid timeout value '" + property + "'")
+				return nil, errors.New("Invalid timeout value '" + property + "'")
+			}
+		case natsJetStreamProperty:
+			c.jetStream, err = strconv.ParseBool(property)
+			if err != nil {
+				s.logger().Error("Invalid " + natsJetStreamProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + natsJetStreamProperty + " '" + property + "'")
+			}
+		case natsStreamProperty:
+			c.stream = property
+		case natsTLSProperty:
+			c.secure, err = strconv.ParseBool(property)
+			if err != nil {
+				s.logger().Error("Invalid " + natsTLSProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + natsTLSProperty + " '" + property + "'")
+			}
+		default:
+			s.logger().Error("Unknown property key '" + key + "'")
+			return nil, errors.New("Unknown property key '" + key + "'")
+		}
+	}
+	if c.stream != "" && !c.jetStream {
+		s.logger().Error(natsStreamProperty + " requires " + natsJetStreamProperty)
+		return nil, errors.New(natsStreamProperty + " requires " + natsJetStreamProperty)
+	}
+	if !c.secure {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := c.connect(); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// options returns the connection options. The credentials are taken from the
+// user info of the URI or the credentials file of the subscriber which holds
+// either a creds file or an NKey seed.
+func (c *natsclient) options() ([]nats.Option, error) {
+	opts := []nats.Option{
+		nats.Timeout(time.Duration(c.timeout) * time.Millisecond),
+		nats.MaxReconnects(-1),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			c.lg.Info("Connection established")
+			c.status.connected()
+		}),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err != nil {
+				c.lg.Error("Connection lost " + err.Error())
+				c.status.disconnected(err)
+			}
+		}),
+	}
+	if c.user != nil {
+		if password, ok := c.user.Password(); ok {
+			opts = append(opts, nats.UserInfo(c.user.Username(), password))
+		} else {
+			opts = append(opts, nats.Token(c.user.Username()))
+		}
+	}
+	credentials := c.certs + "/" + credentialsFileName
+	if utils.FileExists(credentials) {
+		content, err := ioutil.ReadFile(credentials)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Contains(content, []byte("BEGIN NATS USER JWT")) {
+			opts = append(opts, nats.UserCredentials(credentials))
+		} else {
+			opt, err := nats.NkeyOptionFromSeed(credentials)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, opt)
+		}
+	}
+	if c.secure {
+		opts = append(opts, nats.Secure(newTLSConfig(c.certs, c.lg)))
+	}
+	return opts, nil
+}
+
+// connect opens the connection, c.mu has to be held. Once established the
+// connection is reconnected by the client.
+func (c *natsclient) connect() error {
+	c.close()
+	opts, err := c.options()
+	if err != nil {
+		c.lg.Error(err.Error())
+		c.status.failed(err)
+		return err
+	}
+	c.status.setState(StatusConnecting)
+	nc, err := nats.Connect(c.URI, opts...)
+	if err != nil {
+		c.lg.Error("Can't connect to NATS at " + c.URI + ": " + err.Error())
+		c.status.disconnected(err)
+		return err
+	}
+	c.status.connected()
+	if c.jetStream {
+		js, err := jetstream.New(nc)
+		if err != nil {
+			nc.Close()
+			c.lg.Error(err.Error())
+			return err
+		}
+		c.js = js
+	}
+	c.nc = nc
+	return nil
+}
+
+func (c *natsclient) Publish(ctx context.Context, topic string, message interface{}) error {
+	if c == nil {
+		return errors.New("NATS client not initialized")
+	}
+
+	subject := c.subject
+	if topic != "" {
+		token, err := natsSubject(topic)
+		if err != nil {
+			c.lg.Error(err.Error())
+			return &deliveryError{err: err, permanent: true}
+		}
+		if token != "" {
+			subject = subject + "." + token
+		}
+	}
+
+	payload, err := c.enc.Encode(message)
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	// the same id for every attempt lets JetStream drop duplicates
+	id := uuid.New().String()
+	return c.retry.do(ctx, func(ctx context.Context) error {
+		return c.send(ctx, subject, id, payload)
+	})
+}
+
+// send makes a single attempt to publish the report. Core NATS publishes are
+// flushed, JetStream publishes wait for the acknowledgement of the stream.
+func (c *natsclient) send(ctx context.Context, subject string, id string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.timeout)*time.Millisecond)
+	defer cancel()
+	c.mu.Lock()
+	if c.nc == nil || c.nc.IsClosed() {
+		if err := c.connect(); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	nc, js := c.nc, c.js
+	c.mu.Unlock()
+
+	if js != nil {
+		msg := nats.NewMsg(subject)
+		msg.Header.Set("Content-Type", c.enc.ContentType())
+		msg.Data = payload
+		opts := []jetstream.PublishOpt{jetstream.WithMsgID(id)}
+		if c.stream != "" {
+			opts = append(opts, jetstream.WithExpectStream(c.stream))
+		}
+		ack, err := js.PublishMsg(ctx, msg, opts...)
+		if err != nil {
+			c.lg.Error(err.Error())
+			return err
+		}
+		if ack.Duplicate {
+			c.lg.Debug("Report " + id + " already stored by stream " + ack.Stream)
+		}
+		c.metrics.sent(len(payload))
+		return nil
+	}
+	if err := nc.Publish(subject, payload); err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	if err := nc.FlushWithContext(ctx); err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	c.metrics.sent(len(payload))
+	return nil
+}
+
+// close closes the connection, c.mu has to be held
+func (c *natsclient) close() {
+	if c.nc != nil {
+		c.nc.Close()
+		c.nc = nil
+		c.js = nil
+	}
+}
+
+func (c *natsclient) Shutdown() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.close()
+}
+
+//SetTLS connects again using the current certificates and credentials of
+//the subscriber
+func (c *natsclient) SetTLS(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connect()
+}
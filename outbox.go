@@ -0,0 +1,411 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var outboxRetryInterval = 5 * time.Second
+
+//ErrQueuedForRedelivery is returned by synchronous publishes of a report
+//which could not be delivered yet and has been queued for redelivery
+var ErrQueuedForRedelivery = errors.New("Report queued for redelivery")
+
+var defaultResendMaxAttempts int = 10
+
+// outboxRecord is a line of the outbox log. A record either holds a report or
+// acknowledges the delivery of the report with the same sequence number.
+type outboxRecord struct {
+	Seq     uint64 `json:"seq"`
+	Ack     bool   `json:"ack,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+	// replays and publish attempts failed since the outbox was loaded
+	replays  int
+	attempts int
+}
+
+// outbox persistent queue of the reports which could not be delivered to a
+// subscriber. Reports are replayed in order as soon as the subscriber is
+// reachable again.
+type outbox struct {
+	mu      sync.Mutex
+	t       *Transport
+	id      string
+	path    string
+	size    int
+	max     int
+	drop    bool
+	retry   time.Duration
+	enc     Encoder
+	entries []outboxRecord
+	acks    int
+	seq     uint64
+	file    *os.File
+	kick    chan struct{}
+	done    chan struct{}
+}
+
+// openOutbox returns the outbox of the subscriber and starts replaying
+// queued reports
+func (t *Transport) openOutbox(s Subscriber) (*outbox, error) {
+	size, err := resendQueueSize(s)
+	if err != nil {
+		return nil, err
+	}
+	max, err := resendAttempts(s)
+	if err != nil {
+		return nil, err
+	}
+	drop, err := resendDropExhausted(s)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	t.outboxesMu.Lock()
+	defer t.outboxesMu.Unlock()
+	if o, ok := t.outboxes[s.ID]; ok {
+		o.mu.Lock()
+		o.size = size
+		o.max = max
+		o.drop = drop
+		o.enc = enc
+		o.mu.Unlock()
+		o.notify()
+		return o, nil
+	}
+	if _, err := os.Stat(t.outboxFolder()); os.IsNotExist(err) {
+		os.MkdirAll(t.outboxFolder(), 0700)
+	}
+	o := &outbox{
+		t:     t,
+		id:    s.ID,
+		path:  t.outboxFolder() + "/" + s.ID + ".log",
+		size:  size,
+		max:   max,
+		drop:  drop,
+		retry: outboxRetryInterval,
+		enc:   enc,
+		kick:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	t.outboxes[s.ID] = o
+	go o.run()
+	o.notify()
+	return o, nil
+}
+
+func (t *Transport) getOutbox(id string) *outbox {
+	t.outboxesMu.Lock()
+	defer t.outboxesMu.Unlock()
+	return t.outboxes[id]
+}
+
+// removeOutbox stops the outbox of the subscriber and deletes queued reports
+func (t *Transport) removeOutbox(id string) {
+	t.outboxesMu.Lock()
+	o, ok := t.outboxes[id]
+	delete(t.outboxes, id)
+	t.outboxesMu.Unlock()
+	if ok {
+		o.close()
+	}
+	err := os.Remove(t.outboxFolder() + "/" + id + ".log")
+	if err != nil && !os.IsNotExist(err) {
+		t.lg.WithError(err).Warning("Failed to delete outbox")
+	}
+}
+
+func resendQueueSize(s Subscriber) (int, error) {
+	property, ok := s.Properties[queueSize]
+	if !ok {
+		return defaultQueueSize, nil
+	}
+	size, err := strconv.Atoi(property)
+	if err != nil || size <= 0 {
+		s.logger().Error("Invalid queuesize value '" + property + "'")
+		return 0, errors.New("Invalid queuesize value '" + property + "'")
+	}
+	return size, nil
+}
+
+func resendAttempts(s Subscriber) (int, error) {
+	property, ok := s.Properties[resendMaxAttempts]
+	if !ok {
+		return defaultResendMaxAttempts, nil
+	}
+	max, err := strconv.Atoi(property)
+	if err != nil || max <= 0 {
+		s.logger().Error("Invalid " + resendMaxAttempts + " value '" + property + "'")
+		return 0, errors.New("Invalid " + resendMaxAttempts + " value '" + property + "'")
+	}
+	return max, nil
+}
+
+func resendDropExhausted(s Subscriber) (bool, error) {
+	property, ok := s.Properties[resendDropExhaustedProperty]
+	if !ok {
+		return false, nil
+	}
+	drop, err := strconv.ParseBool(property)
+	if err != nil {
+		s.logger().Error("Invalid " + resendDropExhaustedProperty + " value '" + property + "'")
+		return false, errors.New("Invalid " + resendDropExhaustedProperty + " value '" + property + "'")
+	}
+	return drop, nil
+}
+
+func (o *outbox) load() error {
+	f, err := os.Open(o.path)
+	if err == nil {
+		dec := json.NewDecoder(f)
+		for {
+			var r outboxRecord
+			if err := dec.Decode(&r); err != nil {
+				// a truncated last record is the result of an interrupted write
+				break
+			}
+			if r.Seq > o.seq {
+				o.seq = r.Seq
+			}
+			if r.Ack {
+				o.acks++
+				if len(o.entries) > 0 && o.entries[0].Seq == r.Seq {
+					o.entries = o.entries[1:]
+				}
+			} else {
+				o.entries = append(o.entries, r)
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		o.t.lg.WithError(err).Error("Failed to read outbox")
+		return err
+	}
+	return o.compact()
+}
+
+// compact rewrites the log with the pending reports only
+func (o *outbox) compact() error {
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		o.t.lg.WithError(err).Error("Failed to create outbox")
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, r := range o.entries {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+	o.file, err = os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	o.acks = 0
+	return nil
+}
+
+func (o *outbox) write(r outboxRecord) error {
+	if o.file == nil {
+		return errors.New("Outbox of subscriber " + o.id + " is closed")
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := o.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+// pending returns whether reports are waiting for delivery
+func (o *outbox) pending() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries) > 0
+}
+
+// count returns the number of reports waiting for delivery
+func (o *outbox) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries)
+}
+
+// put queues the encoded report
+func (o *outbox) put(topic string, report interface{}) error {
+	o.mu.Lock()
+	payload, err := o.enc.Encode(report)
+	if err != nil {
+		o.mu.Unlock()
+		o.t.lg.Error(err.Error())
+		return err
+	}
+	r := outboxRecord{Topic: topic, Payload: payload}
+	if len(o.entries) >= o.size {
+		o.mu.Unlock()
+		o.t.lg.Debug("queue size excedeed")
+		return errors.New("Resend queue of subscriber " + o.id + " is full")
+	}
+	r.Seq = o.seq + 1
+	if err := o.write(r); err != nil {
+		o.mu.Unlock()
+		o.t.lg.WithError(err).Error("Failed to write outbox")
+		return err
+	}
+	o.seq = r.Seq
+	o.entries = append(o.entries, r)
+	o.mu.Unlock()
+	o.notify()
+	return nil
+}
+
+func (o *outbox) notify() {
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) run() {
+	t := time.NewTicker(o.retry)
+	defer t.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-o.kick:
+			o.drain(false)
+		case <-t.C:
+			o.drain(true)
+		}
+	}
+}
+
+// drain replays the queued reports until the subscriber fails again. Only
+// the replays of the retry interval which reached the subscriber count as
+// attempts. A report failing permanently is dead lettered, or dropped if the
+// subscriber has no dead letter destination. A report failing more than the
+// max attempts is dead lettered, without destination it is kept unless the
+// subscriber drops exhausted reports.
+func (o *outbox) drain(retry bool) {
+	for {
+		select {
+		case <-o.done:
+			return
+		default:
+		}
+		o.mu.Lock()
+		if len(o.entries) == 0 {
+			o.mu.Unlock()
+			return
+		}
+		r := o.entries[0]
+		o.mu.Unlock()
+
+		s, ok := o.t.subscriber(o.id)
+		if !ok || s.Provider == nil {
+			return
+		}
+		// a report still in flight is delivered by the provider
+		if err := s.Provider.Publish(context.Background(), r.Topic, r.Payload); err != nil && !inFlight(err) {
+			if permanentFailure(err) {
+				if !o.t.discard(&s, r.Topic, r.Payload, err) {
+					return
+				}
+			} else if !retry || errors.Is(err, ErrCircuitOpen) {
+				o.t.lg.WithError(err).Debug("Failed to resend report")
+				return
+			} else if !o.exhausted(&s, r, err) {
+				return
+			}
+		}
+		if err := o.ack(r.Seq); err != nil {
+			o.t.lg.WithError(err).Error("Failed to write outbox")
+			return
+		}
+	}
+}
+
+// exhausted records a failed replay of the first report, it returns true
+// once the report failed more than the max attempts and has been dead
+// lettered or dropped
+func (o *outbox) exhausted(s *Subscriber, r outboxRecord, err error) bool {
+	attempts, exhausted := o.failed(r.Seq, deliveryAttempts(err))
+	if !exhausted {
+		o.t.lg.WithError(err).Debug("Failed to resend report")
+		return false
+	}
+	err = &deliveryError{err: err, attempts: attempts}
+	o.mu.Lock()
+	drop := o.drop
+	o.mu.Unlock()
+	if drop {
+		return o.t.discard(s, r.Topic, r.Payload, err)
+	}
+	return o.t.deadLetter(s, r.Topic, r.Payload, err)
+}
+
+// failed records a failed replay of the first report, it returns the
+// publish attempts made so far and whether the replays are exhausted
+func (o *outbox) failed(seq uint64, attempts int) (int, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.entries) == 0 || o.entries[0].Seq != seq {
+		return attempts, false
+	}
+	o.entries[0].replays++
+	o.entries[0].attempts += attempts
+	return o.entries[0].attempts, o.entries[0].replays >= o.max
+}
+
+func (o *outbox) ack(seq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.entries) == 0 || o.entries[0].Seq != seq {
+		return nil
+	}
+	o.entries = o.entries[1:]
+	o.acks++
+	if o.acks >= o.size {
+		return o.compact()
+	}
+	return o.write(outboxRecord{Seq: seq, Ack: true})
+}
+
+func (o *outbox) close() {
+	close(o.done)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+}
@@ -0,0 +1,361 @@
+package transport
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// retryOutboxEvery sets the retry interval of the outboxes opened by the test
+func retryOutboxEvery(t *testing.T, interval time.Duration) {
+	old := outboxRetryInterval
+	outboxRetryInterval = interval
+	t.Cleanup(func() {
+		outboxRetryInterval = old
+	})
+}
+
+func sendReports(t *testing.T, tr *Transport, id string, reports ...string) {
+	for _, report := range reports {
+		err := tr.SendReport(context.Background(), Subscriptor{SubscriberID: id, Path: "a"}, report)
+		if err != nil && err != ErrQueuedForRedelivery {
+			t.Fatal(err)
+		}
+	}
+}
+
+func waitForReports(t *testing.T, host string, want ...string) {
+	waitFor(t, "reports", func() bool {
+		return len(fakeReports(host)) >= len(want)
+	})
+	got := fakeReports(host)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delivered %v, want %v", got, want)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+}
+
+func TestOutboxReplaysInOrderAfterRecovery(t *testing.T) {
+	retryOutboxEvery(t, 10*time.Millisecond)
+	up := fakeDown("recovery")
+	defer up()
+
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://recovery", Properties: map[string]string{
+		queueWorkersProperty:     "0",
+		breakerThresholdProperty: "0",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.SendReport(context.Background(), Subscriptor{SubscriberID: id}, "r1")
+	if err != ErrQueuedForRedelivery {
+		t.Fatal("report not queued for redelivery:", err)
+	}
+	sendReports(t, tr, id, "r2", "r3")
+	if n := tr.getOutbox(id).count(); n != 3 {
+		t.Fatalf("%d reports queued, want 3", n)
+	}
+	up()
+	// queued behind the pending reports although the subscriber is back
+	sendReports(t, tr, id, "r4")
+	waitForReports(t, "recovery", "r1", "r2", "r3", "r4")
+	waitFor(t, "empty outbox", func() bool {
+		return tr.getOutbox(id).count() == 0
+	})
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	retryOutboxEvery(t, 10*time.Millisecond)
+	up := fakeDown("restart")
+	defer up()
+
+	dir := testDir(t)
+	tr := newTestTransport(t, WithDirectory(dir))
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://restart", Properties: map[string]string{
+		queueWorkersProperty:     "0",
+		breakerThresholdProperty: "0",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendReports(t, tr, id, "r1", "r2", "r3")
+	tr.Close()
+	up()
+
+	tr = newTestTransport(t, WithDirectory(dir))
+	defer tr.Close()
+	waitForReports(t, "restart", "r1", "r2", "r3")
+	waitFor(t, "empty outbox", func() bool {
+		return tr.getOutbox(id).count() == 0
+	})
+}
+
+func TestOutboxCompaction(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	// the outbox of an unknown subscriber is not drained
+	o, err := tr.openOutbox(Subscriber{ID: "compaction", Properties: map[string]string{queueSize: "3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload := func() []outboxRecord {
+		r := &outbox{t: tr, id: o.id, path: o.path, size: o.size}
+		if err := r.load(); err != nil {
+			t.Fatal(err)
+		}
+		r.file.Close()
+		return r.entries
+	}
+	lines := func() int {
+		b, err := ioutil.ReadFile(o.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(b), "\n")
+	}
+	o.put("a", "r1")
+	o.put("a", "r2")
+	o.ack(1)
+	o.put("a", "r3")
+	o.ack(2)
+	if n := lines(); n != 5 {
+		t.Fatalf("%d lines before the compaction, want 5", n)
+	}
+	if entries := reload(); len(entries) != 1 || entries[0].Seq != 3 {
+		t.Fatalf("reloaded %+v", entries)
+	}
+	o.put("a", "r4")
+	o.ack(3)
+	// the third ack compacts the log to the pending report
+	if n := lines(); n != 1 {
+		t.Fatalf("%d lines after the compaction, want 1", n)
+	}
+	o.put("a", "r5")
+	entries := reload()
+	if len(entries) != 2 || entries[0].Seq != 4 || entries[1].Seq != 5 || string(entries[1].Payload) != "r5" {
+		t.Fatalf("reloaded %+v", entries)
+	}
+}
+
+func TestOutboxCapacity(t *testing.T) {
+	up := fakeDown("capacity")
+	defer up()
+
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://capacity", Properties: map[string]string{
+		queueWorkersProperty:        "0",
+		breakerThresholdProperty:    "0",
+		queueSize:                   "2",
+		deadLetterDirectoryProperty: "deadletters",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendReports(t, tr, id, "r1", "r2")
+	err = tr.SendReport(context.Background(), Subscriptor{SubscriberID: id}, "r3")
+	if err == nil || err == ErrQueuedForRedelivery {
+		t.Fatal("report exceeding the resend queue accepted:", err)
+	}
+	if n := tr.getOutbox(id).count(); n != 2 {
+		t.Fatalf("%d reports queued, want 2", n)
+	}
+	letters, _ := tr.deadLetters(id)
+	if len(letters) != 1 || string(letters[0].Payload) != "r3" {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+}
+
+func TestOutboxDeadLettersExhaustedReports(t *testing.T) {
+	retryOutboxEvery(t, 10*time.Millisecond)
+
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://fail", Properties: map[string]string{
+		queueWorkersProperty:        "0",
+		breakerThresholdProperty:    "0",
+		resendMaxAttempts:           "3",
+		deadLetterDirectoryProperty: "deadletters",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.SendReport(context.Background(), Subscriptor{SubscriberID: id, Path: "a/b"}, "report")
+	if err != ErrQueuedForRedelivery {
+		t.Fatal("report not queued for redelivery:", err)
+	}
+	waitFor(t, "dead letter", func() bool {
+		letters, _ := tr.deadLetters(id)
+		return len(letters) == 1
+	})
+	if n := tr.getOutbox(id).count(); n != 0 {
+		t.Fatalf("%d reports left in the outbox", n)
+	}
+	letters, _ := tr.deadLetters(id)
+	if letters[0].Path != "a/b" || letters[0].Attempts != 3 {
+		t.Fatalf("unexpected dead letter %+v", letters[0])
+	}
+}
+
+func TestOutboxKeepsExhaustedReportsWithoutDestination(t *testing.T) {
+	retryOutboxEvery(t, 10*time.Millisecond)
+	up := fakeDown("outage")
+	defer up()
+
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://outage", Properties: map[string]string{
+		queueWorkersProperty:     "0",
+		breakerThresholdProperty: "0",
+		resendMaxAttempts:        "2",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendReports(t, tr, id, "r1", "r2")
+	waitFor(t, "replays", func() bool {
+		return fakeCount("outage") >= 10
+	})
+	if n := tr.getOutbox(id).count(); n != 2 {
+		t.Fatalf("%d reports left in the outbox, want 2", n)
+	}
+	up()
+	waitForReports(t, "outage", "r1", "r2")
+}
+
+func TestOutboxDropsExhaustedReportsIfEnabled(t *testing.T) {
+	retryOutboxEvery(t, 10*time.Millisecond)
+
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://fail", Properties: map[string]string{
+		queueWorkersProperty:        "0",
+		resendMaxAttempts:           "2",
+		resendDropExhaustedProperty: "true",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendReports(t, tr, id, "r1")
+	waitFor(t, "drop", func() bool {
+		return tr.getOutbox(id).count() == 0
+	})
+}
+
+func TestOutboxNewReportsDoNotCountAttempts(t *testing.T) {
+	// no replays of the retry interval during the test
+	retryOutboxEvery(t, time.Hour)
+	up := fakeDown("kicks")
+	defer up()
+
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://kicks", Properties: map[string]string{
+		queueWorkersProperty:        "0",
+		breakerThresholdProperty:    "0",
+		resendMaxAttempts:           "2",
+		deadLetterDirectoryProperty: "deadletters",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		sendReports(t, tr, id, "r"+strconv.Itoa(i))
+		time.Sleep(2 * time.Millisecond)
+	}
+	if n := tr.getOutbox(id).count(); n != 10 {
+		t.Fatalf("%d reports left in the outbox, want 10", n)
+	}
+	if letters, _ := tr.deadLetters(id); len(letters) != 0 {
+		t.Fatalf("%d reports dead lettered", len(letters))
+	}
+}
+
+func TestOutboxOpenCircuitDoesNotCountAttempts(t *testing.T) {
+	retryOutboxEvery(t, 10*time.Millisecond)
+	up := fakeDown("circuit")
+	defer up()
+
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://circuit", Properties: map[string]string{
+		queueWorkersProperty:        "0",
+		breakerThresholdProperty:    "1",
+		breakerOpenTimeoutProperty:  "3600000",
+		resendMaxAttempts:           "2",
+		deadLetterDirectoryProperty: "deadletters",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendReports(t, tr, id, "r1")
+	time.Sleep(100 * time.Millisecond)
+	if n := fakeCount("circuit"); n != 1 {
+		t.Fatalf("%d publishes passed the open circuit", n)
+	}
+	if letters, _ := tr.deadLetters(id); len(letters) != 0 {
+		t.Fatalf("%d reports dead lettered", len(letters))
+	}
+	up()
+	if err := tr.resetCircuit(id); err != nil {
+		t.Fatal(err)
+	}
+	waitForReports(t, "circuit", "r1")
+}
+
+func TestPermanentFailureIsNotQueued(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://reject", Properties: map[string]string{
+		queueWorkersProperty: "0",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.SendReport(context.Background(), Subscriptor{SubscriberID: id}, "report"); err == nil {
+		t.Fatal("permanent failure not returned")
+	}
+	if n := tr.getOutbox(id).count(); n != 0 {
+		t.Fatalf("%d reports parked in the outbox", n)
+	}
+}
+
+func TestDeadLetterDirectoryInsideConfiguration(t *testing.T) {
+	tr := New(WithDirectory("/var/lib/transport"))
+	for directory, valid := range map[string]bool{
+		"deadletters":      true,
+		"a/../deadletters": true,
+		"/tmp/deadletters": false,
+		"..":               false,
+		"../deadletters":   false,
+		"a/../../b":        false,
+		".":                false,
+	} {
+		sink, err := newDeadLetterSink(Subscriber{ID: "x", t: tr, Properties: map[string]string{deadLetterDirectoryProperty: directory}})
+		if valid != (err == nil) {
+			t.Errorf("%s: unexpected result %v", directory, err)
+		}
+		if err == nil && sink.directory != "/var/lib/transport/deadletters" {
+			t.Errorf("%s: resolved to %s", directory, sink.directory)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+//ProviderFactory creates the provider of a subscriber. The factory validates
+//the Transporter.* properties it is responsible for and reports whether the
+//TLS material of the subscriber has to be applied using Provider.SetTLS.
+type ProviderFactory func(s Subscriber) (p Provider, tls bool, err error)
+
+var factories = make(map[string]ProviderFactory)
+var factoriesMu sync.RWMutex
+
+//RegisterProvider makes a provider available for the given URI scheme.
+//Enabled subscribers using the scheme which have been loaded before the
+//registration are started immediately. It panics if the factory is nil or
+//the scheme is already registered.
+func RegisterProvider(scheme string, factory ProviderFactory) {
+	if factory == nil {
+		panic("transport: RegisterProvider factory is nil")
+	}
+	factoriesMu.Lock()
+	if _, dup := factories[scheme]; dup {
+		factoriesMu.Unlock()
+		panic("transport: RegisterProvider called twice for scheme " + scheme)
+	}
+	factories[scheme] = factory
+	factoriesMu.Unlock()
+
+	providerRegistered(scheme)
+}
+
+func lookupProvider(scheme string) (ProviderFactory, bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	f, ok := factories[scheme]
+	return f, ok
+}
+
+func schemeOf(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme
+}
+
+//LegacyProvider provider interface without delivery feedback
+type LegacyProvider interface {
+	Publish(topic string, m interface{})
+	Shutdown()
+	SetTLS(id string) error
+}
+
+type legacyProvider struct {
+	LegacyProvider
+}
+
+//FromLegacyProvider adapts a provider implementing the former Publish
+//signature. Publish of the returned provider only fails if the context is
+//done before the report has been handed over.
+func FromLegacyProvider(p LegacyProvider) Provider {
+	return &legacyProvider{p}
+}
+
+func (p *legacyProvider) Publish(ctx context.Context, topic string, m interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.LegacyProvider.Publish(topic, m)
+	return nil
+}
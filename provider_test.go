@@ -0,0 +1,138 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testScheme returns a scheme which has not been registered, the registry
+// is global and tests may run repeatedly
+func testScheme(name string) string {
+	return name + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+type legacyStub struct {
+	mu        sync.Mutex
+	published []string
+	shutdown  bool
+	tls       string
+}
+
+func (p *legacyStub) Publish(topic string, m interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, topic+":"+m.(string))
+}
+
+func (p *legacyStub) Shutdown() {
+	p.shutdown = true
+}
+
+func (p *legacyStub) SetTLS(id string) error {
+	p.tls = id
+	return nil
+}
+
+func mustPanic(t *testing.T, what string, f func()) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal(what + " did not panic")
+		}
+	}()
+	f()
+}
+
+func TestRegisterProvider(t *testing.T) {
+	scheme := testScheme("registry")
+	if _, ok := lookupProvider(scheme); ok {
+		t.Fatal("unregistered scheme found")
+	}
+	factory := func(s Subscriber) (Provider, bool, error) {
+		return &fakeProvider{host: "registry"}, false, nil
+	}
+	RegisterProvider(scheme, factory)
+	if _, ok := lookupProvider(scheme); !ok {
+		t.Fatal("registered scheme not found")
+	}
+	mustPanic(t, "duplicate registration", func() {
+		RegisterProvider(scheme, factory)
+	})
+	mustPanic(t, "registration of a nil factory", func() {
+		RegisterProvider(testScheme("nil"), nil)
+	})
+	for _, scheme := range []string{"http", "https", "mqtt", "mqtts", "tcp", "tcps", "udp", "azure", "amqp", "amqps", "kafka", "nats", "ws", "wss", "local"} {
+		if _, ok := lookupProvider(scheme); !ok {
+			t.Errorf("built-in scheme %s not registered", scheme)
+		}
+	}
+}
+
+func TestUnknownScheme(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	if _, err := tr.config.add(Subscriber{Enable: true, URI: testScheme("unknown") + "://host"}); err == nil {
+		t.Fatal("subscriber with unknown scheme added")
+	}
+	// disabled subscribers are not connected
+	if _, err := tr.config.add(Subscriber{URI: testScheme("unknown") + "://host"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPendingSubscriberStartedOnRegistration(t *testing.T) {
+	dir := testDir(t)
+	scheme := testScheme("pending")
+	config, _ := json.Marshal(SubscriberConfiguration{Subscribers: map[string]*Subscriber{
+		"pending": {ID: "pending", Enable: true, URI: scheme + "://host"},
+	}})
+	if err := ioutil.WriteFile(dir+"/subscribers.json", config, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tr := newTestTransport(t, WithDirectory(dir))
+	defer tr.Close()
+	if s, ok := tr.subscriber("pending"); !ok || s.Provider != nil {
+		t.Fatalf("subscriber of unregistered scheme connected %+v", s)
+	}
+	legacy := &legacyStub{}
+	RegisterProvider(scheme, func(s Subscriber) (Provider, bool, error) {
+		return FromLegacyProvider(legacy), false, nil
+	})
+	if s, _ := tr.subscriber("pending"); s.Provider == nil {
+		t.Fatal("subscriber not started on registration")
+	}
+	if err := tr.deliver(context.Background(), "pending", "topic", "report"); err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy.published) != 1 || legacy.published[0] != "topic:report" {
+		t.Fatalf("published %v", legacy.published)
+	}
+}
+
+func TestLegacyProvider(t *testing.T) {
+	legacy := &legacyStub{}
+	p := FromLegacyProvider(legacy)
+	if err := p.Publish(context.Background(), "a", "report"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Publish(ctx, "b", "report"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("publish with canceled context returned %v", err)
+	}
+	if len(legacy.published) != 1 || legacy.published[0] != "a:report" {
+		t.Fatalf("published %v", legacy.published)
+	}
+	if err := p.SetTLS("id"); err != nil || legacy.tls != "id" {
+		t.Fatalf("TLS applied for %q, %v", legacy.tls, err)
+	}
+	p.Shutdown()
+	if !legacy.shutdown {
+		t.Fatal("legacy provider not shut down")
+	}
+}
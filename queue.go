@@ -0,0 +1,229 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+var queueSizeProperty string = prefix + "Queue.Size"
+var queueWorkersProperty string = prefix + "Queue.Workers"
+var queueOverflowProperty string = prefix + "Queue.Overflow"
+
+var defaultPublishQueueSize int = 100
+var defaultWorkers int = 1
+
+// errQueueClosed is returned by put once the queue is stopped, the report
+// belongs to the queue replacing it
+var errQueueClosed = errors.New("Publish queue is closed")
+
+type job struct {
+	topic  string
+	report interface{}
+}
+
+// queue bounded publish queue of a subscriber drained by a pool of workers.
+// Reports of a subscriptor keep their order with a single worker.
+type queue struct {
+	t        *Transport
+	id       string
+	jobs     chan job
+	overflow overflowPolicy
+	done     chan struct{}
+	// mu is held shared by put and exclusively by stop, reports put
+	// before the queue is closed are drained by stop
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+type queueSettings struct {
+	size     int
+	workers  int
+	overflow overflowPolicy
+}
+
+func publishQueueSettings(s Subscriber) (queueSettings, error) {
+	settings := queueSettings{defaultPublishQueueSize, defaultWorkers, overflowDropNewest}
+	for key, property := range s.Properties {
+		switch key {
+		case queueSizeProperty:
+			size, err := strconv.Atoi(property)
+			if err != nil || size <= 0 {
+				s.logger().Error("Invalid queue size value '" + property + "'")
+				return settings, errors.New("Invalid queue size value '" + property + "'")
+			}
+			settings.size = size
+		case queueWorkersProperty:
+			workers, err := strconv.Atoi(property)
+			if err != nil || workers < 0 {
+				s.logger().Error("Invalid workers value '" + property + "'")
+				return settings, errors.New("Invalid workers value '" + property + "'")
+			}
+			settings.workers = workers
+		case queueOverflowProperty:
+			overflow, err := parseOverflowPolicy(property)
+			if err != nil {
+				s.logger().Error(err.Error())
+				return settings, err
+			}
+			settings.overflow = overflow
+		}
+	}
+	return settings, nil
+}
+
+// openQueue creates the publish queue of the subscriber. Reports are
+// published synchronously if the number of workers is 0.
+func (t *Transport) openQueue(s Subscriber) error {
+	settings, err := publishQueueSettings(s)
+	if err != nil {
+		return err
+	}
+	t.queuesMu.Lock()
+	old := t.queues[s.ID]
+	delete(t.queues, s.ID)
+	if settings.workers > 0 {
+		q := &queue{
+			t:        t,
+			id:       s.ID,
+			jobs:     make(chan job, settings.size),
+			overflow: settings.overflow,
+			done:     make(chan struct{}),
+		}
+		q.workers.Add(settings.workers)
+		for i := 0; i < settings.workers; i++ {
+			go q.work()
+		}
+		t.queues[s.ID] = q
+	}
+	t.queuesMu.Unlock()
+	if old != nil {
+		// the reports already queued are published by the new queue. The
+		// configuration lock may be held, a worker of the old queue waiting
+		// for it finishes in the background.
+		go old.stop(func(j job) {
+			t.requeue(s.ID, j)
+		})
+	}
+	return nil
+}
+
+func (t *Transport) getQueue(id string) *queue {
+	t.queuesMu.Lock()
+	defer t.queuesMu.Unlock()
+	return t.queues[id]
+}
+
+// closeQueue stops the workers of the queue and hands the reports still
+// queued to keep. The workers need the configuration lock, it must not be
+// held.
+func (t *Transport) closeQueue(id string, keep func(j job)) {
+	t.queuesMu.Lock()
+	q, ok := t.queues[id]
+	delete(t.queues, id)
+	t.queuesMu.Unlock()
+	if ok {
+		q.stop(keep)
+	}
+}
+
+// requeue moves a report to the current queue of the subscriber without
+// blocking, reports which do not fit are persisted
+func (t *Transport) requeue(id string, j job) {
+	defer t.inflight.end(id)
+	if q := t.getQueue(id); q != nil && t.inflight.begin(id) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := q.put(ctx, j); err == nil {
+			return
+		}
+		t.inflight.end(id)
+	}
+	t.persist(id, j)
+}
+
+// persist moves a queued report to the resend queue of the subscriber
+func (t *Transport) persist(id string, j job) {
+	if o := t.getOutbox(id); o != nil {
+		if err := o.put(j.topic, j.report); err != nil {
+			t.lg.WithError(err).Warning("Dropping queued report")
+		}
+		return
+	}
+	t.lg.Warning("Dropping queued report of subscriber " + id)
+}
+
+// put queues a report applying the overflow policy if the queue is full
+func (q *queue) put(ctx context.Context, j job) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return errQueueClosed
+	}
+	select {
+	case q.jobs <- j:
+		return nil
+	default:
+	}
+	switch q.overflow {
+	case overflowDropOldest:
+		for {
+			select {
+			case q.jobs <- j:
+				return nil
+			case <-q.jobs:
+				q.t.inflight.end(q.id)
+				q.t.lg.Debug("publish queue size excedeed, oldest report dropped")
+			}
+		}
+	case overflowBlock:
+		select {
+		case q.jobs <- j:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.done:
+			return errQueueClosed
+		}
+	default:
+		q.t.lg.Debug("publish queue size excedeed")
+		return errors.New("Publish queue of subscriber " + q.id + " is full")
+	}
+}
+
+func (q *queue) work() {
+	defer q.workers.Done()
+	for {
+		select {
+		case <-q.done:
+			return
+		case j := <-q.jobs:
+			err := q.t.deliver(context.Background(), q.id, j.topic, j.report)
+			if err != nil {
+				q.t.lg.WithError(err).Debug("Failed to publish queued report")
+			}
+			q.t.inflight.end(q.id)
+		}
+	}
+}
+
+// stop stops the workers, waits for the running publishes and hands the
+// reports still queued to keep
+func (q *queue) stop(keep func(j job)) {
+	// unblock the puts waiting for space before taking the lock
+	close(q.done)
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.workers.Wait()
+	for {
+		select {
+		case j := <-q.jobs:
+			keep(j)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueuePutAfterStop(t *testing.T) {
+	q := &queue{id: "q", jobs: make(chan job, 1), done: make(chan struct{})}
+	q.stop(func(j job) {})
+	if err := q.put(context.Background(), job{}); err != errQueueClosed {
+		t.Fatalf("put after stop returned %v", err)
+	}
+}
+
+func TestQueueStopWaitsForWorkers(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://slow", Properties: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := fakeCount("slow")
+	if err := tr.SendReport(context.Background(), Subscriptor{SubscriberID: id}, "report"); err != nil {
+		t.Fatal(err)
+	}
+	// let the worker pick up the report
+	time.Sleep(5 * time.Millisecond)
+	tr.closeQueue(id, func(j job) {
+		tr.inflight.end(id)
+	})
+	if n := fakeCount("slow") - before; n != 1 {
+		t.Fatalf("closeQueue returned before the running publish, %d publishes", n)
+	}
+}
+
+func TestQueueReplacedWhileSending(t *testing.T) {
+	tr := newTestTransport(t)
+	// the reports left in a replaced queue which do not fit into the new one
+	// are moved to the resend queue
+	properties := map[string]string{queueOverflowProperty: "block", queueSizeProperty: "4", queueSize: "10000"}
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://ok", Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := fakeCount("ok")
+	var wg sync.WaitGroup
+	var sent int64
+	var mu sync.Mutex
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if tr.SendReport(context.Background(), Subscriptor{SubscriberID: id}, "report") == nil {
+					mu.Lock()
+					sent++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := tr.config.set(Subscriber{ID: id, Enable: true, URI: "fake://ok", Properties: properties}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	// every accepted report is published or persisted, none keeps the
+	// shutdown waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if delivered := fakeCount("ok") - before; delivered != sent {
+		t.Fatalf("%d reports accepted, %d published", sent, delivered)
+	}
+}
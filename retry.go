@@ -0,0 +1,230 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	loglib "github.com/menucha-de/logging"
+)
+
+var retryMaxAttemptsProperty string = prefix + "Retry.MaxAttempts"
+var retryInitialBackoffProperty string = prefix + "Retry.InitialBackoff"
+var retryMaxBackoffProperty string = prefix + "Retry.MaxBackoff"
+var retryJitterProperty string = prefix + "Retry.Jitter"
+var retryStatusCodesProperty string = prefix + "Retry.StatusCodes"
+var retryAfterProperty string = prefix + "Retry.RetryAfter"
+
+var defaultMaxAttempts int = 3
+var defaultInitialBackoff int = 100
+var defaultMaxBackoff int = 10000
+var defaultJitter float64 = 0.2
+var defaultRetryStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// retryPolicy retries failed publishes with an exponential backoff
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	statusCodes    map[int]bool
+	retryAfter     bool
+	metrics        *subscriberMetrics
+	lg             *loglib.Logger
+}
+
+// statusError is returned for HTTP responses which are not successful
+type statusError struct {
+	code       int
+	status     string
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return "HTTP " + strconv.Itoa(e.code) + ": " + e.status
+}
+
+// permanentError marks errors which are not retried
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func newRetryPolicy(s Subscriber) (*retryPolicy, error) {
+	p := &retryPolicy{
+		maxAttempts:    defaultMaxAttempts,
+		initialBackoff: time.Duration(defaultInitialBackoff) * time.Millisecond,
+		maxBackoff:     time.Duration(defaultMaxBackoff) * time.Millisecond,
+		jitter:         defaultJitter,
+		statusCodes:    make(map[int]bool),
+		retryAfter:     true,
+		metrics:        s.metrics(),
+		lg:             s.logger(),
+	}
+	for _, code := range defaultRetryStatusCodes {
+		p.statusCodes[code] = true
+	}
+	for key, property := range s.Properties {
+		switch key {
+		case retryMaxAttemptsProperty:
+			attempts, err := strconv.Atoi(property)
+			if err != nil || attempts < 1 {
+				s.logger().Error("Invalid max attempts value '" + property + "'")
+				return nil, errors.New("Invalid max attempts value '" + property + "'")
+			}
+			p.maxAttempts = attempts
+		case retryInitialBackoffProperty, retryMaxBackoffProperty:
+			backoff, err := strconv.Atoi(property)
+			if err != nil || backoff < 0 {
+				s.logger().Error("Invalid backoff value '" + property + "'")
+				return nil, errors.New("Invalid backoff value '" + property + "'")
+			}
+			if key == retryInitialBackoffProperty {
+				p.initialBackoff = time.Duration(backoff) * time.Millisecond
+			} else {
+				p.maxBackoff = time.Duration(backoff) * time.Millisecond
+			}
+		case retryJitterProperty:
+			jitter, err := strconv.ParseFloat(property, 64)
+			if err != nil || jitter < 0 || jitter > 1 {
+				s.logger().Error("Invalid jitter value '" + property + "'")
+				return nil, errors.New("Invalid jitter value '" + property + "'")
+			}
+			p.jitter = jitter
+		case retryStatusCodesProperty:
+			p.statusCodes = make(map[int]bool)
+			for _, c := range strings.Split(property, ",") {
+				c = strings.TrimSpace(c)
+				if c == "" {
+					continue
+				}
+				code, err := strconv.Atoi(c)
+				if err != nil || code < 100 || code > 599 {
+					s.logger().Error("Invalid status code '" + c + "'")
+					return nil, errors.New("Invalid status code '" + c + "'")
+				}
+				p.statusCodes[code] = true
+			}
+		case retryAfterProperty:
+			b, err := strconv.ParseBool(property)
+			if err != nil {
+				s.logger().Error("Invalid " + retryAfterProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + retryAfterProperty + " '" + property + "'")
+			}
+			p.retryAfter = b
+		}
+	}
+	if p.maxBackoff < p.initialBackoff {
+		s.logger().Error("Max backoff must not be less than the initial backoff")
+		return nil, errors.New("Max backoff must not be less than the initial backoff")
+	}
+	return p, nil
+}
+
+// deliveryError is returned once a publish has been given up
+type deliveryError struct {
+	err       error
+	attempts  int
+	permanent bool
+}
+
+func (e *deliveryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deliveryError) Unwrap() error {
+	return e.err
+}
+
+// do runs attempt until it succeeds, fails permanently, the attempts are
+// exhausted or the context is done
+func (p *retryPolicy) do(ctx context.Context, attempt func(ctx context.Context) error) error {
+	backoff := p.initialBackoff
+	for i := 1; ; i++ {
+		err := attempt(ctx)
+		if err == nil {
+			return nil
+		}
+		retryable := p.retryable(err)
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			err = perm.err
+		}
+		if i >= p.maxAttempts || ctx.Err() != nil || !retryable {
+			return &deliveryError{err: err, attempts: i, permanent: !retryable}
+		}
+		delay := p.delay(backoff, err)
+		p.lg.WithError(err).Debug("Publish failed, retrying in " + delay.String())
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &deliveryError{err: err, attempts: i}
+		case <-timer.C:
+		}
+		p.metrics.retried()
+		backoff *= 2
+		if backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+}
+
+func (p *retryPolicy) retryable(err error) bool {
+	var perm *permanentError
+	if errors.As(err, &perm) {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return p.statusCodes[status.code]
+	}
+	return true
+}
+
+// delay returns the backoff reduced by a random jitter or the delay requested
+// by the server, both bounded by the max backoff
+func (p *retryPolicy) delay(backoff time.Duration, err error) time.Duration {
+	var status *statusError
+	if p.retryAfter && errors.As(err, &status) && status.retryAfter > 0 {
+		if status.retryAfter > p.maxBackoff {
+			return p.maxBackoff
+		}
+		return status.retryAfter
+	}
+	return backoff - time.Duration(p.jitter*rand.Float64()*float64(backoff))
+}
+
+// parseRetryAfter parses the Retry-After header given in seconds or as HTTP
+// date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,250 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRetryPolicy(t *testing.T, properties map[string]string) *retryPolicy {
+	p, err := newRetryPolicy(Subscriber{Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRetryPolicyProperties(t *testing.T) {
+	p := testRetryPolicy(t, nil)
+	if p.maxAttempts != 3 || p.initialBackoff != 100*time.Millisecond || p.maxBackoff != 10*time.Second || p.jitter != 0.2 || !p.retryAfter {
+		t.Fatalf("unexpected default policy %+v", p)
+	}
+	for _, code := range []int{408, 429, 500, 502, 503, 504} {
+		if !p.statusCodes[code] {
+			t.Fatalf("status code %d not retried by default", code)
+		}
+	}
+	p = testRetryPolicy(t, map[string]string{retryStatusCodesProperty: "503, 418"})
+	if !p.statusCodes[418] || !p.statusCodes[503] || p.statusCodes[500] {
+		t.Fatalf("unexpected status codes %v", p.statusCodes)
+	}
+	for _, properties := range []map[string]string{
+		{retryMaxAttemptsProperty: "0"},
+		{retryInitialBackoffProperty: "-1"},
+		{retryJitterProperty: "1.5"},
+		{retryStatusCodesProperty: "600"},
+		{retryAfterProperty: "maybe"},
+		{retryInitialBackoffProperty: "200", retryMaxBackoffProperty: "100"},
+	} {
+		if _, err := newRetryPolicy(Subscriber{Properties: properties}); err == nil {
+			t.Fatalf("invalid properties %v accepted", properties)
+		}
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	p := testRetryPolicy(t, map[string]string{retryJitterProperty: "0"})
+	if d := p.delay(time.Second, errors.New("unreachable")); d != time.Second {
+		t.Fatalf("delay without jitter is %v", d)
+	}
+	p = testRetryPolicy(t, map[string]string{retryJitterProperty: "0.5"})
+	for i := 0; i < 1000; i++ {
+		d := p.delay(time.Second, errors.New("unreachable"))
+		if d < 500*time.Millisecond || d > time.Second {
+			t.Fatalf("delay %v out of the jitter bounds", d)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := testRetryPolicy(t, map[string]string{
+		retryMaxAttemptsProperty:    "5",
+		retryInitialBackoffProperty: "20",
+		retryMaxBackoffProperty:     "50",
+		retryJitterProperty:         "0",
+	})
+	var times []time.Time
+	err := p.do(context.Background(), func(ctx context.Context) error {
+		times = append(times, time.Now())
+		return errors.New("unreachable")
+	})
+	var derr *deliveryError
+	if !errors.As(err, &derr) || derr.attempts != 5 || derr.permanent {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// the backoff doubles until it is capped by the max backoff
+	want := []time.Duration{20, 40, 50, 50}
+	for i, w := range want {
+		gap := times[i+1].Sub(times[i])
+		if gap < w*time.Millisecond || gap > w*time.Millisecond+40*time.Millisecond {
+			t.Fatalf("backoff %d is %v, want %v", i+1, gap, w*time.Millisecond)
+		}
+	}
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	p := testRetryPolicy(t, map[string]string{retryInitialBackoffProperty: "1"})
+	for _, fail := range []error{
+		&permanentError{errors.New("invalid request")},
+		&statusError{code: 400, status: "400 Bad Request"},
+	} {
+		n := 0
+		err := p.do(context.Background(), func(ctx context.Context) error {
+			n++
+			return fail
+		})
+		var derr *deliveryError
+		if !errors.As(err, &derr) || !derr.permanent || derr.attempts != 1 || n != 1 {
+			t.Fatalf("%v retried %d times, returned %v", fail, n, err)
+		}
+	}
+}
+
+func TestRetryContextDone(t *testing.T) {
+	p := testRetryPolicy(t, map[string]string{retryInitialBackoffProperty: "1000", retryMaxAttemptsProperty: "10"})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := p.do(ctx, func(ctx context.Context) error {
+		return errors.New("unreachable")
+	})
+	var derr *deliveryError
+	if !errors.As(err, &derr) || derr.attempts != 1 || derr.permanent {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("retry did not stop when the context was done")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter(""); d != 0 {
+		t.Fatalf("empty Retry-After parsed as %v", d)
+	}
+	if d := parseRetryAfter("2"); d != 2*time.Second {
+		t.Fatalf("Retry-After in seconds parsed as %v", d)
+	}
+	if d := parseRetryAfter("-2"); d != 0 {
+		t.Fatalf("negative Retry-After parsed as %v", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Fatalf("invalid Retry-After parsed as %v", d)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d <= 58*time.Second || d > time.Minute {
+		t.Fatalf("Retry-After date parsed as %v", d)
+	}
+	date = time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d != 0 {
+		t.Fatalf("past Retry-After date parsed as %v", d)
+	}
+}
+
+func TestRetryDelayRetryAfter(t *testing.T) {
+	p := testRetryPolicy(t, map[string]string{retryInitialBackoffProperty: "10", retryMaxBackoffProperty: "1000", retryJitterProperty: "0"})
+	if d := p.delay(10*time.Millisecond, &statusError{code: 503, retryAfter: 500 * time.Millisecond}); d != 500*time.Millisecond {
+		t.Fatalf("Retry-After not honoured, delay is %v", d)
+	}
+	if d := p.delay(10*time.Millisecond, &statusError{code: 503, retryAfter: time.Minute}); d != time.Second {
+		t.Fatalf("Retry-After not capped by the max backoff, delay is %v", d)
+	}
+	p = testRetryPolicy(t, map[string]string{retryInitialBackoffProperty: "10", retryJitterProperty: "0", retryAfterProperty: "false"})
+	if d := p.delay(10*time.Millisecond, &statusError{code: 503, retryAfter: 500 * time.Millisecond}); d != 10*time.Millisecond {
+		t.Fatalf("disabled Retry-After honoured, delay is %v", d)
+	}
+}
+
+// retryServer answers the first failures requests with the status and
+// Retry-After header, then with 200
+func retryServer(t *testing.T, failures int32, status int, retryAfter string) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func testHTTPProvider(t *testing.T, uri string, properties map[string]string) *httpclient {
+	p, err := newHTTPProvider(Subscriber{URI: uri, Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHTTPPublishRetries(t *testing.T) {
+	srv, requests := retryServer(t, 2, http.StatusServiceUnavailable, "")
+	p := testHTTPProvider(t, srv.URL, map[string]string{retryInitialBackoffProperty: "1"})
+	if err := p.Publish(context.Background(), "a", "report"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Fatalf("%d requests, want 3", n)
+	}
+}
+
+func TestHTTPPublishAttemptsExhausted(t *testing.T) {
+	srv, requests := retryServer(t, 10, http.StatusInternalServerError, "")
+	p := testHTTPProvider(t, srv.URL, map[string]string{retryInitialBackoffProperty: "1", retryMaxAttemptsProperty: "4"})
+	err := p.Publish(context.Background(), "a", "report")
+	var derr *deliveryError
+	if !errors.As(err, &derr) || derr.attempts != 4 || derr.permanent {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 4 {
+		t.Fatalf("%d requests, want 4", n)
+	}
+}
+
+func TestHTTPPublishNotRetryableStatus(t *testing.T) {
+	srv, requests := retryServer(t, 10, http.StatusBadRequest, "")
+	p := testHTTPProvider(t, srv.URL, map[string]string{retryInitialBackoffProperty: "1"})
+	err := p.Publish(context.Background(), "a", "report")
+	if !permanentFailure(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("%d requests, want 1", n)
+	}
+}
+
+func TestHTTPPublishRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		properties map[string]string
+		min, max   time.Duration
+	}{
+		// Retry-After of a second is capped by the max backoff of 200ms
+		{"honoured", map[string]string{retryInitialBackoffProperty: "1", retryMaxBackoffProperty: "200"}, 200 * time.Millisecond, 900 * time.Millisecond},
+		{"disabled", map[string]string{retryInitialBackoffProperty: "1", retryMaxBackoffProperty: "200", retryAfterProperty: "false"}, 0, 150 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, requests := retryServer(t, 1, http.StatusTooManyRequests, strconv.Itoa(1))
+			p := testHTTPProvider(t, srv.URL, tc.properties)
+			start := time.Now()
+			if err := p.Publish(context.Background(), "a", "report"); err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+			if elapsed < tc.min || elapsed > tc.max {
+				t.Fatalf("retried after %v, want between %v and %v", elapsed, tc.min, tc.max)
+			}
+			if n := atomic.LoadInt32(requests); n != 2 {
+				t.Fatalf("%d requests, want 2", n)
+			}
+		})
+	}
+}
@@ -1,84 +1,245 @@
 package transport
 
 import (
+	"net/http"
 	"strings"
 
 	"github.com/menucha-de/utils"
 )
 
-//TransportRoutes Transport Library Routes
-var TransportRoutes = []utils.Route{
+//TransportRoutes Transport Library Routes of the default transport service
+var TransportRoutes = newRoutes(Default)
 
-	utils.Route{
-		Name:        "GetSubscribers",
-		Method:      strings.ToUpper("Get"),
-		Pattern:     "/rest/subscribers",
-		HandlerFunc: getSubscribers,
-	},
-	utils.Route{
-		Name:        "SetPassphrase",
-		Method:      strings.ToUpper("Post"),
-		Pattern:     "/rest/subscribers/certs/passphrase",
-		HandlerFunc: setPassphrase,
-	},
-	utils.Route{
-		Name:        "HasTrusted",
-		Method:      strings.ToUpper("Get"),
-		Pattern:     "/rest/subscribers/{id}/certs/trust",
-		HandlerFunc: hasTrusted,
-	},
-	utils.Route{
-		Name:        "DeleteTrusted",
-		Method:      strings.ToUpper("Delete"),
-		Pattern:     "/rest/subscribers/{id}/certs/trust",
-		HandlerFunc: deleteTrusted,
-	},
-	utils.Route{
-		Name:        "SetTrusted",
-		Method:      strings.ToUpper("Post"),
-		Pattern:     "/rest/subscribers/{id}/certs/trust",
-		HandlerFunc: setTrusted,
-	},
-	utils.Route{
-		Name:        "HasKeyStore",
-		Method:      strings.ToUpper("Get"),
-		Pattern:     "/rest/subscribers/{id}/certs/keystore",
-		HandlerFunc: hasKeyStore,
-	},
-	utils.Route{
-		Name:        "DeleteKeyStore",
-		Method:      strings.ToUpper("Delete"),
-		Pattern:     "/rest/subscribers/{id}/certs/keystore",
-		HandlerFunc: deleteKeyStore,
-	},
-	utils.Route{
-		Name:        "setKeyStore",
-		Method:      strings.ToUpper("Post"),
-		Pattern:     "/rest/subscribers/{id}/certs/keystore",
-		HandlerFunc: setKeyStore,
-	},
-	utils.Route{
-		Name:        "AddSubscriber",
-		Method:      strings.ToUpper("Post"),
-		Pattern:     "/rest/subscribers",
-		HandlerFunc: addSubscriber,
-	},
-	utils.Route{
-		Name:        "GetSubscriber",
-		Method:      strings.ToUpper("Get"),
-		Pattern:     "/rest/subscribers/{id}",
-		HandlerFunc: getSubscriber,
-	},
-	utils.Route{
-		Name:        "setSubscriber",
-		Method:      strings.ToUpper("Put"),
-		Pattern:     "/rest/subscribers/{id}",
-		HandlerFunc: setSubscriber,
-	},
-	utils.Route{
-		Name:        "deleteSubscriber",
-		Method:      strings.ToUpper("Delete"),
-		Pattern:     "/rest/subscribers/{id}",
-		HandlerFunc: deleteSubscriber,
-	},
+func newRoutes(t func() *Transport) []utils.Route {
+	return []utils.Route{
+		utils.Route{
+			Name:        "GetSubscribers",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers",
+			HandlerFunc: bind(t, (*Transport).getSubscribers),
+		},
+		utils.Route{
+			Name:        "SetPassphrase",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscribers/certs/passphrase",
+			HandlerFunc: bind(t, (*Transport).setPassphrase),
+		},
+		utils.Route{
+			Name:        "HasTrusted",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/{id}/certs/trust",
+			HandlerFunc: bind(t, (*Transport).hasTrusted),
+		},
+		utils.Route{
+			Name:        "DeleteTrusted",
+			Method:      strings.ToUpper("Delete"),
+			Pattern:     "/rest/subscribers/{id}/certs/trust",
+			HandlerFunc: bind(t, (*Transport).deleteTrusted),
+		},
+		utils.Route{
+			Name:        "SetTrusted",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscribers/{id}/certs/trust",
+			HandlerFunc: bind(t, (*Transport).setTrusted),
+		},
+		utils.Route{
+			Name:        "HasKeyStore",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/{id}/certs/keystore",
+			HandlerFunc: bind(t, (*Transport).hasKeyStore),
+		},
+		utils.Route{
+			Name:        "DeleteKeyStore",
+			Method:      strings.ToUpper("Delete"),
+			Pattern:     "/rest/subscribers/{id}/certs/keystore",
+			HandlerFunc: bind(t, (*Transport).deleteKeyStore),
+		},
+		utils.Route{
+			Name:        "setKeyStore",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscribers/{id}/certs/keystore",
+			HandlerFunc: bind(t, (*Transport).setKeyStore),
+		},
+		utils.Route{
+			Name:        "HasCredentials",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/{id}/certs/credentials",
+			HandlerFunc: bind(t, (*Transport).hasCredentials),
+		},
+		utils.Route{
+			Name:        "DeleteCredentials",
+			Method:      strings.ToUpper("Delete"),
+			Pattern:     "/rest/subscribers/{id}/certs/credentials",
+			HandlerFunc: bind(t, (*Transport).deleteCredentials),
+		},
+		utils.Route{
+			Name:        "SetCredentials",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscribers/{id}/certs/credentials",
+			HandlerFunc: bind(t, (*Transport).setCredentials),
+		},
+		utils.Route{
+			Name:        "AddSubscriber",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscribers",
+			HandlerFunc: bind(t, (*Transport).addSubscriber),
+		},
+		utils.Route{
+			Name:        "TestSubscriber",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscribers/test",
+			HandlerFunc: bind(t, (*Transport).testSubscriberDefinition),
+		},
+		utils.Route{
+			Name:        "TestStoredSubscriber",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscribers/{id}/test",
+			HandlerFunc: bind(t, (*Transport).testStoredSubscriber),
+		},
+		utils.Route{
+			Name:        "GetMetrics",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/metrics",
+			HandlerFunc: bind(t, (*Transport).getMetrics),
+		},
+		utils.Route{
+			Name:        "GetSubscriberStatuses",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/status",
+			HandlerFunc: bind(t, (*Transport).getSubscriberStatuses),
+		},
+		utils.Route{
+			Name:        "GetSubscriberStatus",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/{id}/status",
+			HandlerFunc: bind(t, (*Transport).getSubscriberStatus),
+		},
+		utils.Route{
+			Name:        "GetCircuits",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/circuits",
+			HandlerFunc: bind(t, (*Transport).getCircuits),
+		},
+		utils.Route{
+			Name:        "GetCircuit",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/{id}/circuit",
+			HandlerFunc: bind(t, (*Transport).getCircuit),
+		},
+		utils.Route{
+			Name:        "ResetCircuit",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscribers/{id}/circuit/reset",
+			HandlerFunc: bind(t, (*Transport).resetCircuitBreaker),
+		},
+		utils.Route{
+			Name:        "GetSubscriber",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/{id}",
+			HandlerFunc: bind(t, (*Transport).getSubscriber),
+		},
+		utils.Route{
+			Name:        "setSubscriber",
+			Method:      strings.ToUpper("Put"),
+			Pattern:     "/rest/subscribers/{id}",
+			HandlerFunc: bind(t, (*Transport).setSubscriber),
+		},
+		utils.Route{
+			Name:        "deleteSubscriber",
+			Method:      strings.ToUpper("Delete"),
+			Pattern:     "/rest/subscribers/{id}",
+			HandlerFunc: bind(t, (*Transport).deleteSubscriber),
+		},
+		utils.Route{
+			Name:        "GetDeadLetters",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/{id}/deadletters",
+			HandlerFunc: bind(t, (*Transport).getDeadLetters),
+		},
+		utils.Route{
+			Name:        "PurgeDeadLetters",
+			Method:      strings.ToUpper("Delete"),
+			Pattern:     "/rest/subscribers/{id}/deadletters",
+			HandlerFunc: bind(t, (*Transport).purgeDeadLetterList),
+		},
+		utils.Route{
+			Name:        "GetDeadLetter",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscribers/{id}/deadletters/{letterId}",
+			HandlerFunc: bind(t, (*Transport).getDeadLetterEntry),
+		},
+		utils.Route{
+			Name:        "DeleteDeadLetter",
+			Method:      strings.ToUpper("Delete"),
+			Pattern:     "/rest/subscribers/{id}/deadletters/{letterId}",
+			HandlerFunc: bind(t, (*Transport).deleteDeadLetterEntry),
+		},
+		utils.Route{
+			Name:        "ReplayDeadLetter",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscribers/{id}/deadletters/{letterId}/replay",
+			HandlerFunc: bind(t, (*Transport).replayDeadLetterEntry),
+		},
+		utils.Route{
+			Name:        "GetSubscriptors",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscriptors",
+			HandlerFunc: bind(t, (*Transport).getSubscriptors),
+		},
+		utils.Route{
+			Name:        "AddSubscriptor",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscriptors",
+			HandlerFunc: bind(t, (*Transport).addSubscriptor),
+		},
+		utils.Route{
+			Name:        "GetSubscriptor",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/subscriptors/{id}",
+			HandlerFunc: bind(t, (*Transport).getSubscriptor),
+		},
+		utils.Route{
+			Name:        "setSubscriptor",
+			Method:      strings.ToUpper("Put"),
+			Pattern:     "/rest/subscriptors/{id}",
+			HandlerFunc: bind(t, (*Transport).setSubscriptor),
+		},
+		utils.Route{
+			Name:        "deleteSubscriptor",
+			Method:      strings.ToUpper("Delete"),
+			Pattern:     "/rest/subscriptors/{id}",
+			HandlerFunc: bind(t, (*Transport).deleteSubscriptor),
+		},
+		utils.Route{
+			Name:        "EnableSubscriptor",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscriptors/{id}/enable",
+			HandlerFunc: bind(t, (*Transport).enableSubscriptor),
+		},
+		utils.Route{
+			Name:        "DisableSubscriptor",
+			Method:      strings.ToUpper("Post"),
+			Pattern:     "/rest/subscriptors/{id}/disable",
+			HandlerFunc: bind(t, (*Transport).disableSubscriptor),
+		},
+		utils.Route{
+			Name:        "GetStreamEvents",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/streams/{name}/events",
+			HandlerFunc: bind(t, (*Transport).getStreamEvents),
+		},
+		utils.Route{
+			Name:        "GetStreamWebSocket",
+			Method:      strings.ToUpper("Get"),
+			Pattern:     "/rest/streams/{name}/ws",
+			HandlerFunc: bind(t, (*Transport).getStreamWebSocket),
+		},
+	}
+}
+
+// bind resolves the transport service on every request
+func bind(t func() *Transport, h func(*Transport, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(t(), w, r)
+	}
 }
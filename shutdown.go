@@ -0,0 +1,164 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrShutdown is returned by SendReport once the service is shutting down
+var ErrShutdown = errors.New("Transport is shutting down")
+
+//ShutdownError lists the subscribers which could not be drained before the
+//shutdown context expired
+type ShutdownError struct {
+	Subscribers []string
+}
+
+func (e *ShutdownError) Error() string {
+	return "Subscribers " + strings.Join(e.Subscribers, ", ") + " could not be drained"
+}
+
+//Drainer is implemented by providers which complete deliveries in the
+//background. Drain waits until these deliveries are completed.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+var flushInterval = 100 * time.Millisecond
+
+// inflight counts the running publishes per subscriber
+type inflight struct {
+	mu      sync.Mutex
+	closing bool
+	pending map[string]int
+	idle    chan struct{}
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		pending: make(map[string]int),
+		idle:    make(chan struct{}),
+	}
+}
+
+// begin registers a publish, it fails once the service is shutting down
+func (f *inflight) begin(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closing {
+		return false
+	}
+	f.pending[id]++
+	return true
+}
+
+func (f *inflight) end(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending[id]--
+	if f.pending[id] <= 0 {
+		delete(f.pending, id)
+	}
+	close(f.idle)
+	f.idle = make(chan struct{})
+}
+
+// wait stops accepting publishes and waits for the running ones. It returns
+// the subscribers with publishes still running when the context is done.
+func (f *inflight) wait(ctx context.Context) []string {
+	f.mu.Lock()
+	f.closing = true
+	for len(f.pending) > 0 {
+		idle := f.idle
+		f.mu.Unlock()
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			f.mu.Lock()
+			ids := make([]string, 0, len(f.pending))
+			for id := range f.pending {
+				ids = append(ids, id)
+			}
+			f.mu.Unlock()
+			return ids
+		}
+		f.mu.Lock()
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+//Shutdown gracefully shuts down the default transport service
+func Shutdown(ctx context.Context) error {
+	return Default().Shutdown(ctx)
+}
+
+//Shutdown stops accepting reports, waits for running publishes, flushes the
+//resend queues and closes the service. Subscribers which could not be
+//drained before the context is done are reported by a ShutdownError, their
+//queued reports are kept for the next start.
+func (t *Transport) Shutdown(ctx context.Context) error {
+	failed := make(map[string]bool)
+	for _, id := range t.inflight.wait(ctx) {
+		failed[id] = true
+	}
+
+	t.outboxesMu.Lock()
+	outboxes := make([]*outbox, 0, len(t.outboxes))
+	for _, o := range t.outboxes {
+		outboxes = append(outboxes, o)
+	}
+	t.outboxesMu.Unlock()
+	for _, o := range outboxes {
+		if !o.flush(ctx) {
+			failed[o.id] = true
+		}
+	}
+
+	t.config.mu.RLock()
+	drainers := make(map[string]Drainer)
+	for id, v := range t.config.Subscribers {
+		if d, ok := v.Provider.(Drainer); ok {
+			drainers[id] = d
+		}
+	}
+	t.config.mu.RUnlock()
+	for id, d := range drainers {
+		if err := d.Drain(ctx); err != nil {
+			t.lg.WithError(err).Warning("Failed to drain subscriber " + id)
+			failed[id] = true
+		}
+	}
+
+	t.Close()
+	if len(failed) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(failed))
+	for id := range failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return &ShutdownError{Subscribers: ids}
+}
+
+// flush waits until the queued reports have been replayed
+func (o *outbox) flush(ctx context.Context) bool {
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	for o.pending() {
+		o.notify()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-o.done:
+			return !o.pending()
+		case <-t.C:
+		}
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Subscriber connection states
+const (
+	StatusDisabled     = "disabled"
+	StatusIdle         = "idle"
+	StatusConnecting   = "connecting"
+	StatusConnected    = "connected"
+	StatusDisconnected = "disconnected"
+	StatusFailed       = "failed"
+)
+
+//SubscriberStatus health of a subscriber
+type SubscriberStatus struct {
+	SubscriberID      string     `json:"subscriberId"`
+	State             string     `json:"state"`
+	Circuit           string     `json:"circuit,omitempty"`
+	LastSuccess       *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure       *time.Time `json:"lastFailure,omitempty"`
+	LastError         string     `json:"lastError,omitempty"`
+	Queued            int        `json:"queued"`
+	ReconnectAttempts int        `json:"reconnectAttempts"`
+}
+
+// statusTracker records the connection state and publish results of a
+// subscriber. The providers report their connection events, the publish
+// results are recorded by the breaker wrapping every provider. A nil tracker
+// ignores all events.
+type statusTracker struct {
+	mu          sync.Mutex
+	state       string
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+	reconnects  int
+}
+
+// status returns the status tracker of the subscriber
+func (s Subscriber) status() *statusTracker {
+	if s.t == nil {
+		return nil
+	}
+	return s.t.tracker(s.ID)
+}
+
+func (t *Transport) tracker(id string) *statusTracker {
+	t.statusesMu.Lock()
+	defer t.statusesMu.Unlock()
+	st, ok := t.statuses[id]
+	if !ok {
+		st = &statusTracker{state: StatusIdle}
+		t.statuses[id] = st
+	}
+	return st
+}
+
+func (t *Transport) removeTracker(id string) {
+	t.statusesMu.Lock()
+	defer t.statusesMu.Unlock()
+	delete(t.statuses, id)
+}
+
+func (st *statusTracker) setState(state string) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.state = state
+}
+
+// connected records an established connection
+func (st *statusTracker) connected() {
+	st.setState(StatusConnected)
+}
+
+// disconnected records a lost or failed connection
+func (st *statusTracker) disconnected(err error) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.state = StatusDisconnected
+	if err != nil {
+		st.lastError = err.Error()
+	}
+}
+
+// reconnecting records a reconnect attempt
+func (st *statusTracker) reconnecting() {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.state = StatusConnecting
+	st.reconnects++
+}
+
+// failed records that the provider could not be created
+func (st *statusTracker) failed(err error) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.state = StatusFailed
+	st.lastFailure = time.Now()
+	st.lastError = err.Error()
+}
+
+// published records the result of a publish
+func (st *statusTracker) published(err error) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err == nil {
+		st.lastSuccess = time.Now()
+		return
+	}
+	if inFlight(err) {
+		return
+	}
+	st.lastFailure = time.Now()
+	st.lastError = err.Error()
+}
+
+func (st *statusTracker) snapshot(s *SubscriberStatus) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s.State = st.state
+	s.LastError = st.lastError
+	s.ReconnectAttempts = st.reconnects
+	if !st.lastSuccess.IsZero() {
+		lastSuccess := st.lastSuccess.UTC()
+		s.LastSuccess = &lastSuccess
+	}
+	if !st.lastFailure.IsZero() {
+		lastFailure := st.lastFailure.UTC()
+		s.LastFailure = &lastFailure
+	}
+}
+
+// subscriberStatus returns the status of the subscriber, t.config.mu has to
+// be held
+func (t *Transport) subscriberStatus(s *Subscriber) SubscriberStatus {
+	status := SubscriberStatus{SubscriberID: s.ID}
+	t.tracker(s.ID).snapshot(&status)
+	if !s.Enable {
+		status.State = StatusDisabled
+	}
+	if b, ok := s.Provider.(*breaker); ok && b.threshold > 0 {
+		status.Circuit = b.circuitState(s.ID).State
+	}
+	if q := t.getQueue(s.ID); q != nil {
+		status.Queued += len(q.jobs)
+	}
+	if o := t.getOutbox(s.ID); o != nil {
+		status.Queued += o.count()
+	}
+	return status
+}
+
+// subscriberStatuses returns the status of all subscribers
+func (t *Transport) subscriberStatuses() []SubscriberStatus {
+	t.config.mu.RLock()
+	defer t.config.mu.RUnlock()
+	result := []SubscriberStatus{}
+	for _, s := range t.config.Subscribers {
+		result = append(result, t.subscriberStatus(s))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].SubscriberID < result[j].SubscriberID
+	})
+	return result
+}
+
+// status returns the status of the subscriber
+func (t *Transport) status(id string) (SubscriberStatus, error) {
+	t.config.mu.RLock()
+	defer t.config.mu.RUnlock()
+	s, ok := t.config.Subscribers[id]
+	if !ok {
+		return SubscriberStatus{}, errors.New("Subscriber with ID " + id + " does not exist")
+	}
+	return t.subscriberStatus(s), nil
+}
@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type overflowPolicy int
+
+const (
+	overflowDropNewest overflowPolicy = iota
+	overflowDropOldest
+	overflowBlock
+)
+
+func parseOverflowPolicy(value string) (overflowPolicy, error) {
+	switch value {
+	case "drop-newest":
+		return overflowDropNewest, nil
+	case "drop-oldest":
+		return overflowDropOldest, nil
+	case "block":
+		return overflowBlock, nil
+	default:
+		return overflowDropNewest, errors.New("Invalid overflow value '" + value + "'")
+	}
+}
+
+// storeLimit keeps the insertion order of the keys of a store and applies
+// the overflow policy once the size of the store is reached. It is guarded
+// by the lock of the store.
+type storeLimit struct {
+	size     int
+	overflow overflowPolicy
+	timeout  time.Duration
+	keys     []string
+	freed    chan struct{}
+}
+
+func newStoreLimit(size int, overflow overflowPolicy, timeout time.Duration) *storeLimit {
+	return &storeLimit{
+		size:     size,
+		overflow: overflow,
+		timeout:  timeout,
+		freed:    make(chan struct{}),
+	}
+}
+
+// reserve makes room for the key. The store lock mu is released while
+// waiting for room with the block policy. It returns the key which has to
+// be evicted, if any, and false if the new packet has to be dropped.
+func (l *storeLimit) reserve(mu sync.Locker, key string) (string, bool) {
+	for _, k := range l.keys {
+		if k == key {
+			return "", true
+		}
+	}
+	if len(l.keys) < l.size {
+		l.keys = append(l.keys, key)
+		return "", true
+	}
+	switch l.overflow {
+	case overflowDropOldest:
+		evict := l.keys[0]
+		l.keys = append(l.keys[1:], key)
+		return evict, true
+	case overflowBlock:
+		deadline := time.NewTimer(l.timeout)
+		defer deadline.Stop()
+		for len(l.keys) >= l.size {
+			freed := l.freed
+			mu.Unlock()
+			select {
+			case <-freed:
+				mu.Lock()
+			case <-deadline.C:
+				mu.Lock()
+				return "", false
+			}
+		}
+		l.keys = append(l.keys, key)
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+func (l *storeLimit) remove(key string) {
+	for i, k := range l.keys {
+		if k == key {
+			l.keys = append(l.keys[:i], l.keys[i+1:]...)
+			l.signal()
+			return
+		}
+	}
+}
+
+func (l *storeLimit) reset() {
+	l.keys = nil
+	l.signal()
+}
+
+func (l *storeLimit) signal() {
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+func (l *storeLimit) all() []string {
+	keys := make([]string, len(l.keys))
+	copy(keys, l.keys)
+	return keys
+}
@@ -0,0 +1,225 @@
+package transport
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+var _ mqtt.Store = (*FileStore)(nil)
+var _ mqtt.Store = (*MemoryStore)(nil)
+
+func testPacket(id uint16) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Qos = 1
+	p.MessageID = id
+	p.TopicName = "reports/" + strconv.Itoa(int(id))
+	p.Payload = []byte("report " + strconv.Itoa(int(id)))
+	return p
+}
+
+func testKey(id uint16) string {
+	return "o." + strconv.Itoa(int(id))
+}
+
+// storeFactories create the stores under test, every call of a factory of a
+// test returns a store backed by the same data where the store persists it
+func storeFactories(t *testing.T) map[string]func(size int, overflow overflowPolicy, timeout time.Duration) mqtt.Store {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return map[string]func(int, overflowPolicy, time.Duration) mqtt.Store{
+		"file": func(size int, overflow overflowPolicy, timeout time.Duration) mqtt.Store {
+			return newFileStore(dir, size, overflow, timeout, lg)
+		},
+		"memory": func(size int, overflow overflowPolicy, timeout time.Duration) mqtt.Store {
+			return newMemoryStore(size, overflow, timeout, lg)
+		},
+	}
+}
+
+func TestStoreContract(t *testing.T) {
+	for name, factory := range storeFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			store := factory(10, overflowDropNewest, 0)
+			store.Open()
+			defer store.Close()
+			store.Reset()
+
+			for id := uint16(1); id <= 3; id++ {
+				store.Put(testKey(id), testPacket(id))
+			}
+			if keys := store.All(); !reflect.DeepEqual(keys, []string{"o.1", "o.2", "o.3"}) {
+				t.Fatalf("All returned %v", keys)
+			}
+			got, ok := store.Get("o.2").(*packets.PublishPacket)
+			if !ok {
+				t.Fatal("stored packet not returned")
+			}
+			want := testPacket(2)
+			if got.MessageID != want.MessageID || got.TopicName != want.TopicName || string(got.Payload) != string(want.Payload) || got.Qos != want.Qos {
+				t.Fatalf("Get returned %v", got)
+			}
+
+			// putting a key again replaces the packet and keeps its position
+			store.Put("o.1", testPacket(4))
+			if keys := store.All(); !reflect.DeepEqual(keys, []string{"o.1", "o.2", "o.3"}) {
+				t.Fatalf("All returned %v after replacing a packet", keys)
+			}
+
+			store.Del("o.2")
+			if store.Get("o.2") != nil {
+				t.Fatal("deleted packet returned")
+			}
+			if keys := store.All(); !reflect.DeepEqual(keys, []string{"o.1", "o.3"}) {
+				t.Fatalf("All returned %v after Del", keys)
+			}
+			// deleting a missing key is ignored
+			store.Del("o.2")
+
+			store.Reset()
+			if keys := store.All(); len(keys) != 0 {
+				t.Fatalf("All returned %v after Reset", keys)
+			}
+			if store.Get("o.1") != nil {
+				t.Fatal("packet returned after Reset")
+			}
+		})
+	}
+}
+
+func TestStoreClosed(t *testing.T) {
+	for name, factory := range storeFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			store := factory(10, overflowDropNewest, 0)
+			store.Put("o.1", testPacket(1))
+			if store.Get("o.1") != nil || store.All() != nil {
+				t.Fatal("store used before Open")
+			}
+			store.Open()
+			store.Put("o.1", testPacket(1))
+			store.Close()
+			store.Put("o.2", testPacket(2))
+			store.Del("o.1")
+			if store.Get("o.1") != nil || store.All() != nil {
+				t.Fatal("store used after Close")
+			}
+			store.Open()
+			defer store.Close()
+			if name == "file" && store.Get("o.1") == nil {
+				t.Fatal("packet deleted after Close")
+			}
+			if store.Get("o.2") != nil {
+				t.Fatal("packet stored after Close")
+			}
+		})
+	}
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	factory := storeFactories(t)["file"]
+	store := factory(10, overflowDropNewest, 0)
+	store.Open()
+	for id := uint16(1); id <= 3; id++ {
+		store.Put(testKey(id), testPacket(id))
+	}
+	store.Del("o.2")
+	store.Close()
+
+	store = factory(10, overflowDropNewest, 0)
+	store.Open()
+	defer store.Close()
+	if keys := store.All(); !reflect.DeepEqual(keys, []string{"o.1", "o.3"}) {
+		t.Fatalf("All returned %v after restart", keys)
+	}
+	got, ok := store.Get("o.3").(*packets.PublishPacket)
+	if !ok || string(got.Payload) != "report 3" {
+		t.Fatalf("Get returned %v after restart", got)
+	}
+}
+
+func TestStoreOverflow(t *testing.T) {
+	for name, factory := range storeFactories(t) {
+		t.Run(name+"/drop-newest", func(t *testing.T) {
+			store := factory(2, overflowDropNewest, 0)
+			store.Open()
+			defer store.Close()
+			store.Reset()
+			for id := uint16(1); id <= 3; id++ {
+				store.Put(testKey(id), testPacket(id))
+			}
+			if keys := store.All(); !reflect.DeepEqual(keys, []string{"o.1", "o.2"}) {
+				t.Fatalf("All returned %v", keys)
+			}
+			if store.Get("o.3") != nil {
+				t.Fatal("newest packet not dropped")
+			}
+		})
+		t.Run(name+"/drop-oldest", func(t *testing.T) {
+			store := factory(2, overflowDropOldest, 0)
+			store.Open()
+			defer store.Close()
+			store.Reset()
+			for id := uint16(1); id <= 3; id++ {
+				store.Put(testKey(id), testPacket(id))
+			}
+			if keys := store.All(); !reflect.DeepEqual(keys, []string{"o.2", "o.3"}) {
+				t.Fatalf("All returned %v", keys)
+			}
+			if store.Get("o.1") != nil {
+				t.Fatal("oldest packet not dropped")
+			}
+		})
+		t.Run(name+"/block", func(t *testing.T) {
+			store := factory(1, overflowBlock, time.Second)
+			store.Open()
+			defer store.Close()
+			store.Reset()
+			store.Put("o.1", testPacket(1))
+			put := make(chan struct{})
+			go func() {
+				store.Put("o.2", testPacket(2))
+				close(put)
+			}()
+			select {
+			case <-put:
+				t.Fatal("Put did not block on a full store")
+			case <-time.After(50 * time.Millisecond):
+			}
+			store.Del("o.1")
+			select {
+			case <-put:
+			case <-time.After(time.Second):
+				t.Fatal("Put still blocked after Del")
+			}
+			if keys := store.All(); !reflect.DeepEqual(keys, []string{"o.2"}) {
+				t.Fatalf("All returned %v", keys)
+			}
+		})
+		t.Run(name+"/block-timeout", func(t *testing.T) {
+			store := factory(1, overflowBlock, 20*time.Millisecond)
+			store.Open()
+			defer store.Close()
+			store.Reset()
+			store.Put("o.1", testPacket(1))
+			start := time.Now()
+			store.Put("o.2", testPacket(2))
+			if time.Since(start) < 20*time.Millisecond {
+				t.Fatal("Put did not wait for room")
+			}
+			if keys := store.All(); !reflect.DeepEqual(keys, []string{"o.1"}) {
+				t.Fatalf("All returned %v", keys)
+			}
+		})
+	}
+}
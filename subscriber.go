@@ -1,17 +1,29 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"net/url"
+
+	loglib "github.com/menucha-de/logging"
 )
 
 //Provider provider interface
 type Provider interface {
-	Publish(topic string, m interface{})
+	Publish(ctx context.Context, topic string, m interface{}) error
 	Shutdown()
 	SetTLS(id string) error
 }
 
+//ErrPublishInFlight is returned by Publish if the report has been handed
+//over but its delivery was not confirmed in time. The provider still
+//delivers the report, so it must not be published again.
+var ErrPublishInFlight = errors.New("Publish timed out, the report is still in flight")
+
+func inFlight(err error) bool {
+	return errors.Is(err, ErrPublishInFlight)
+}
+
 //Subscriber subscriber structure
 type Subscriber struct {
 	ID         string            `json:"id,omitempty"`
@@ -19,70 +31,100 @@ type Subscriber struct {
 	URI        string            `json:"uri,omitempty"`
 	Properties map[string]string `json:"properties"`
 	Provider   Provider          `json:"-"`
+	t          *Transport
+	// probe subscriber of a test, see probeSubscriber
+	probe bool
 }
 
 func (s *Subscriber) newProvider() (bool, error) {
 	u, err := url.Parse(s.URI)
 	if err != nil {
-		lg.Error(err.Error())
+		s.logger().Error(err.Error())
+		return false, err
+	}
+	factory, ok := lookupProvider(u.Scheme)
+	if !ok {
+		s.logger().Error("Unsuported scheme " + u.Scheme)
+		return false, errors.New("Unsuported scheme " + u.Scheme)
+	}
+	b, err := newBreaker(nil, *s)
+	if err != nil {
 		return false, err
 	}
-	switch u.Scheme {
-	case "mqtts":
-		p, err := newMqttProvider(*s)
-		s.Provider = p
-		if err != nil {
-			lg.Error(err.Error())
-			return false, err
-		}
-		return true, nil
-	case "mqtt":
-		p, err := newMqttProvider(*s)
-		s.Provider = p
-		if err != nil {
-			lg.Error(err.Error())
-			return false, err
-		}
-		return false, nil
-	case "https":
-		p, err := newHTTPProvider(*s)
-		if err != nil {
-			lg.Error(err.Error())
-			return false, err
-		}
-		s.Provider = p
-		return true, nil
-	case "http":
-		p, err := newHTTPProvider(*s)
-		if err != nil {
-			lg.Error(err.Error())
-			return false, err
-		}
-		s.Provider = p
-		return false, nil
-	case "udp":
-		fallthrough
-	case "tcp":
-		p, err := newTCPProvider(*s)
-		if err != nil {
-			lg.Error(err.Error())
-			return false, err
-		}
-		s.Provider = p
-		return false, nil
+	b.status = s.status()
+	b.metrics = s.metrics()
+	b.status.setState(StatusIdle)
+	p, flag, err := factory(*s)
+	s.Provider = nil
+	if p != nil {
+		b.Provider = p
+		s.Provider = b
+	} else if err != nil {
+		b.status.failed(err)
+	}
+	if err != nil {
+		s.logger().Error(err.Error())
+		return false, err
+	}
+	return flag, nil
+}
 
-	case "azure":
-		p, err := newAzureProvider(*s)
-		if err != nil {
-			lg.Error(err.Error())
-			return false, err
-		}
-		s.Provider = p
-		return false, nil
+//connect creates the provider, its publish queue and outbox and applies the
+//TLS material if required
+func (s *Subscriber) connect() error {
+	_, err := newDeadLetterSink(*s)
+	if err != nil {
+		return err
+	}
+	_, err = s.t.openOutbox(*s)
+	if err != nil {
+		return err
+	}
+	err = s.t.openQueue(*s)
+	if err != nil {
+		return err
+	}
+	flag, err := s.newProvider()
+	if err != nil {
+		return err
+	}
+	if flag {
+		return s.Provider.SetTLS(s.ID)
+	}
+	return nil
+}
 
-	default:
-		lg.Error("Unsuported scheme " + u.Scheme)
-		return false, errors.New("Unsuported scheme " + u.Scheme)
+// disconnect shuts the provider down, providers like MQTT keep connecting in
+// the background otherwise
+func (s *Subscriber) disconnect() {
+	if s.Provider != nil {
+		s.Provider.Shutdown()
+		s.Provider = nil
 	}
+}
+
+//certRoot returns the folder containing the certificate folders of the
+//subscribers
+func (s Subscriber) certRoot() string {
+	if s.t == nil {
+		return dirname + "/certs"
+	}
+	return s.t.certFolder
+}
 
+//storeFolder returns the folder for the persisted data of the provider
+func (s Subscriber) storeFolder(name string) string {
+	dir := dirname
+	if s.t != nil {
+		dir = s.t.dir
+	}
+	return dir + "/" + name + "/" + s.ID
+}
+
+//logger returns the logger of the transport service of the subscriber
+func (s Subscriber) logger() *loglib.Logger {
+	if s.t == nil {
+		return lg
+	}
+	return s.t.lg
 }
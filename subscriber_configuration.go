@@ -13,6 +13,7 @@ import (
 type SubscriberConfiguration struct {
 	Subscribers map[string]*Subscriber `json:"subscribers,omitempty"`
 	mu          sync.RWMutex
+	t           *Transport
 }
 
 func (c *SubscriberConfiguration) add(sub Subscriber) (string, error) {
@@ -27,6 +28,7 @@ func (c *SubscriberConfiguration) add(sub Subscriber) (string, error) {
 	if sub.URI == "" {
 		return "", errors.New("Subscriber Path must  be set ")
 	}
+	sub.t = c.t
 	var id guuid.UUID
 	for {
 		id = guuid.New()
@@ -39,10 +41,22 @@ func (c *SubscriberConfiguration) add(sub Subscriber) (string, error) {
 	}
 
 	if sub.Enable {
-		_, err := sub.newProvider()
+		_, err := newDeadLetterSink(sub)
 		if err != nil {
 			return "", err
 		}
+		_, err = c.t.openOutbox(sub)
+		if err != nil {
+			return "", err
+		}
+		err = c.t.openQueue(sub)
+		if err == nil {
+			_, err = sub.newProvider()
+		}
+		if err != nil {
+			c.discard(&sub)
+			return "", err
+		}
 	}
 	c.Subscribers[id.String()] = &sub
 	c.serialize()
@@ -69,28 +83,26 @@ func (c *SubscriberConfiguration) set(sub Subscriber) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	old, ok := c.Subscribers[sub.ID]
-	if len(subEnabled[sub.ID]) > 0 {
+	if c.t.manager.locked(sub.ID) {
 		return errors.New("Subscriber is locked")
 	}
 	if !ok {
 		return errors.New("Subscriber with ID " + sub.ID + " does not exist")
 
 	}
+	sub.t = c.t
 
+	if old.Provider != nil {
+		old.Provider.Shutdown()
+	}
 	if sub.Enable {
-		if old.Provider != nil {
-			old.Provider.Shutdown()
-		}
-		flag, err := sub.newProvider()
+		err := sub.connect()
 		if err != nil {
+			// providers retrying in the background must not outlive the
+			// rejected definition
+			sub.disconnect()
 			return err
 		}
-		if flag {
-			err := sub.Provider.SetTLS(sub.ID)
-			if err != nil {
-				return err
-			}
-		}
 	}
 	c.Subscribers[sub.ID] = &sub
 	c.serialize()
@@ -98,31 +110,69 @@ func (c *SubscriberConfiguration) set(sub Subscriber) error {
 }
 func (c *SubscriberConfiguration) delete(id string) error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	sub, ok := c.Subscribers[id]
-	if len(subs[id]) > 0 {
+	if c.t.manager.inUse(id) {
+		c.mu.Unlock()
 		return errors.New("Subscriber is in use")
 	}
 	if !ok {
+		c.mu.Unlock()
 		return errors.New("Subscriber with ID " + id + " does not exist")
 
 	}
+	//stop connection
 	if sub.Provider != nil {
 		sub.Provider.Shutdown()
 	}
 	delete(c.Subscribers, id)
-	err := os.RemoveAll(certFolder + "/" + id)
+	c.serialize()
+	c.mu.Unlock()
+
+	// the workers of the queue need the lock to finish
+	c.t.closeQueue(id, func(j job) {
+		c.t.inflight.end(id)
+	})
+	c.t.removeOutbox(id)
+	c.t.removeTracker(id)
+	c.t.removeMetrics(id)
+	err := os.RemoveAll(c.t.certFolder + "/" + id)
 	if err != nil {
-		lg.WithError(err).Warning("Faied to delete certificate folder")
+		c.t.lg.WithError(err).Warning("Faied to delete certificate folder")
+	}
+	err = os.RemoveAll(c.t.mqttStoreFolder() + "/" + id)
+	if err != nil {
+		c.t.lg.WithError(err).Warning("Failed to delete MQTT store folder")
 	}
-	//stop connection
-	c.serialize()
 	return nil
 }
+// discard releases the provider, the publish queue and the outbox opened for
+// a subscriber which is not added. Nothing has been queued for it, so the
+// queue is stopped although the lock is held.
+func (c *SubscriberConfiguration) discard(sub *Subscriber) {
+	sub.disconnect()
+	c.t.closeQueue(sub.ID, func(j job) {})
+	c.t.removeOutbox(sub.ID)
+	c.t.removeTracker(sub.ID)
+	c.t.removeMetrics(sub.ID)
+}
+
+//start creates the providers of the enabled subscribers using the scheme
+func (c *SubscriberConfiguration) start(scheme string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range c.Subscribers {
+		if v.Enable && v.Provider == nil && schemeOf(v.URI) == scheme {
+			err := v.connect()
+			if err != nil {
+				c.t.lg.WithError(err).Warning("Failed to create provider")
+			}
+		}
+	}
+}
 func (c *SubscriberConfiguration) serialize() {
-	f, err := os.Create(filename)
+	f, err := os.Create(c.t.filename())
 	if err != nil {
-		lg.WithError(err).Error("Failed to create or open configuration file")
+		c.t.lg.WithError(err).Error("Failed to create or open configuration file")
 	} else {
 		enc := json.NewEncoder(f)
 		enc.SetIndent("", " ")
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"strings"
 )
@@ -15,14 +16,15 @@ type Subscriptor struct {
 	Properties   map[string]string `json:"properties"`
 }
 
-func (subscriptor Subscriptor) valid() error {
+//valid validates the subscriptor, c.mu has to be held
+func (subscriptor Subscriptor) valid(c *SubscriberConfiguration) error {
 	if subscriptor.Name == "" || strings.TrimSpace(subscriptor.Name) == "" {
 		return errors.New("Subscriptor must have a name")
 	}
 	if subscriptor.SubscriberID == "" || strings.TrimSpace(subscriptor.SubscriberID) == "" {
 		return errors.New("Subscriptor must have a subscriber")
 	}
-	_, ok := config.Subscribers[subscriptor.SubscriberID]
+	_, ok := c.Subscribers[subscriptor.SubscriberID]
 	if !ok {
 		return errors.New("Subscriptor subscriber does not exist")
 	}
@@ -30,17 +32,13 @@ func (subscriptor Subscriptor) valid() error {
 	return nil
 }
 
-//SendReport --send a report
-func (subscriptor Subscriptor) SendReport(report interface{}) {
-	config.mu.RLock()
-	s, ok := config.Subscribers[subscriptor.SubscriberID]
-	config.mu.RUnlock()
-	if !ok {
-		lg.Error("Subscriptor subscriber does not exist")
-		return
-	}
-	if s.Provider == nil {
-		return
-	}
-	s.Provider.Publish(subscriptor.Path, report)
+//SendReport --send a report using the default transport service
+func (subscriptor Subscriptor) SendReport(report interface{}) error {
+	return subscriptor.SendReportContext(context.Background(), report)
+}
+
+//SendReportContext --send a report using the default transport service, the
+//context bounds the delivery
+func (subscriptor Subscriptor) SendReportContext(ctx context.Context, report interface{}) error {
+	return Default().SendReport(ctx, subscriptor, report)
 }
@@ -1,114 +1,244 @@
 package transport
 
 import (
+	"encoding/json"
 	"errors"
+	"os"
+	"sync"
 
 	guuid "github.com/google/uuid"
 )
 
-var subs map[string]map[string]string
-var subEnabled map[string]map[string]string
-var subscriptors map[string]*Subscriptor
+// subscriptorManager registry of the subscriptors. Validating a subscriptor
+// requires the subscriber configuration, hence t.config.mu has always to be
+// acquired before mu.
+type subscriptorManager struct {
+	mu           sync.RWMutex
+	t            *Transport
+	subs         map[string]map[string]string
+	subEnabled   map[string]map[string]string
+	subscriptors map[string]*Subscriptor
+}
+
+type subscriptorConfiguration struct {
+	Subscriptors map[string]*Subscriptor `json:"subscriptors,omitempty"`
+}
+
+func newSubscriptorManager(t *Transport) *subscriptorManager {
+	return &subscriptorManager{
+		t:            t,
+		subs:         make(map[string]map[string]string),
+		subEnabled:   make(map[string]map[string]string),
+		subscriptors: make(map[string]*Subscriptor),
+	}
+}
 
-//AddSubscriptor  add a subscriptor
+//AddSubscriptor  add a subscriptor to the default transport service
 func AddSubscriptor(sub Subscriptor) error {
-	err := sub.valid()
+	return Default().AddSubscriptor(sub)
+}
+
+//DefineSubscriptor define a subscriptor of the default transport service
+func DefineSubscriptor(sub Subscriptor) (string, error) {
+	return Default().DefineSubscriptor(sub)
+}
+
+//UpdateSubscriptor update a subscriptor of the default transport service
+func UpdateSubscriptor(sub Subscriptor) error {
+	return Default().UpdateSubscriptor(sub)
+}
+
+//DeleteSubscriptor deletes a subscriptor of the default transport service
+func DeleteSubscriptor(id string) error {
+	return Default().DeleteSubscriptor(id)
+}
+
+func (m *subscriptorManager) add(sub Subscriptor) error {
+	m.t.config.mu.RLock()
+	defer m.t.config.mu.RUnlock()
+	err := sub.valid(m.t.config)
 	if err != nil {
 		return err
 	}
-
-	subscriptors[sub.ID] = &sub
-	if subs[sub.SubscriberID] == nil {
-		subs[sub.SubscriberID] = make(map[string]string)
-		subEnabled[sub.SubscriberID] = make(map[string]string)
-	}
-	subs[sub.SubscriberID][sub.ID] = sub.ID
-	if sub.Enable {
-		subEnabled[sub.SubscriberID][sub.ID] = sub.ID
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.subscriptors[sub.ID]; ok {
+		m.unindex(old)
 	}
-
+	m.subscriptors[sub.ID] = &sub
+	m.index(&sub)
+	m.serialize()
 	return nil
 
 }
 
-//DefineSubscriptor define a subscriptor
-func DefineSubscriptor(sub Subscriptor) (string, error) {
+func (m *subscriptorManager) define(sub Subscriptor) (string, error) {
 	if sub.ID != "" {
 		return "", errors.New("Subscriptor ID must not be set ")
 	}
-	err := sub.valid()
+	m.t.config.mu.RLock()
+	defer m.t.config.mu.RUnlock()
+	err := sub.valid(m.t.config)
 	if err != nil {
 
 		return "", err
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	var id guuid.UUID
 	for {
 		id = guuid.New()
-		_, ok := subscriptors[id.String()]
+		_, ok := m.subscriptors[id.String()]
 		if !ok {
 			sub.ID = id.String()
 			break
 		}
 
 	}
-	subscriptors[sub.ID] = &sub
-	if subs[sub.SubscriberID] == nil {
-		subs[sub.SubscriberID] = make(map[string]string)
-		subEnabled[sub.SubscriberID] = make(map[string]string)
-	}
-	subs[sub.SubscriberID][sub.ID] = sub.ID
-	if sub.Enable {
-		subEnabled[sub.SubscriberID][sub.ID] = sub.ID
-	}
-
+	m.subscriptors[sub.ID] = &sub
+	m.index(&sub)
+	m.serialize()
 	return id.String(), nil
 
 }
 
-//UpdateSubscriptor update a subscriptor
-func UpdateSubscriptor(sub Subscriptor) error {
-	s, ok := subscriptors[sub.ID]
+func (m *subscriptorManager) update(sub Subscriptor) error {
+	m.t.config.mu.RLock()
+	defer m.t.config.mu.RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.subscriptors[sub.ID]
 	if !ok {
 		return errors.New("Subscriptor with Id " + sub.ID + " has not been initialized")
 	}
 	if s.Enable && sub.Enable {
 		return errors.New("Can't update an used subscriptor")
 	}
-	err := sub.valid()
+	err := sub.valid(m.t.config)
 	if err != nil {
-		lg.Error(err)
+		m.t.lg.Error(err)
 		return err
 	}
-	if s.SubscriberID != sub.SubscriberID {
-		delete(subs[s.SubscriberID], s.ID)
-		delete(subEnabled[s.SubscriberID], s.ID)
-		if subs[sub.SubscriberID] == nil {
-			subs[sub.SubscriberID] = make(map[string]string)
-			subEnabled[sub.SubscriberID] = make(map[string]string)
+	m.unindex(s)
+	m.subscriptors[sub.ID] = &sub
+	m.index(&sub)
+	m.serialize()
+	return nil
+}
+
+func (m *subscriptorManager) delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.subscriptors[id]
+	if !ok {
+		return errors.New("Subscriptor with Id " + id + " has not been initialized")
+	}
+	m.unindex(s)
+	delete(m.subscriptors, id)
+	m.serialize()
+	return nil
+}
+
+// get returns a copy of the subscriptor
+func (m *subscriptorManager) get(id string) (Subscriptor, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.subscriptors[id]
+	if !ok {
+		return Subscriptor{}, false
+	}
+	return *s, true
+}
+
+// list returns copies of the subscriptors of the subscriber or of all
+// subscriptors if subscriberID is empty
+func (m *subscriptorManager) list(subscriberID string) []Subscriptor {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := []Subscriptor{}
+	for _, value := range m.subscriptors {
+		if subscriberID == "" || value.SubscriberID == subscriberID {
+			result = append(result, *value)
 		}
-		subs[sub.SubscriberID][sub.ID] = sub.ID
 	}
+	return result
+}
+
+// inUse returns whether subscriptors refer to the subscriber
+func (m *subscriptorManager) inUse(subscriberID string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.subs[subscriberID]) > 0
+}
+
+// locked returns whether enabled subscriptors refer to the subscriber
+func (m *subscriptorManager) locked(subscriberID string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.subEnabled[subscriberID]) > 0
+}
 
+// index marks the subscriber of the subscriptor as in use and as locked if
+// the subscriptor is enabled
+func (m *subscriptorManager) index(sub *Subscriptor) {
+	if m.subs[sub.SubscriberID] == nil {
+		m.subs[sub.SubscriberID] = make(map[string]string)
+		m.subEnabled[sub.SubscriberID] = make(map[string]string)
+	}
+	m.subs[sub.SubscriberID][sub.ID] = sub.ID
 	if sub.Enable {
-		subEnabled[sub.SubscriberID][sub.ID] = sub.ID
-	} else {
+		m.subEnabled[sub.SubscriberID][sub.ID] = sub.ID
+	}
+}
 
-		delete(subEnabled[sub.SubscriberID], sub.ID)
+func (m *subscriptorManager) unindex(sub *Subscriptor) {
+	delete(m.subs[sub.SubscriberID], sub.ID)
+	delete(m.subEnabled[sub.SubscriberID], sub.ID)
+}
 
+// load reads the persisted subscriptors. Subscriptors of subscribers which
+// do not exist anymore are dropped.
+func (m *subscriptorManager) load() {
+	f, err := os.Open(m.t.subscriptorsFilename())
+	if err != nil {
+		m.t.lg.WithError(err).Debug("Failed to read subscriptors")
+		return
+	}
+	defer f.Close()
+	var c subscriptorConfiguration
+	err = json.NewDecoder(f).Decode(&c)
+	if err != nil {
+		m.t.lg.Warning("Failed to parse subscriptors")
+		return
+	}
+	m.t.config.mu.RLock()
+	defer m.t.config.mu.RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, sub := range c.Subscriptors {
+		if sub == nil {
+			continue
+		}
+		sub.ID = id
+		if err := sub.valid(m.t.config); err != nil {
+			m.t.lg.WithError(err).Warning("Dropping subscriptor " + id)
+			continue
+		}
+		m.subscriptors[id] = sub
+		m.index(sub)
 	}
-	subscriptors[sub.ID] = &sub
-	return nil
 }
 
-//DeleteSubscriptor deletes a subscriptor
-func DeleteSubscriptor(id string) error {
-	s, ok := subscriptors[id]
-	if !ok {
-		return errors.New("Subscriptor with Id " + id + " has not been initialized")
+// serialize writes the subscriptors, mu has to be held
+func (m *subscriptorManager) serialize() {
+	f, err := os.Create(m.t.subscriptorsFilename())
+	if err != nil {
+		m.t.lg.WithError(err).Error("Failed to create or open subscriptors file")
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", " ")
+		enc.Encode(subscriptorConfiguration{Subscriptors: m.subscriptors})
 	}
-	delete(subs[s.SubscriberID], id)
-	delete(subEnabled[s.SubscriberID], id)
-	delete(subscriptors, id)
-	return nil
+	defer f.Close()
 }
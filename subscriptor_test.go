@@ -0,0 +1,229 @@
+package transport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// testServer serves the REST routes of the transport
+func testServer(t *testing.T, tr *Transport) *httptest.Server {
+	router := mux.NewRouter()
+	for _, route := range tr.Routes() {
+		router.Methods(route.Method).Path(route.Pattern).Name(route.Name).Handler(route.HandlerFunc)
+	}
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// request sends the body as JSON and returns the status and the response
+func request(t *testing.T, method string, url string, body interface{}) (int, string) {
+	var payload string
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload = string(b)
+	}
+	r, err := http.NewRequest(method, url, strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func listSubscriptors(t *testing.T, url string) []Subscriptor {
+	status, body := request(t, http.MethodGet, url, nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	var subscriptors []Subscriptor
+	if err := json.Unmarshal([]byte(body), &subscriptors); err != nil {
+		t.Fatal(err)
+	}
+	return subscriptors
+}
+
+func TestSubscriptorsAPI(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	srv := testServer(t, tr)
+	base := srv.URL + "/rest/subscriptors"
+	first, err := tr.config.add(Subscriber{Enable: true, URI: "fake://first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tr.config.add(Subscriber{Enable: true, URI: "fake://second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		body   Subscriptor
+		status int
+	}{
+		{Subscriptor{ID: "x", Name: "a", SubscriberID: first}, http.StatusBadRequest},
+		{Subscriptor{Name: "a", SubscriberID: "unknown"}, http.StatusBadRequest},
+	} {
+		if status, body := request(t, http.MethodPost, base, tc.body); status != tc.status {
+			t.Fatalf("%+v added with status %d: %s", tc.body, status, body)
+		}
+	}
+	ids := make(map[string]string)
+	for _, sub := range []Subscriptor{
+		{Enable: true, Name: "a", Path: "a", SubscriberID: first},
+		{Name: "b", Path: "b", SubscriberID: first},
+		{Name: "c", Path: "c", SubscriberID: second},
+	} {
+		status, id := request(t, http.MethodPost, base, sub)
+		if status != http.StatusOK || id == "" {
+			t.Fatalf("%+v added with status %d: %s", sub, status, id)
+		}
+		ids[sub.Name] = id
+	}
+
+	if n := len(listSubscriptors(t, base)); n != 3 {
+		t.Fatalf("%d subscriptors listed, want 3", n)
+	}
+	for subscriber, want := range map[string]int{first: 2, second: 1, "unknown": 0} {
+		for _, sub := range listSubscriptors(t, base+"?subscriberId="+subscriber) {
+			if sub.SubscriberID != subscriber {
+				t.Fatalf("subscriptor of %s listed for %s", sub.SubscriberID, subscriber)
+			}
+		}
+		if n := len(listSubscriptors(t, base+"?subscriberId="+subscriber)); n != want {
+			t.Fatalf("%d subscriptors listed for %s, want %d", n, subscriber, want)
+		}
+	}
+
+	status, body := request(t, http.MethodGet, base+"/"+ids["a"], nil)
+	var got Subscriptor
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &got) != nil || got.Name != "a" || got.ID != ids["a"] {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	if status, _ := request(t, http.MethodGet, base+"/unknown", nil); status != http.StatusNotFound {
+		t.Fatalf("unknown subscriptor returned status %d", status)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		id     string
+		body   Subscriptor
+		status int
+	}{
+		{"mismatching id", ids["b"], Subscriptor{ID: ids["a"], Name: "b"}, http.StatusBadRequest},
+		{"enabled subscriptor", ids["a"], Subscriptor{ID: ids["a"], Enable: true, Name: "a2", SubscriberID: first}, http.StatusBadRequest},
+		{"unknown subscriber", ids["b"], Subscriptor{ID: ids["b"], Name: "b2", SubscriberID: "unknown"}, http.StatusBadRequest},
+		{"unknown subscriptor", "unknown", Subscriptor{ID: "unknown", Name: "x", SubscriberID: first}, http.StatusBadRequest},
+		{"disabled subscriptor", ids["b"], Subscriptor{ID: ids["b"], Name: "b2", Path: "b", SubscriberID: second}, http.StatusNoContent},
+	} {
+		if status, body := request(t, http.MethodPut, base+"/"+tc.id, tc.body); status != tc.status {
+			t.Fatalf("update of %s returned status %d, want %d: %s", tc.name, status, tc.status, body)
+		}
+	}
+	if sub, _ := tr.manager.get(ids["b"]); sub.Name != "b2" || sub.SubscriberID != second {
+		t.Fatalf("subscriptor not updated %+v", sub)
+	}
+
+	if status, _ := request(t, http.MethodPost, base+"/"+ids["a"]+"/disable", nil); status != http.StatusNoContent {
+		t.Fatalf("disable returned status %d", status)
+	}
+	if sub, _ := tr.manager.get(ids["a"]); sub.Enable {
+		t.Fatal("subscriptor not disabled")
+	}
+	if status, _ := request(t, http.MethodPost, base+"/"+ids["a"]+"/enable", nil); status != http.StatusNoContent {
+		t.Fatalf("enable returned status %d", status)
+	}
+	if status, _ := request(t, http.MethodPost, base+"/unknown/enable", nil); status != http.StatusNotFound {
+		t.Fatalf("enable of an unknown subscriptor returned status %d", status)
+	}
+
+	if status, _ := request(t, http.MethodDelete, base+"/"+ids["c"], nil); status != http.StatusNoContent {
+		t.Fatalf("delete returned status %d", status)
+	}
+	if status, _ := request(t, http.MethodDelete, base+"/"+ids["c"], nil); status != http.StatusBadRequest {
+		t.Fatalf("second delete returned status %d", status)
+	}
+	if status, _ := request(t, http.MethodGet, base+"/"+ids["c"], nil); status != http.StatusNotFound {
+		t.Fatalf("deleted subscriptor returned status %d", status)
+	}
+}
+
+func TestSubscriptorsReloaded(t *testing.T) {
+	dir := testDir(t)
+	tr := newTestTransport(t, WithDirectory(dir))
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://reload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := Subscriptor{Enable: true, Name: "a", Path: "p", SubscriberID: id, Properties: map[string]string{"k": "v"}}
+	subID, err := tr.DefineSubscriptor(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Close()
+
+	reloaded := newTestTransport(t, WithDirectory(dir))
+	defer reloaded.Close()
+	got, ok := reloaded.manager.get(subID)
+	sub.ID = subID
+	if !ok || got.Name != sub.Name || got.Path != sub.Path || got.SubscriberID != id || !got.Enable || got.Properties["k"] != "v" {
+		t.Fatalf("reloaded %+v, want %+v", got, sub)
+	}
+	if n := len(reloaded.manager.list(id)); n != 1 {
+		t.Fatalf("%d subscriptors indexed for the subscriber", n)
+	}
+	if err := reloaded.config.delete(id); err == nil {
+		t.Fatal("subscriber of a reloaded subscriptor deleted")
+	}
+}
+
+func TestSubscriptorsCorruptFile(t *testing.T) {
+	dir := testDir(t)
+	tr := newTestTransport(t, WithDirectory(dir))
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://corrupt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.DefineSubscriptor(Subscriptor{Name: "a", SubscriberID: id}); err != nil {
+		t.Fatal(err)
+	}
+	tr.Close()
+
+	for _, content := range []string{`{"subscriptors": {"x": `, `[1, 2]`, `{"subscriptors": {"x": {"subscriberId": "unknown"}}}`} {
+		if err := ioutil.WriteFile(tr.subscriptorsFilename(), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		reloaded := newTestTransport(t, WithDirectory(dir))
+		if n := len(reloaded.manager.list("")); n != 0 {
+			t.Fatalf("%d subscriptors loaded from %s", n, content)
+		}
+		if _, ok := reloaded.subscriber(id); !ok {
+			t.Fatal("subscribers not loaded")
+		}
+		// the service keeps working and persists new subscriptors
+		if _, err := reloaded.DefineSubscriptor(Subscriptor{Name: "b", SubscriberID: id}); err != nil {
+			t.Fatal(err)
+		}
+		reloaded.Close()
+	}
+	reloaded := newTestTransport(t, WithDirectory(dir))
+	defer reloaded.Close()
+	if subs := reloaded.manager.list(""); len(subs) != 1 || subs[0].Name != "b" {
+		t.Fatalf("reloaded %+v", subs)
+	}
+}
@@ -1,67 +1,147 @@
 package transport
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	loglib "github.com/menucha-de/logging"
 )
 
 type tcpclient struct {
-	URI     string
-	timeout int
+	URI        string
+	timeout    int
+	enc        Encoder
+	retry      *retryPolicy
+	status     *statusTracker
+	metrics    *subscriberMetrics
+	lg         *loglib.Logger
+	persistent bool
+	framing    *framing
+	secure     bool
+	serverName string
+	minVersion uint16
+	certs      string
+	tlsConfig  *tls.Config
+	mu         sync.Mutex
+	conn       net.Conn
+	closed     chan struct{}
+}
+
+var tcpPersistentProperty string = prefix + "TCP.Persistent"
+var tcpFramingProperty string = prefix + "TCP.Framing"
+var tcpDelimiterProperty string = prefix + "TCP.Delimiter"
+var tcpsServerNameProperty string = prefix + "TCPS.ServerName"
+var tcpsMinVersionProperty string = prefix + "TCPS.MinVersion"
+
+func init() {
+	RegisterProvider("tcp", tcpFactory)
+	RegisterProvider("tcps", tcpFactory)
+}
+
+func tcpFactory(s Subscriber) (Provider, bool, error) {
+	p, err := newTCPProvider(s)
+	if err != nil {
+		return nil, false, err
+	}
+	return p, p.secure, nil
 }
 
 func newTCPProvider(s Subscriber) (*tcpclient, error) {
 	defaultTimeout = 1000
 	if s.URI == "" {
-		lg.Error("URI Can't be null")
+		s.logger().Error("URI Can't be null")
 		return nil, errors.New("URI must not be null")
 	}
 	u, err := url.Parse(s.URI)
 	if err != nil {
-		lg.Error("Can't parse subscriber URI")
+		s.logger().Error("Can't parse subscriber URI")
 		return nil, err
 	}
-	if strings.ToLower(u.Scheme) != "tcp" && strings.ToLower(u.Scheme) != "udp" {
-		lg.Error("Unknown scheme ")
-		return nil, err
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "tcp" && scheme != "tcps" {
+		s.logger().Error("Unknown scheme '" + u.Scheme + "'")
+		return nil, errors.New("Unknown scheme '" + u.Scheme + "'")
 	}
 	if u.Host == "" {
-		lg.Error("No host specified")
+		s.logger().Error("No host specified")
 		return nil, errors.New("No  host specified")
 
 	}
-	var tcpTimeoutProperty string = prefix + strings.ToUpper(u.Scheme) + ".Timeout"
+	// tcps shares the Transporter.TCP.* properties of tcp
+	secure := scheme == "tcps"
+	var tcpTimeoutProperty string = prefix + "TCP.Timeout"
 	if u.Port() == "" {
-		lg.Error("No port specified")
+		s.logger().Error("No port specified")
 		return nil, errors.New("No  port specified")
 	}
 	timeout := defaultTimeout
+	persistent := false
+	framingName := ""
+	delimiter := ""
+	serverName := ""
+	var minVersion uint16
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicy(s)
+	if err != nil {
+		return nil, err
+	}
 	if s.Properties != nil {
 		for key, property := range s.Properties {
 
-			if key != "" && strings.HasPrefix(key, prefix+strings.ToUpper(u.Scheme)) {
+			if key != "" && strings.HasPrefix(key, prefix+"TCP") {
 				switch key {
 				case tcpTimeoutProperty:
 					timeout, err = strconv.Atoi(property)
 					if err != nil {
-						lg.Error("Invalid timeout value '" + property + "'")
+						s.logger().Error("Invalid timeout value '" + property + "'")
 						return nil, errors.New("Invalid timeout value '" + property + "'")
 
 					}
 
 					if timeout < 0 {
-						lg.Error("Invalid timeout value '" + property + "'")
+						s.logger().Error("Invalid timeout value '" + property + "'")
 						return nil, errors.New("Invalid timeout value '" + property + "'")
 
 					}
+				case tcpPersistentProperty:
+					persistent, err = strconv.ParseBool(property)
+					if err != nil {
+						s.logger().Error("Invalid " + tcpPersistentProperty + " '" + property + "'")
+						return nil, errors.New("Invalid " + tcpPersistentProperty + " '" + property + "'")
+					}
+				case tcpFramingProperty:
+					framingName = property
+				case tcpDelimiterProperty:
+					delimiter = property
+				case tcpsServerNameProperty, tcpsMinVersionProperty:
+					if !secure {
+						s.logger().Error("Property key '" + key + "' requires the tcps scheme")
+						return nil, errors.New("Property key '" + key + "' requires the tcps scheme")
+					}
+					if key == tcpsServerNameProperty {
+						serverName = property
+						break
+					}
+					minVersion, err = parseTLSVersion(property)
+					if err != nil {
+						s.logger().Error(err.Error())
+						return nil, err
+					}
 
 				default:
-					lg.Error("Unknown property key '" + key + "'")
+					s.logger().Error("Unknown property key '" + key + "'")
 					return nil, errors.New("Unknown property key '" + key + "'")
 
 				}
@@ -69,32 +149,164 @@ func newTCPProvider(s Subscriber) (*tcpclient, error) {
 		}
 	}
 
-	return &tcpclient{s.URI, timeout}, nil
+	f, err := newFraming(framingName, delimiter)
+	if err != nil {
+		s.logger().Error(err.Error())
+		return nil, err
+	}
+	if delimiter != "" && f.name != "delimiter" {
+		s.logger().Error(tcpDelimiterProperty + " requires the delimiter framing")
+		return nil, errors.New(tcpDelimiterProperty + " requires the delimiter framing")
+	}
+
+	return &tcpclient{
+		URI:        s.URI,
+		timeout:    timeout,
+		enc:        enc,
+		retry:      retry,
+		status:     s.status(),
+		metrics:    s.metrics(),
+		lg:         s.logger(),
+		persistent: persistent,
+		framing:    f,
+		secure:     secure,
+		serverName: serverName,
+		minVersion: minVersion,
+		certs:      s.certRoot(),
+	}, nil
 }
-func (c *tcpclient) Publish(topic string, message interface{}) {
+func (c *tcpclient) Publish(ctx context.Context, topic string, message interface{}) error {
 	if c == nil {
-		return
+		return errors.New("TCP client not initialized")
 	}
 
-	str := fmt.Sprintf("%v", message)
-	u, _ := url.Parse(c.URI)
-	servAddr := u.Host
+	str, err := c.enc.Encode(message)
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	str, err = c.framing.frame(str)
+	if err != nil {
+		// the report will never fit into the frame
+		c.lg.Error(err.Error())
+		return &deliveryError{err: err, permanent: true}
+	}
+	return c.retry.do(ctx, func(ctx context.Context) error {
+		return c.send(ctx, str)
+	})
+}
+
+// send makes a single attempt to deliver the encoded report. A persistent
+// connection is reused and dialed again once it failed.
+func (c *tcpclient) send(ctx context.Context, str []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.timeout)*time.Millisecond)
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn := c.conn
+	if conn != nil && !c.alive() {
+		c.close()
+		conn = nil
+	}
+	if conn == nil {
+		var err error
+		conn, err = c.dial(ctx)
+		if err != nil {
+			c.lg.Error("Dial failed:", err.Error())
+			c.status.disconnected(err)
+			return err
+		}
+		if c.persistent {
+			c.conn = conn
+			c.closed = make(chan struct{})
+			go c.watch(conn, c.closed)
+		} else {
+			defer conn.Close()
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
 
-	d := net.Dialer{Timeout: time.Duration(c.timeout/1000) * time.Second}
-	conn, err := d.Dial(strings.ToLower(u.Scheme), servAddr)
+	n, err := conn.Write(str)
+	c.metrics.sent(n)
 	if err != nil {
-		lg.Error("Dial failed:", err.Error())
-		return
+		c.lg.Error("Write to server failed:", err.Error())
+		c.status.disconnected(err)
+		c.close()
+		return err
+	}
+	c.status.connected()
+	return nil
+}
+
+func (c *tcpclient) dial(ctx context.Context) (net.Conn, error) {
+	u, _ := url.Parse(c.URI)
+	if !c.secure {
+		var d net.Dialer
+		return d.DialContext(ctx, strings.ToLower(u.Scheme), u.Host)
+	}
+	if c.tlsConfig == nil {
+		return nil, errors.New("TLS not configured")
 	}
+	d := tls.Dialer{Config: c.tlsConfig}
+	return d.DialContext(ctx, "tcp", u.Host)
+}
 
-	_, err = conn.Write([]byte(str))
+// watch reads from the persistent connection until the peer closes it,
+// data sent by the peer is discarded
+func (c *tcpclient) watch(conn net.Conn, closed chan struct{}) {
+	_, err := io.Copy(ioutil.Discard, conn)
 	if err != nil {
-		lg.Error("Write to server failed:", err.Error())
+		c.lg.WithError(err).Debug("TCP connection closed")
+	}
+	close(closed)
+}
+
+// alive checks whether the persistent connection is still open, c.mu has to
+// be held
+func (c *tcpclient) alive() bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// close closes the persistent connection, c.mu has to be held
+func (c *tcpclient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *tcpclient) Shutdown() {
+	if c == nil {
 		return
 	}
-	conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.close()
 }
-func (c *tcpclient) Shutdown() {}
+
+//SetTLS applies the certificates of the subscriber, the persistent connection
+//is dialed again using them
 func (c *tcpclient) SetTLS(id string) error {
+	if !c.secure {
+		return nil
+	}
+	config := newTLSConfig(c.certs+"/"+id, c.lg)
+	u, _ := url.Parse(c.URI)
+	config.ServerName = u.Hostname()
+	if c.serverName != "" {
+		config.ServerName = c.serverName
+	}
+	config.MinVersion = c.minVersion
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tlsConfig = config
+	c.close()
 	return nil
 }
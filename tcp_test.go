@@ -0,0 +1,200 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpServer local listener collecting the frames received per connection
+type tcpServer struct {
+	ln     net.Listener
+	f      *framing
+	mu     sync.Mutex
+	conns  []net.Conn
+	frames chan string
+}
+
+func newTCPServer(t *testing.T, f *framing) *tcpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &tcpServer{ln: ln, f: f, frames: make(chan string, 100)}
+	go srv.accept()
+	t.Cleanup(srv.close)
+	return srv
+}
+
+func (srv *tcpServer) accept() {
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns = append(srv.conns, conn)
+		srv.mu.Unlock()
+		go func() {
+			r := bufio.NewReader(conn)
+			for {
+				payload, err := readFrame(r, srv.f)
+				if err != nil {
+					return
+				}
+				srv.frames <- string(payload)
+			}
+		}()
+	}
+}
+
+func (srv *tcpServer) uri() string {
+	return "tcp://" + srv.ln.Addr().String()
+}
+
+func (srv *tcpServer) connections() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.conns)
+}
+
+// drop closes the accepted connections
+func (srv *tcpServer) drop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, c := range srv.conns {
+		c.Close()
+	}
+}
+
+func (srv *tcpServer) close() {
+	srv.ln.Close()
+	srv.drop()
+}
+
+func (srv *tcpServer) receive(t *testing.T) string {
+	select {
+	case s := <-srv.frames:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatal("no report received")
+	}
+	return ""
+}
+
+func testTCPProvider(t *testing.T, uri string, properties map[string]string) *tcpclient {
+	p, err := newTCPProvider(Subscriber{URI: uri, Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+	return p
+}
+
+func TestTCPFramingRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		framing, delimiter string
+	}{
+		{"newline", ""},
+		{"length-prefix-2", ""},
+		{"length-prefix-4", ""},
+		{"stx-etx", ""},
+		{"delimiter", `\r\n`},
+	} {
+		for _, persistent := range []bool{false, true} {
+			t.Run(tc.framing+"/persistent="+strconv.FormatBool(persistent), func(t *testing.T) {
+				f, err := newFraming(tc.framing, tc.delimiter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				srv := newTCPServer(t, f)
+				properties := map[string]string{
+					tcpFramingProperty:    tc.framing,
+					tcpPersistentProperty: strconv.FormatBool(persistent),
+				}
+				if tc.delimiter != "" {
+					properties[tcpDelimiterProperty] = tc.delimiter
+				}
+				p := testTCPProvider(t, srv.uri(), properties)
+				for i := 0; i < 3; i++ {
+					report := map[string]int{"report": i}
+					if err := p.Publish(context.Background(), "a", report); err != nil {
+						t.Fatal(err)
+					}
+					want, _ := p.enc.Encode(report)
+					if got := srv.receive(t); got != string(want) {
+						t.Fatalf("received %q, want %q", got, want)
+					}
+				}
+				want := 3
+				if persistent {
+					want = 1
+				}
+				if n := srv.connections(); n != want {
+					t.Fatalf("%d connections, want %d", n, want)
+				}
+			})
+		}
+	}
+}
+
+func TestTCPPersistentRedial(t *testing.T) {
+	f, _ := newFraming("newline", "")
+	srv := newTCPServer(t, f)
+	p := testTCPProvider(t, srv.uri(), map[string]string{
+		tcpFramingProperty:          "newline",
+		tcpPersistentProperty:       "true",
+		retryInitialBackoffProperty: "1",
+	})
+	if err := p.Publish(context.Background(), "a", "first"); err != nil {
+		t.Fatal(err)
+	}
+	srv.receive(t)
+	srv.drop()
+	// wait until the provider noticed the closed connection
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		p.mu.Lock()
+		alive := p.alive()
+		p.mu.Unlock()
+		if !alive {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection not detected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := p.Publish(context.Background(), "a", "second"); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := p.enc.Encode("second")
+	if got := srv.receive(t); got != string(want) {
+		t.Fatalf("received %q, want %q", got, want)
+	}
+	if n := srv.connections(); n != 2 {
+		t.Fatalf("%d connections, want 2", n)
+	}
+}
+
+func TestTCPProviderProperties(t *testing.T) {
+	for _, properties := range []map[string]string{
+		{tcpFramingProperty: "xml"},
+		{tcpPersistentProperty: "maybe"},
+		{tcpDelimiterProperty: "#"},
+		{tcpsServerNameProperty: "localhost"},
+	} {
+		if _, err := newTCPProvider(Subscriber{URI: "tcp://localhost:1234", Properties: properties}); err == nil {
+			t.Fatalf("invalid properties %v accepted", properties)
+		}
+	}
+	for _, uri := range []string{"tcp://localhost", "tcp:///path", "udp://localhost:1234"} {
+		if _, err := newTCPProvider(Subscriber{URI: uri}); err == nil {
+			t.Fatalf("invalid URI %s accepted", uri)
+		}
+	}
+}
@@ -3,12 +3,14 @@ package transport
 import (
 	tls "crypto/tls"
 	"crypto/x509"
+	"errors"
 	"io/ioutil"
 
+	loglib "github.com/menucha-de/logging"
 	"github.com/menucha-de/utils"
 )
 
-func newTLSConfig(dir string) *tls.Config {
+func newTLSConfig(dir string, lg *loglib.Logger) *tls.Config {
 	// Import trusted certificates from CAfile.pem.
 	certpool := x509.NewCertPool()
 
@@ -42,3 +44,19 @@ func newTLSConfig(dir string) *tls.Config {
 		Certificates: []tls.Certificate{cert},
 	}
 }
+
+// parseTLSVersion returns the TLS version like 1.2
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, errors.New("Invalid TLS version '" + version + "'")
+	}
+}
@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed server certificate for the names
+// and its PEM encoding
+func testCertificate(t *testing.T, names ...string) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: names[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              names,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// newTLSServer accepts TLS connections using the certificate, the server
+// names sent by the clients are passed to names
+func newTLSServer(t *testing.T, cert tls.Certificate, maxVersion uint16, names chan string) *tcpServer {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   maxVersion,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			names <- hello.ServerName
+			return nil, nil
+		},
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := newFraming("newline", "")
+	srv := &tcpServer{ln: ln, f: f, frames: make(chan string, 100)}
+	go srv.accept()
+	t.Cleanup(srv.close)
+	return srv
+}
+
+func TestTCPSTLS(t *testing.T) {
+	cert, ca := testCertificate(t, "reports.test")
+	tr := newTestTransport(t)
+	defer tr.Close()
+	if err := os.MkdirAll(tr.certFolder+"/trusted", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tr.certFolder+"/trusted/ca", ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		id         string
+		serverName string
+		minVersion string
+		maxVersion uint16
+		sent       string
+		ok         bool
+	}{
+		{"trusted", "trusted", "reports.test", "", 0, "reports.test", true},
+		{"min version met", "trusted", "reports.test", "1.3", tls.VersionTLS13, "reports.test", true},
+		{"min version not met", "trusted", "reports.test", "1.3", tls.VersionTLS12, "reports.test", false},
+		{"server name mismatch", "trusted", "other.test", "", 0, "other.test", false},
+		{"host name verified", "trusted", "", "", 0, "", false},
+		{"untrusted certificate", "untrusted", "reports.test", "", 0, "reports.test", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			names := make(chan string, 10)
+			srv := newTLSServer(t, cert, tc.maxVersion, names)
+			properties := map[string]string{
+				tcpFramingProperty:       "newline",
+				retryMaxAttemptsProperty: "1",
+			}
+			if tc.serverName != "" {
+				properties[tcpsServerNameProperty] = tc.serverName
+			}
+			if tc.minVersion != "" {
+				properties[tcpsMinVersionProperty] = tc.minVersion
+			}
+			p, err := newTCPProvider(Subscriber{ID: tc.id, URI: "tcps://" + srv.ln.Addr().String(), Properties: properties, t: tr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Shutdown()
+			if err := p.SetTLS(tc.id); err != nil {
+				t.Fatal(err)
+			}
+			err = p.Publish(context.Background(), "", "report")
+			if tc.ok != (err == nil) {
+				t.Fatalf("publish returned %v", err)
+			}
+			select {
+			case name := <-names:
+				if name != tc.sent {
+					t.Fatalf("server name %q sent, want %q", name, tc.sent)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("no client hello received")
+			}
+			if tc.ok {
+				if got := srv.receive(t); got != "report" {
+					t.Fatalf("received %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPSWithoutTLSMaterial(t *testing.T) {
+	p := testTCPProvider(t, "tcps://127.0.0.1:1", map[string]string{retryMaxAttemptsProperty: "1"})
+	if err := p.Publish(context.Background(), "", "report"); err == nil {
+		t.Fatal("published without TLS configuration")
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for version, want := range map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	} {
+		if got, err := parseTLSVersion(version); err != nil || got != want {
+			t.Errorf("%s parsed as %x, %v", version, got, err)
+		}
+	}
+	for _, version := range []string{"", "1.4", "TLS1.2", "1"} {
+		if _, err := parseTLSVersion(version); err == nil {
+			t.Errorf("invalid version %q accepted", version)
+		}
+		if _, err := newTCPProvider(Subscriber{URI: "tcps://127.0.0.1:1", Properties: map[string]string{tcpsMinVersionProperty: version}}); err == nil {
+			t.Errorf("provider with min version %q created", version)
+		}
+	}
+	if _, err := newTCPProvider(Subscriber{URI: "tcp://127.0.0.1:1", Properties: map[string]string{tcpsMinVersionProperty: "1.2"}}); err == nil {
+		t.Error("min version accepted for the tcp scheme")
+	}
+}
@@ -0,0 +1,371 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	loglib "github.com/menucha-de/logging"
+	"github.com/menucha-de/utils"
+)
+
+//Transport transport service owning the subscribers and subscriptors
+//persisted in its configuration directory
+type Transport struct {
+	dir        string
+	certFolder string
+	lg         *loglib.Logger
+
+	config    *SubscriberConfiguration
+	manager   *subscriptorManager
+	secKeys   map[string]string
+	secKeysMu sync.Mutex
+
+	outboxes   map[string]*outbox
+	outboxesMu sync.Mutex
+
+	queues   map[string]*queue
+	queuesMu sync.Mutex
+
+	statuses   map[string]*statusTracker
+	statusesMu sync.Mutex
+
+	metrics        map[string]*subscriberMetrics
+	metricsMu      sync.Mutex
+	metricsEnabled int32
+
+	streams   map[string]*stream
+	streamsMu sync.Mutex
+
+	inflight *inflight
+}
+
+//Option configures a transport service
+type Option func(*Transport)
+
+//WithDirectory sets the configuration directory, defaults to ./conf/transport
+func WithDirectory(dir string) Option {
+	return func(t *Transport) {
+		t.dir = dir
+	}
+}
+
+//WithCertFolder sets the folder of the subscriber certificates, defaults to
+//the certs folder inside of the configuration directory
+func WithCertFolder(dir string) Option {
+	return func(t *Transport) {
+		t.certFolder = dir
+	}
+}
+
+//WithLogger sets the logger of the service
+func WithLogger(l *loglib.Logger) Option {
+	return func(t *Transport) {
+		t.lg = l
+	}
+}
+
+//WithMetrics exposes the delivery metrics at /rest/subscribers/metrics
+func WithMetrics() Option {
+	return func(t *Transport) {
+		t.metricsEnabled = 1
+	}
+}
+
+var instances = make(map[*Transport]struct{})
+var instancesMu sync.Mutex
+
+var defaultTransport *Transport
+var defaultOnce sync.Once
+
+//New creates a transport service, it has to be started using Start
+func New(opts ...Option) *Transport {
+	t := &Transport{
+		dir:      dirname,
+		lg:       lg,
+		secKeys:  make(map[string]string),
+		outboxes: make(map[string]*outbox),
+		queues:   make(map[string]*queue),
+		statuses: make(map[string]*statusTracker),
+		metrics:  make(map[string]*subscriberMetrics),
+		streams:  make(map[string]*stream),
+		inflight: newInflight(),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.certFolder == "" {
+		t.certFolder = t.dir + "/certs"
+	}
+	t.config = initConfiguration()
+	t.config.t = t
+	t.manager = newSubscriptorManager(t)
+	return t
+}
+
+//Default returns the transport service used by the package level functions
+//and TransportRoutes. It is started on first use.
+func Default() *Transport {
+	defaultOnce.Do(func() {
+		defaultTransport = New()
+		err := defaultTransport.Start()
+		if err != nil {
+			defaultTransport.lg.WithError(err).Error("Failed to start transport")
+		}
+	})
+	return defaultTransport
+}
+
+//Start loads the configuration and connects the enabled subscribers
+func (t *Transport) Start() error {
+	if _, err := os.Stat(t.dir); os.IsNotExist(err) {
+		err = os.MkdirAll(t.dir, 0700)
+		if err != nil {
+			return err
+		}
+	}
+	instancesMu.Lock()
+	if _, ok := instances[t]; ok {
+		instancesMu.Unlock()
+		return errors.New("Transport already started")
+	}
+	instances[t] = struct{}{}
+	instancesMu.Unlock()
+
+	f, err := os.Open(t.filename())
+	// if we os.Open returns an error then handle it
+	if err == nil {
+		var c *SubscriberConfiguration
+		dec := json.NewDecoder(f)
+		err = dec.Decode(&c)
+		f.Close()
+
+		if err != nil || c == nil {
+			t.lg.Warning("Failed to parse config")
+		} else {
+			t.config.mu.Lock()
+			for id, v := range c.Subscribers {
+				v.t = t
+				t.config.Subscribers[id] = v
+			}
+			t.config.mu.Unlock()
+		}
+	} else {
+		t.lg.WithError(err).Debug("Failed to read config")
+	}
+	t.config.mu.Lock()
+	for _, v := range t.config.Subscribers {
+		if v.Enable {
+			if _, ok := lookupProvider(schemeOf(v.URI)); !ok {
+				// started as soon as the provider is registered
+				continue
+			}
+			err = v.connect()
+			if err != nil {
+				t.lg.WithError(err).Warning("Failed to create provider")
+				if v.Provider == nil {
+					v.status().failed(err)
+				}
+			}
+		}
+	}
+	t.config.mu.Unlock()
+	t.manager.load()
+	return nil
+}
+
+//Close shuts down the providers of the subscribers immediately, see
+//Shutdown for a graceful shutdown
+func (t *Transport) Close() error {
+	instancesMu.Lock()
+	delete(instances, t)
+	instancesMu.Unlock()
+
+	t.config.mu.Lock()
+	for _, v := range t.config.Subscribers {
+		if v.Provider != nil {
+			v.Provider.Shutdown()
+			v.Provider = nil
+		}
+	}
+	t.config.mu.Unlock()
+
+	t.queuesMu.Lock()
+	ids := make([]string, 0, len(t.queues))
+	for id := range t.queues {
+		ids = append(ids, id)
+	}
+	t.queuesMu.Unlock()
+	for _, id := range ids {
+		t.closeQueue(id, func(j job) {
+			t.persist(id, j)
+			t.inflight.end(id)
+		})
+	}
+
+	t.outboxesMu.Lock()
+	for id, o := range t.outboxes {
+		o.close()
+		delete(t.outboxes, id)
+	}
+	t.outboxesMu.Unlock()
+
+	t.streamsMu.Lock()
+	for _, st := range t.streams {
+		st.close()
+	}
+	t.streamsMu.Unlock()
+	return nil
+}
+
+//EnableMetrics exposes the delivery metrics at /rest/subscribers/metrics
+func (t *Transport) EnableMetrics() {
+	atomic.StoreInt32(&t.metricsEnabled, 1)
+}
+
+//Routes returns the REST routes of the service
+func (t *Transport) Routes() []utils.Route {
+	return newRoutes(func() *Transport { return t })
+}
+
+//AddSubscriptor  add a subscriptor
+func (t *Transport) AddSubscriptor(sub Subscriptor) error {
+	return t.manager.add(sub)
+}
+
+//DefineSubscriptor define a subscriptor
+func (t *Transport) DefineSubscriptor(sub Subscriptor) (string, error) {
+	return t.manager.define(sub)
+}
+
+//UpdateSubscriptor update a subscriptor
+func (t *Transport) UpdateSubscriptor(sub Subscriptor) error {
+	return t.manager.update(sub)
+}
+
+//DeleteSubscriptor deletes a subscriptor
+func (t *Transport) DeleteSubscriptor(id string) error {
+	return t.manager.delete(id)
+}
+
+//SendReport --send a report to the subscriber of the subscriptor. Reports
+//are queued and published by the workers of the subscriber, in this case
+//the context only bounds the queuing. Subscribers without workers publish
+//synchronously and the context bounds the delivery. ErrPublishInFlight is
+//returned if the delivery of a synchronous publish was not confirmed in
+//time, the report is still delivered and must not be sent again.
+//ErrQueuedForRedelivery is returned if a synchronous publish failed and the
+//report has been queued in the resend queue of the subscriber.
+func (t *Transport) SendReport(ctx context.Context, subscriptor Subscriptor, report interface{}) error {
+	s, ok := t.subscriber(subscriptor.SubscriberID)
+	if !ok {
+		t.lg.Error("Subscriptor subscriber does not exist")
+		return errors.New("Subscriptor subscriber does not exist")
+	}
+	if s.Provider == nil {
+		return errors.New("Subscriber with ID " + s.ID + " is not connected")
+	}
+	if !t.inflight.begin(s.ID) {
+		return ErrShutdown
+	}
+	for q := t.getQueue(s.ID); q != nil; q = t.getQueue(s.ID) {
+		err := q.put(ctx, job{subscriptor.Path, report})
+		if err == errQueueClosed {
+			// replaced or removed meanwhile
+			continue
+		}
+		if err != nil {
+			t.inflight.end(s.ID)
+		}
+		return err
+	}
+	defer t.inflight.end(s.ID)
+	return t.deliver(ctx, s.ID, subscriptor.Path, report)
+}
+
+// deliver publishes a report, reports which can't be delivered are queued
+// for redelivery. Reports which fail permanently or do not fit into the
+// resend queue are dead lettered, reports failing permanently are dropped
+// if the subscriber has no dead letter destination.
+func (t *Transport) deliver(ctx context.Context, id string, topic string, report interface{}) error {
+	s, ok := t.subscriber(id)
+	if !ok || s.Provider == nil {
+		return errors.New("Subscriber with ID " + id + " is not connected")
+	}
+	o := t.getOutbox(id)
+	if o == nil {
+		err := s.Provider.Publish(ctx, topic, report)
+		if err != nil && !inFlight(err) && ctx.Err() == nil {
+			t.deadLetter(&s, topic, report, err)
+		}
+		return err
+	}
+	// keep the order while undelivered reports are waiting
+	if o.pending() {
+		err := o.put(topic, report)
+		if err != nil {
+			t.deadLetter(&s, topic, report, err)
+			return err
+		}
+		return ErrQueuedForRedelivery
+	}
+	err := s.Provider.Publish(ctx, topic, report)
+	if err != nil && !inFlight(err) && ctx.Err() == nil {
+		if permanentFailure(err) && t.discard(&s, topic, report, err) {
+			return err
+		}
+		t.lg.WithError(err).Warning("Failed to send report, queued for redelivery")
+		if perr := o.put(topic, report); perr != nil {
+			t.deadLetter(&s, topic, report, err)
+			return perr
+		}
+		return ErrQueuedForRedelivery
+	}
+	return err
+}
+
+// subscriber returns a copy of the subscriber taken while holding the
+// configuration lock, its provider stays usable after the subscriber is
+// replaced or closed
+func (t *Transport) subscriber(id string) (Subscriber, bool) {
+	t.config.mu.RLock()
+	defer t.config.mu.RUnlock()
+	s, ok := t.config.Subscribers[id]
+	if !ok {
+		return Subscriber{}, false
+	}
+	return *s, true
+}
+
+func (t *Transport) filename() string {
+	return t.dir + "/subscribers.json"
+}
+
+func (t *Transport) subscriptorsFilename() string {
+	return t.dir + "/subscriptors.json"
+}
+
+func (t *Transport) outboxFolder() string {
+	return t.dir + "/outbox"
+}
+
+func (t *Transport) mqttStoreFolder() string {
+	return t.dir + "/mqtt"
+}
+
+// providerRegistered starts the pending subscribers of all started services
+// using the scheme
+func providerRegistered(scheme string) {
+	instancesMu.Lock()
+	started := make([]*Transport, 0, len(instances))
+	for t := range instances {
+		started = append(started, t)
+	}
+	instancesMu.Unlock()
+	for _, t := range started {
+		t.config.start(scheme)
+	}
+}
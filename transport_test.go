@@ -0,0 +1,334 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeProvider test provider, fake://ok publishes, fake://slow publishes
+// after 20ms, fake://fail fails transiently, fake://reject fails permanently
+// and fake://inflight does not confirm the delivery. Other hosts publish
+// unless they are marked down using fakeDown. The publishes are counted per
+// host and the delivered reports are recorded, fake://tls records the id its
+// TLS material is applied for. fake://refused is returned along with a
+// connection error like a MQTT client connecting in the background, the
+// shutdowns of its providers are counted.
+type fakeProvider struct {
+	host string
+}
+
+var fakeShutdowns int64
+var fakePublishes sync.Map
+var fakeDelivered sync.Map
+var fakeDownHosts sync.Map
+var fakeTLS sync.Map
+
+func init() {
+	RegisterProvider("fake", func(s Subscriber) (Provider, bool, error) {
+		u, err := url.Parse(s.URI)
+		if err != nil {
+			return nil, false, err
+		}
+		if u.Host == "refused" {
+			return &fakeProvider{host: u.Host}, false, errors.New("connection refused")
+		}
+		return &fakeProvider{host: u.Host}, u.Host == "tls", nil
+	})
+}
+
+func fakeCount(host string) int64 {
+	n, _ := fakePublishes.LoadOrStore(host, new(int64))
+	return atomic.LoadInt64(n.(*int64))
+}
+
+// fakeDown marks the host as unreachable until the returned function is
+// called
+func fakeDown(host string) func() {
+	fakeDownHosts.Store(host, true)
+	return func() {
+		fakeDownHosts.Delete(host)
+	}
+}
+
+// fakeReports returns the reports delivered to the host
+func fakeReports(host string) []string {
+	l, _ := fakeDelivered.LoadOrStore(host, &fakeLog{})
+	return l.(*fakeLog).reports()
+}
+
+type fakeLog struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *fakeLog) add(m interface{}) {
+	var report string
+	switch m := m.(type) {
+	case []byte:
+		report = string(m)
+	case string:
+		report = m
+	default:
+		b, _ := json.Marshal(m)
+		report = string(b)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, report)
+}
+
+func (l *fakeLog) reports() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.entries...)
+}
+
+func (p *fakeProvider) Publish(ctx context.Context, topic string, m interface{}) error {
+	if p.host == "slow" {
+		time.Sleep(20 * time.Millisecond)
+	}
+	n, _ := fakePublishes.LoadOrStore(p.host, new(int64))
+	atomic.AddInt64(n.(*int64), 1)
+	if _, down := fakeDownHosts.Load(p.host); down {
+		return errors.New("unreachable")
+	}
+	switch p.host {
+	case "fail":
+		return errors.New("unreachable")
+	case "reject":
+		return &deliveryError{err: errors.New("rejected"), permanent: true}
+	case "inflight":
+		return ErrPublishInFlight
+	}
+	l, _ := fakeDelivered.LoadOrStore(p.host, &fakeLog{})
+	l.(*fakeLog).add(m)
+	return nil
+}
+
+func (p *fakeProvider) Shutdown() {
+	if p.host == "refused" {
+		atomic.AddInt64(&fakeShutdowns, 1)
+	}
+}
+
+func (p *fakeProvider) SetTLS(id string) error {
+	fakeTLS.Store(p.host, id)
+	return nil
+}
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// newTestTransport starts a transport in a temporary directory unless the
+// options set another one
+func newTestTransport(t *testing.T, opts ...Option) *Transport {
+	tr := New(append([]Option{WithDirectory(testDir(t))}, opts...)...)
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestSendReportConcurrentWithConfigurationChanges(t *testing.T) {
+	for _, workers := range []string{"0", "2"} {
+		t.Run("workers="+workers, func(t *testing.T) {
+			tr := newTestTransport(t)
+			properties := map[string]string{queueWorkersProperty: workers}
+			id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://ok", Properties: properties})
+			if err != nil {
+				t.Fatal(err)
+			}
+			subscriptor := Subscriptor{SubscriberID: id, Path: "a"}
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						tr.SendReport(context.Background(), subscriptor, "report")
+					}
+				}()
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					tr.config.set(Subscriber{ID: id, Enable: true, URI: "fake://ok", Properties: properties})
+				}
+			}()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					other, err := tr.config.add(Subscriber{Enable: true, URI: "fake://ok", Properties: properties})
+					if err == nil {
+						tr.config.delete(other)
+					}
+				}
+			}()
+			time.Sleep(50 * time.Millisecond)
+			tr.Close()
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func TestSendReportConcurrentWithDelete(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://ok", Properties: map[string]string{queueWorkersProperty: "0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tr.SendReport(context.Background(), Subscriptor{SubscriberID: id}, "report")
+			}
+		}()
+	}
+	tr.config.delete(id)
+	wg.Wait()
+	err = tr.SendReport(context.Background(), Subscriptor{SubscriberID: id}, "report")
+	if err == nil {
+		t.Fatal("report sent to a deleted subscriber")
+	}
+}
+
+func TestSendReportInFlightNotRedelivered(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://inflight", Properties: map[string]string{queueWorkersProperty: "0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = tr.SendReport(context.Background(), Subscriptor{SubscriberID: id}, "report")
+		if !errors.Is(err, ErrPublishInFlight) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if n := tr.getOutbox(id).count(); n != 0 {
+		t.Fatalf("%d reports queued for redelivery", n)
+	}
+	c, err := tr.circuit(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.State != CircuitClosed || c.Failures != 0 {
+		t.Fatalf("publishes in flight counted as failures %+v", c)
+	}
+}
+
+func TestRejectedSubscriberDisconnects(t *testing.T) {
+	tr := newTestTransport(t)
+	defer tr.Close()
+	shutdowns := atomic.LoadInt64(&fakeShutdowns)
+	if _, err := tr.config.add(Subscriber{Enable: true, URI: "fake://refused"}); err == nil {
+		t.Fatal("subscriber added")
+	}
+	if n := atomic.LoadInt64(&fakeShutdowns) - shutdowns; n != 1 {
+		t.Fatalf("%d providers shut down, want 1", n)
+	}
+	if len(tr.outboxes) != 0 || len(tr.queues) != 0 {
+		t.Fatalf("%d outboxes and %d queues kept", len(tr.outboxes), len(tr.queues))
+	}
+
+	id, err := tr.config.add(Subscriber{Enable: true, URI: "fake://ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.config.set(Subscriber{ID: id, Enable: true, URI: "fake://refused"}); err == nil {
+		t.Fatal("subscriber replaced")
+	}
+	if n := atomic.LoadInt64(&fakeShutdowns) - shutdowns; n != 2 {
+		t.Fatalf("%d providers shut down, want 2", n)
+	}
+}
+
+func TestTransportInstancesAreIndependent(t *testing.T) {
+	dirA, dirB := testDir(t), testDir(t)
+	a, b := New(WithDirectory(dirA)), New(WithDirectory(dirB))
+	for _, tr := range []*Transport{a, b} {
+		if err := tr.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Start(); err == nil {
+		t.Fatal("transport started twice")
+	}
+	id, err := a.config.add(Subscriber{Enable: true, URI: "fake://instances"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := Subscriptor{Enable: true, Name: "s", Path: "p", SubscriberID: id}
+	if err := a.AddSubscriptor(sub); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddSubscriptor(sub); err == nil {
+		t.Fatal("subscriptor of a subscriber of another instance added")
+	}
+	if err := a.SendReport(context.Background(), sub, "report"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := b.subscriber(id); ok {
+		t.Fatal("subscriber shared")
+	}
+	if len(b.manager.list("")) != 0 || b.getOutbox(id) != nil || b.getQueue(id) != nil {
+		t.Fatal("registries shared")
+	}
+	if s, _ := a.subscriber(id); s.certRoot() != dirA+"/certs" || s.storeFolder("mqtt") != dirA+"/mqtt/"+id {
+		t.Fatalf("subscriber uses %s and %s", s.certRoot(), s.storeFolder("mqtt"))
+	}
+	if b.certFolder != dirB+"/certs" {
+		t.Fatalf("certificates of the second instance in %s", b.certFolder)
+	}
+	for _, tr := range []*Transport{a, b} {
+		if err := tr.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the configuration is read from the directory of the instance only
+	for dir, subscribers := range map[string]int{dirA: 1, dirB: 0} {
+		tr := New(WithDirectory(dir))
+		if err := tr.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(tr.config.Subscribers); n != subscribers {
+			t.Errorf("%d subscribers loaded from %s, want %d", n, dir, subscribers)
+		}
+		if n := len(tr.manager.list("")); n != subscribers {
+			t.Errorf("%d subscriptors loaded from %s, want %d", n, dir, subscribers)
+		}
+		tr.Close()
+	}
+}
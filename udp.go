@@ -0,0 +1,348 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	loglib "github.com/menucha-de/logging"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type udpclient struct {
+	URI       string
+	timeout   int
+	enc       Encoder
+	retry     *retryPolicy
+	status    *statusTracker
+	metrics   *subscriberMetrics
+	lg        *loglib.Logger
+	maxSize   int
+	ttl       int
+	iface     string
+	loopback  *bool
+	broadcast bool
+	mu        sync.Mutex
+	conn      *net.UDPConn
+}
+
+var udpTimeoutProperty string = prefix + "UDP.Timeout"
+var udpMaxDatagramSizeProperty string = prefix + "UDP.MaxDatagramSize"
+var udpMulticastTTLProperty string = prefix + "UDP.MulticastTTL"
+var udpMulticastInterfaceProperty string = prefix + "UDP.MulticastInterface"
+var udpMulticastLoopbackProperty string = prefix + "UDP.MulticastLoopback"
+var udpBroadcastProperty string = prefix + "UDP.Broadcast"
+
+// maxDatagramSize is the largest UDP payload over IPv4
+const maxDatagramSize = 65507
+
+func init() {
+	RegisterProvider("udp", udpFactory)
+}
+
+func udpFactory(s Subscriber) (Provider, bool, error) {
+	p, err := newUDPProvider(s)
+	if err != nil {
+		return nil, false, err
+	}
+	return p, false, nil
+}
+
+func newUDPProvider(s Subscriber) (*udpclient, error) {
+	defaultTimeout = 1000
+	if s.URI == "" {
+		s.logger().Error("URI Can't be null")
+		return nil, errors.New("URI must not be null")
+	}
+	u, err := url.Parse(s.URI)
+	if err != nil {
+		s.logger().Error("Can't parse subscriber URI")
+		return nil, err
+	}
+	if strings.ToLower(u.Scheme) != "udp" {
+		s.logger().Error("Unknown scheme " + u.Scheme)
+		return nil, errors.New("Unknown scheme " + u.Scheme)
+	}
+	if u.Hostname() == "" {
+		s.logger().Error("No host specified")
+		return nil, errors.New("No host specified")
+	}
+	if u.Port() == "" {
+		s.logger().Error("No port specified")
+		return nil, errors.New("No port specified")
+	}
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicy(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &udpclient{
+		URI:     s.URI,
+		timeout: defaultTimeout,
+		enc:     enc,
+		retry:   retry,
+		status:  s.status(),
+		metrics: s.metrics(),
+		lg:      s.logger(),
+		maxSize: maxDatagramSize,
+		ttl:     -1,
+	}
+	multicast := false
+	for key, property := range s.Properties {
+		if key == "" || !strings.HasPrefix(key, prefix+"UDP") {
+			continue
+		}
+		switch key {
+		case udpTimeoutProperty:
+			c.timeout, err = strconv.Atoi(property)
+			if err != nil || c.timeout < 0 {
+				s.logger().Error("Invalid timeout value '" + property + "'")
+				return nil, errors.New("Invalid timeout value '" + property + "'")
+			}
+		case udpMaxDatagramSizeProperty:
+			c.maxSize, err = strconv.Atoi(property)
+			if err != nil || c.maxSize < 1 || c.maxSize > maxDatagramSize {
+				s.logger().Error("Invalid " + udpMaxDatagramSizeProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + udpMaxDatagramSizeProperty + " '" + property + "', must be between 1 and " + strconv.Itoa(maxDatagramSize))
+			}
+		case udpMulticastTTLProperty:
+			c.ttl, err = strconv.Atoi(property)
+			if err != nil || c.ttl < 0 || c.ttl > 255 {
+				s.logger().Error("Invalid " + udpMulticastTTLProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + udpMulticastTTLProperty + " '" + property + "', must be between 0 and 255")
+			}
+			multicast = true
+		case udpMulticastInterfaceProperty:
+			if _, err := net.InterfaceByName(property); err != nil {
+				s.logger().Error("Invalid " + udpMulticastInterfaceProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + udpMulticastInterfaceProperty + " '" + property + "': " + err.Error())
+			}
+			c.iface = property
+			multicast = true
+		case udpMulticastLoopbackProperty:
+			loopback, err := strconv.ParseBool(property)
+			if err != nil {
+				s.logger().Error("Invalid " + udpMulticastLoopbackProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + udpMulticastLoopbackProperty + " '" + property + "'")
+			}
+			c.loopback = &loopback
+			multicast = true
+		case udpBroadcastProperty:
+			c.broadcast, err = strconv.ParseBool(property)
+			if err != nil {
+				s.logger().Error("Invalid " + udpBroadcastProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + udpBroadcastProperty + " '" + property + "'")
+			}
+		default:
+			s.logger().Error("Unknown property key '" + key + "'")
+			return nil, errors.New("Unknown property key '" + key + "'")
+		}
+	}
+
+	// destinations given by name are checked once resolved
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		if err := c.checkDestination(ip, multicast); err != nil {
+			s.logger().Error(err.Error())
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// multicast reports whether multicast options are configured
+func (c *udpclient) multicast() bool {
+	return c.ttl >= 0 || c.iface != "" || c.loopback != nil
+}
+
+// checkDestination validates the options against the destination address
+func (c *udpclient) checkDestination(ip net.IP, multicast bool) error {
+	if multicast && !ip.IsMulticast() {
+		return errors.New("Multicast properties require a multicast destination, " + ip.String() + " is not")
+	}
+	if !c.broadcast && isBroadcast(ip) {
+		return errors.New("Sending to the broadcast address " + ip.String() + " requires " + udpBroadcastProperty)
+	}
+	return nil
+}
+
+// isBroadcast reports whether ip is the limited broadcast address or the
+// directed broadcast address of a local network
+func isBroadcast(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok || n.IP.To4() == nil || len(n.Mask) != net.IPv4len {
+			continue
+		}
+		ones, bits := n.Mask.Size()
+		if bits-ones < 2 {
+			// point to point and single host networks have no broadcast address
+			continue
+		}
+		b := make(net.IP, net.IPv4len)
+		for i := range b {
+			b[i] = n.IP.To4()[i] | ^n.Mask[i]
+		}
+		if b.Equal(ip4) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *udpclient) Publish(ctx context.Context, topic string, message interface{}) error {
+	if c == nil {
+		return errors.New("UDP client not initialized")
+	}
+
+	str, err := c.enc.Encode(message)
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	if len(str) > c.maxSize {
+		// the report will never fit into a datagram
+		err := errors.New("Report of " + strconv.Itoa(len(str)) + " bytes exceeds the max datagram size of " + strconv.Itoa(c.maxSize) + " bytes")
+		c.lg.Error(err.Error())
+		return &deliveryError{err: err, permanent: true}
+	}
+	return c.retry.do(ctx, func(ctx context.Context) error {
+		return c.send(ctx, str)
+	})
+}
+
+// send makes a single attempt to deliver the report as one datagram, the
+// socket is kept open and opened again once a write failed
+func (c *udpclient) send(ctx context.Context, datagram []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.timeout)*time.Millisecond)
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			c.lg.Error("Dial failed:", err.Error())
+			c.status.disconnected(err)
+			return err
+		}
+		c.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	n, err := c.conn.Write(datagram)
+	c.metrics.sent(n)
+	if err != nil {
+		c.lg.Error("Write to server failed:", err.Error())
+		c.status.disconnected(err)
+		c.close()
+		return err
+	}
+	c.status.connected()
+	return nil
+}
+
+// dial opens the socket and applies the multicast options
+func (c *udpclient) dial(ctx context.Context) (*net.UDPConn, error) {
+	u, _ := url.Parse(c.URI)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	udp := conn.(*net.UDPConn)
+	ip := udp.RemoteAddr().(*net.UDPAddr).IP
+	if err := c.checkDestination(ip, c.multicast()); err != nil {
+		udp.Close()
+		return nil, &permanentError{err}
+	}
+	if ip.IsMulticast() {
+		if err := c.setMulticastOptions(udp, ip); err != nil {
+			udp.Close()
+			return nil, err
+		}
+	}
+	return udp, nil
+}
+
+func (c *udpclient) setMulticastOptions(conn *net.UDPConn, ip net.IP) error {
+	var ifi *net.Interface
+	if c.iface != "" {
+		var err error
+		ifi, err = net.InterfaceByName(c.iface)
+		if err != nil {
+			return err
+		}
+	}
+	if ip.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		if c.ttl >= 0 {
+			if err := p.SetMulticastTTL(c.ttl); err != nil {
+				return err
+			}
+		}
+		if ifi != nil {
+			if err := p.SetMulticastInterface(ifi); err != nil {
+				return err
+			}
+		}
+		if c.loopback != nil {
+			return p.SetMulticastLoopback(*c.loopback)
+		}
+		return nil
+	}
+	p := ipv6.NewPacketConn(conn)
+	if c.ttl >= 0 {
+		if err := p.SetMulticastHopLimit(c.ttl); err != nil {
+			return err
+		}
+	}
+	if ifi != nil {
+		if err := p.SetMulticastInterface(ifi); err != nil {
+			return err
+		}
+	}
+	if c.loopback != nil {
+		return p.SetMulticastLoopback(*c.loopback)
+	}
+	return nil
+}
+
+// close closes the socket, c.mu has to be held
+func (c *udpclient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *udpclient) Shutdown() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.close()
+}
+func (c *udpclient) SetTLS(id string) error {
+	return nil
+}
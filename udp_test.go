@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func listenUDP(t *testing.T, address string) *net.UDPConn {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receiveUDP(t *testing.T, conn *net.UDPConn) string {
+	buf := make([]byte, maxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func testUDPProvider(t *testing.T, uri string, properties map[string]string) *udpclient {
+	p, err := newUDPProvider(Subscriber{URI: uri, Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+	return p
+}
+
+func TestUDPDatagramSize(t *testing.T) {
+	conn := listenUDP(t, "127.0.0.1:0")
+	p := testUDPProvider(t, "udp://"+conn.LocalAddr().String(), map[string]string{
+		udpMaxDatagramSizeProperty: "10",
+	})
+	if err := p.Publish(context.Background(), "", "0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveUDP(t, conn); got != "0123456789" {
+		t.Fatalf("received %q", got)
+	}
+	err := p.Publish(context.Background(), "", "0123456789a")
+	var derr *deliveryError
+	if !errors.As(err, &derr) || !permanentFailure(err) {
+		t.Fatalf("oversize report returned %v", err)
+	}
+	// nothing but the following report is sent
+	if err := p.Publish(context.Background(), "", "next"); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveUDP(t, conn); got != "next" {
+		t.Fatalf("received %q", got)
+	}
+	for _, size := range []string{"0", "65508", "x"} {
+		if _, err := newUDPProvider(Subscriber{URI: "udp://127.0.0.1:1", Properties: map[string]string{udpMaxDatagramSizeProperty: size}}); err == nil {
+			t.Errorf("max datagram size %s accepted", size)
+		}
+	}
+}
+
+// multicastInterface returns an interface which is up and supports
+// multicast
+func multicastInterface(t *testing.T) *net.Interface {
+	ifis, _ := net.Interfaces()
+	for i := range ifis {
+		if ifis[i].Flags&net.FlagUp != 0 && ifis[i].Flags&net.FlagMulticast != 0 {
+			return &ifis[i]
+		}
+	}
+	t.Skip("no multicast interface")
+	return nil
+}
+
+func TestUDPMulticast(t *testing.T) {
+	ifi := multicastInterface(t)
+	group := net.IPv4(239, 255, 0, 1)
+	conn := listenUDP(t, "0.0.0.0:0")
+	if err := ipv4.NewPacketConn(conn).JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
+		t.Skip("joining the group failed: " + err.Error())
+	}
+	port := strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+	p := testUDPProvider(t, "udp://"+group.String()+":"+port, map[string]string{
+		udpMulticastTTLProperty:       "3",
+		udpMulticastInterfaceProperty: ifi.Name,
+		udpMulticastLoopbackProperty:  "true",
+	})
+	if err := p.Publish(context.Background(), "", "report"); err != nil {
+		t.Fatal(err)
+	}
+	// looped back by the interface the group was joined on
+	if got := receiveUDP(t, conn); got != "report" {
+		t.Fatalf("received %q", got)
+	}
+	pc := ipv4.NewPacketConn(p.conn)
+	if ttl, err := pc.MulticastTTL(); err != nil || ttl != 3 {
+		t.Fatalf("multicast TTL %d, %v", ttl, err)
+	}
+	if loopback, err := pc.MulticastLoopback(); err != nil || !loopback {
+		t.Fatalf("multicast loopback %v, %v", loopback, err)
+	}
+
+	for _, tc := range []struct {
+		uri        string
+		properties map[string]string
+	}{
+		{"udp://127.0.0.1:1", map[string]string{udpMulticastTTLProperty: "3"}},
+		{"udp://239.255.0.1:1", map[string]string{udpMulticastTTLProperty: "256"}},
+		{"udp://239.255.0.1:1", map[string]string{udpMulticastInterfaceProperty: "unknown0"}},
+		{"udp://239.255.0.1:1", map[string]string{udpMulticastLoopbackProperty: "maybe"}},
+	} {
+		if _, err := newUDPProvider(Subscriber{URI: tc.uri, Properties: tc.properties}); err == nil {
+			t.Errorf("%s with %v accepted", tc.uri, tc.properties)
+		}
+	}
+}
+
+func TestUDPBroadcast(t *testing.T) {
+	if _, err := newUDPProvider(Subscriber{URI: "udp://255.255.255.255:1"}); err == nil || !strings.Contains(err.Error(), udpBroadcastProperty) {
+		t.Fatalf("broadcast without %s returned %v", udpBroadcastProperty, err)
+	}
+	conn := listenUDP(t, "0.0.0.0:0")
+	port := strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+	p := testUDPProvider(t, "udp://255.255.255.255:"+port, map[string]string{udpBroadcastProperty: "true"})
+	if err := p.Publish(context.Background(), "", "report"); err != nil {
+		t.Skip("broadcast not routable: " + err.Error())
+	}
+	if got := receiveUDP(t, conn); got != "report" {
+		t.Fatalf("received %q", got)
+	}
+}
@@ -0,0 +1,374 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	loglib "github.com/menucha-de/logging"
+)
+
+type wsclient struct {
+	URI          string
+	header       http.Header
+	subprotocols []string
+	messageType  int
+	pingInterval time.Duration
+	timeout      int
+	enc          Encoder
+	retry        *retryPolicy
+	status       *statusTracker
+	metrics      *subscriberMetrics
+	lg           *loglib.Logger
+	certs        string
+	secure       bool
+	tlsConfig    *tls.Config
+	mu           sync.Mutex
+	conn         *websocket.Conn
+	closed       bool
+	stop         chan struct{}
+}
+
+var defaultWebSocketTimeout int = 10000
+var defaultWebSocketPingInterval int = 30000
+var webSocketTimeoutProperty string = prefix + "WebSocket.Timeout"
+var webSocketPingIntervalProperty string = prefix + "WebSocket.PingInterval"
+var webSocketSubprotocolProperty string = prefix + "WebSocket.Subprotocol"
+var webSocketMessageTypeProperty string = prefix + "WebSocket.MessageType"
+var webSocketHeaderProperty string = prefix + "WebSocket.Header."
+
+func init() {
+	RegisterProvider("ws", wsFactory)
+	RegisterProvider("wss", wsFactory)
+}
+
+func wsFactory(s Subscriber) (Provider, bool, error) {
+	p, err := newWebSocketProvider(s)
+	if p == nil {
+		return nil, false, err
+	}
+	// keep the client on connection errors, it connects again on publish
+	return p, p.secure, err
+}
+
+// textual reports whether reports of the content type are sent as text frames
+func textual(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" || mediaType == "application/xml" ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+func newWebSocketProvider(s Subscriber) (*wsclient, error) {
+	if s.URI == "" {
+		s.logger().Error("URI Can't be null")
+		return nil, errors.New("URI must not be null")
+	}
+	u, err := url.Parse(s.URI)
+	if err != nil {
+		s.logger().Error("Can't parse subscriber URI")
+		return nil, err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "ws" && scheme != "wss" {
+		s.logger().Error("Unknown scheme '" + u.Scheme + "'")
+		return nil, errors.New("Unknown scheme '" + u.Scheme + "'")
+	}
+	if u.Hostname() == "" {
+		s.logger().Error("No host specified")
+		return nil, errors.New("No host specified")
+	}
+	enc, err := newEncoder(s)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicy(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &wsclient{
+		URI:          s.URI,
+		header:       make(http.Header),
+		messageType:  websocket.BinaryMessage,
+		pingInterval: time.Duration(defaultWebSocketPingInterval) * time.Millisecond,
+		timeout:      defaultWebSocketTimeout,
+		enc:          enc,
+		retry:        retry,
+		status:       s.status(),
+		metrics:      s.metrics(),
+		lg:           s.logger(),
+		certs:        s.certRoot(),
+		secure:       scheme == "wss",
+		stop:         make(chan struct{}),
+	}
+	if textual(enc.ContentType()) {
+		c.messageType = websocket.TextMessage
+	}
+	for key, property := range s.Properties {
+		if key == "" || !strings.HasPrefix(key, prefix+"WebSocket") {
+			continue
+		}
+		switch key {
+		case webSocketTimeoutProperty:
+			c.timeout, err = strconv.Atoi(property)
+			if err != nil || c.timeout < 0 {
+				s.logger().Error("Invalid timeout value '" + property + "'")
+				return nil, errors.New("Invalid timeout value '" + property + "'")
+			}
+		case webSocketPingIntervalProperty:
+			interval, err := strconv.Atoi(property)
+			if err != nil || interval < 0 {
+				s.logger().Error("Invalid " + webSocketPingIntervalProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + webSocketPingIntervalProperty + " '" + property + "'")
+			}
+			c.pingInterval = time.Duration(interval) * time.Millisecond
+		case webSocketSubprotocolProperty:
+			for _, protocol := range strings.Split(property, ",") {
+				if protocol = strings.TrimSpace(protocol); protocol != "" {
+					c.subprotocols = append(c.subprotocols, protocol)
+				}
+			}
+		case webSocketMessageTypeProperty:
+			switch property {
+			case "text":
+				c.messageType = websocket.TextMessage
+			case "binary":
+				c.messageType = websocket.BinaryMessage
+			default:
+				s.logger().Error("Invalid " + webSocketMessageTypeProperty + " '" + property + "'")
+				return nil, errors.New("Invalid " + webSocketMessageTypeProperty + " '" + property + "', must be text or binary")
+			}
+		default:
+			name := strings.TrimPrefix(key, webSocketHeaderProperty)
+			if !strings.HasPrefix(key, webSocketHeaderProperty) || name == "" {
+				s.logger().Error("Unknown property key '" + key + "'")
+				return nil, errors.New("Unknown property key '" + key + "'")
+			}
+			c.header.Set(name, property)
+		}
+	}
+	if u.User != nil {
+		// user info is not allowed in WebSocket URIs, it is sent as basic auth
+		if c.header.Get("Authorization") == "" {
+			password, _ := u.User.Password()
+			credentials := u.User.Username() + ":" + password
+			c.header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		}
+		u.User = nil
+		c.URI = u.String()
+	}
+	if !c.secure {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := c.connect(context.Background()); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// connect opens the connection, c.mu has to be held
+func (c *wsclient) connect(ctx context.Context) error {
+	if c.secure && c.tlsConfig == nil {
+		return errors.New("TLS not configured")
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.timeout)*time.Millisecond)
+	defer cancel()
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: time.Duration(c.timeout) * time.Millisecond,
+		Subprotocols:     c.subprotocols,
+		TLSClientConfig:  c.tlsConfig,
+	}
+	c.status.setState(StatusConnecting)
+	conn, resp, err := dialer.DialContext(ctx, c.URI, c.header)
+	if err != nil {
+		if resp != nil {
+			// the handshake was rejected
+			err = &statusError{
+				code:       resp.StatusCode,
+				status:     resp.Status,
+				retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			}
+		}
+		c.lg.Error("Can't connect to " + c.URI + ": " + err.Error())
+		c.status.disconnected(err)
+		return err
+	}
+	c.lg.Info("Connection established")
+	c.status.connected()
+	c.conn = conn
+	done := make(chan struct{})
+	go c.read(conn, done)
+	if c.pingInterval > 0 {
+		go c.ping(conn, done)
+	}
+	return nil
+}
+
+// read discards the messages of the server and answers pings until the
+// connection fails, a lost connection is opened again. The read deadline is
+// extended by the pongs.
+func (c *wsclient) read(conn *websocket.Conn, done chan struct{}) {
+	defer close(done)
+	extend := func() {
+		if c.pingInterval > 0 {
+			conn.SetReadDeadline(time.Now().Add(c.pingInterval + time.Duration(c.timeout)*time.Millisecond))
+		}
+	}
+	extend()
+	conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			c.mu.Lock()
+			if c.conn == conn {
+				// closed by the server or the keep-alive failed
+				c.lg.Error("Connection lost " + err.Error())
+				c.status.disconnected(err)
+				c.conn = nil
+				go c.reconnect(err)
+			}
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+	}
+}
+
+// reconnect opens the lost connection again, the attempts back off like the
+// retries of a publish until the connection is open or the client is shut
+// down
+func (c *wsclient) reconnect(err error) {
+	backoff := c.retry.initialBackoff
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(c.retry.delay(backoff, err)):
+		}
+		c.mu.Lock()
+		if c.closed || c.conn != nil {
+			// shut down or opened by a publish meanwhile
+			c.mu.Unlock()
+			return
+		}
+		c.status.reconnecting()
+		err = c.connect(context.Background())
+		c.mu.Unlock()
+		if err == nil {
+			return
+		}
+		backoff *= 2
+		if backoff > c.retry.maxBackoff {
+			backoff = c.retry.maxBackoff
+		}
+	}
+}
+
+// ping sends the keep-alive pings
+func (c *wsclient) ping(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(time.Duration(c.timeout) * time.Millisecond)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.lg.WithError(err).Debug("WebSocket ping failed")
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *wsclient) Publish(ctx context.Context, topic string, message interface{}) error {
+	if c == nil {
+		return errors.New("WebSocket client not initialized")
+	}
+
+	payload, err := c.enc.Encode(message)
+	if err != nil {
+		c.lg.Error(err.Error())
+		return err
+	}
+	return c.retry.do(ctx, func(ctx context.Context) error {
+		return c.send(ctx, payload)
+	})
+}
+
+// send makes a single attempt to write the report as one frame, the
+// connection is opened again once it failed
+func (c *wsclient) send(ctx context.Context, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.timeout)*time.Millisecond)
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	if err := c.conn.WriteMessage(c.messageType, payload); err != nil {
+		c.lg.Error("Write to server failed:", err.Error())
+		c.status.disconnected(err)
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	c.metrics.sent(len(payload))
+	return nil
+}
+
+// close closes the connection with a close frame, c.mu has to be held
+func (c *wsclient) close() {
+	if c.conn == nil {
+		return
+	}
+	deadline := time.Now().Add(time.Second)
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+	c.conn.Close()
+	c.conn = nil
+}
+
+func (c *wsclient) Shutdown() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.stop)
+	}
+	c.close()
+}
+
+//SetTLS applies the certificates of the subscriber and connects using them
+func (c *wsclient) SetTLS(id string) error {
+	if !c.secure {
+		return nil
+	}
+	config := newTLSConfig(c.certs+"/"+id, c.lg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tlsConfig = config
+	c.close()
+	return c.connect(context.Background())
+}
@@ -0,0 +1,208 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsServer WebSocket endpoint recording the handshakes and the frames
+// received. Connections after the first mute ones are served normally, a
+// muted connection does not read and therefore never answers pings.
+type wsServer struct {
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+	mu       sync.Mutex
+	requests []*http.Request
+	conns    []*websocket.Conn
+	mute     int
+	frames   chan wsFrame
+}
+
+type wsFrame struct {
+	messageType int
+	data        string
+}
+
+func newWSServer(t *testing.T, subprotocols ...string) *wsServer {
+	ws := &wsServer{
+		upgrader: websocket.Upgrader{Subprotocols: subprotocols},
+		frames:   make(chan wsFrame, 100),
+	}
+	ws.srv = httptest.NewServer(http.HandlerFunc(ws.serve))
+	t.Cleanup(ws.close)
+	return ws
+}
+
+func (ws *wsServer) serve(w http.ResponseWriter, r *http.Request) {
+	// recorded before the handshake is answered
+	ws.mu.Lock()
+	ws.requests = append(ws.requests, r)
+	ws.mu.Unlock()
+	conn, err := ws.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	ws.mu.Lock()
+	ws.conns = append(ws.conns, conn)
+	mute := len(ws.conns) <= ws.mute
+	ws.mu.Unlock()
+	if mute {
+		return
+	}
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		ws.frames <- wsFrame{messageType, string(data)}
+	}
+}
+
+func (ws *wsServer) uri(userinfo string) string {
+	return "ws://" + userinfo + strings.TrimPrefix(ws.srv.URL, "http://") + "/reports"
+}
+
+func (ws *wsServer) request(i int) *http.Request {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.requests[i]
+}
+
+func (ws *wsServer) connections() int {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.conns)
+}
+
+// drop closes the connections from the server side
+func (ws *wsServer) drop() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, c := range ws.conns {
+		c.Close()
+	}
+}
+
+func (ws *wsServer) close() {
+	ws.drop()
+	ws.srv.Close()
+}
+
+func (ws *wsServer) receive(t *testing.T) wsFrame {
+	select {
+	case f := <-ws.frames:
+		return f
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame received")
+	}
+	return wsFrame{}
+}
+
+func testWSProvider(t *testing.T, uri string, properties map[string]string) *wsclient {
+	p, err := newWebSocketProvider(Subscriber{URI: uri, Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+	return p
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	ws := newWSServer(t, "v2.reports")
+	p := testWSProvider(t, ws.uri("user:secret@"), map[string]string{
+		webSocketSubprotocolProperty:          "v1.reports, v2.reports",
+		webSocketHeaderProperty + "X-Api-Key": "key",
+	})
+	r := ws.request(0)
+	if got := r.Header.Get("Sec-Websocket-Protocol"); got != "v1.reports, v2.reports" {
+		t.Fatalf("offered subprotocols %q", got)
+	}
+	if p.conn.Subprotocol() != "v2.reports" {
+		t.Fatalf("negotiated subprotocol %q", p.conn.Subprotocol())
+	}
+	if r.Header.Get("X-Api-Key") != "key" {
+		t.Fatalf("handshake headers %v", r.Header)
+	}
+	if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+		t.Fatalf("basic auth %q %q", user, password)
+	}
+}
+
+func TestWebSocketMessageType(t *testing.T) {
+	ws := newWSServer(t)
+	for _, tc := range []struct {
+		properties  map[string]string
+		messageType int
+	}{
+		{nil, websocket.TextMessage},
+		{map[string]string{encodingProperty: "cbor"}, websocket.BinaryMessage},
+		{map[string]string{encodingProperty: "msgpack"}, websocket.BinaryMessage},
+		{map[string]string{webSocketMessageTypeProperty: "binary"}, websocket.BinaryMessage},
+		{map[string]string{encodingProperty: "cbor", webSocketMessageTypeProperty: "text"}, websocket.TextMessage},
+	} {
+		p := testWSProvider(t, ws.uri(""), tc.properties)
+		if err := p.Publish(context.Background(), "", map[string]int{"a": 1}); err != nil {
+			t.Fatal(err)
+		}
+		if f := ws.receive(t); f.messageType != tc.messageType {
+			t.Fatalf("%v sent as frame type %d, want %d", tc.properties, f.messageType, tc.messageType)
+		}
+	}
+	if _, err := newWebSocketProvider(Subscriber{URI: ws.uri(""), Properties: map[string]string{webSocketMessageTypeProperty: "json"}}); err == nil {
+		t.Fatal("invalid message type accepted")
+	}
+}
+
+func TestWebSocketReconnect(t *testing.T) {
+	ws := newWSServer(t)
+	p := testWSProvider(t, ws.uri(""), map[string]string{retryInitialBackoffProperty: "1"})
+	ws.drop()
+	// opened again without waiting for a publish
+	waitFor(t, "reconnect", func() bool {
+		return ws.connections() == 2
+	})
+	if err := p.Publish(context.Background(), "", "report"); err != nil {
+		t.Fatal(err)
+	}
+	if f := ws.receive(t); f.data != "report" {
+		t.Fatalf("received %q", f.data)
+	}
+	if ws.connections() != 2 {
+		t.Fatalf("%d connections, want 2", ws.connections())
+	}
+}
+
+func TestWebSocketReconnectMissingPong(t *testing.T) {
+	ws := newWSServer(t)
+	ws.mute = 1
+	p := testWSProvider(t, ws.uri(""), map[string]string{
+		webSocketPingIntervalProperty: "20",
+		webSocketTimeoutProperty:      "100",
+		retryInitialBackoffProperty:   "1",
+	})
+	waitFor(t, "reconnect", func() bool {
+		return ws.connections() == 2
+	})
+	if err := p.Publish(context.Background(), "", "report"); err != nil {
+		t.Fatal(err)
+	}
+	ws.receive(t)
+}
+
+func TestWebSocketShutdownStopsReconnecting(t *testing.T) {
+	ws := newWSServer(t)
+	p := testWSProvider(t, ws.uri(""), map[string]string{retryInitialBackoffProperty: "20"})
+	ws.drop()
+	p.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+	if n := ws.connections(); n != 1 {
+		t.Fatalf("%d connections after the shutdown", n)
+	}
+}